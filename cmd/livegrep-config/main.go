@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const usage = `Usage: livegrep-config check [-index-config FILE] [CONFIG]
+
+Checks a livegrep frontend config file and/or a codesearch index
+config file, printing every problem found. Exits with status 1 if
+there are any.
+`
+
+func check(file string, checker func([]byte) []config.Problem) int {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("%s: %s\n", file, err.Error())
+		return 1
+	}
+	problems := checker(data)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", file, p)
+	}
+	return len(problems)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.Arg(0) != "check" {
+		flag.Usage()
+	}
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	indexConfig := fs.String("index-config", "", "Codesearch index config file to check")
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() > 1 || (fs.NArg() == 0 && *indexConfig == "") {
+		flag.Usage()
+	}
+
+	problems := 0
+	if *indexConfig != "" {
+		problems += check(*indexConfig, config.CheckIndexConfig)
+	}
+	if fs.NArg() == 1 {
+		problems += check(fs.Arg(0), config.CheckConfig)
+	}
+	if problems == 1 {
+		fmt.Println("1 problem found")
+		os.Exit(1)
+	} else if problems > 0 {
+		fmt.Printf("%d problems found\n", problems)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
@@ -6,59 +6,51 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
 	"sync"
 
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/grpcdial"
+	"github.com/livegrep/livegrep/server/log"
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 	"google.golang.org/grpc"
 )
 
-type IndexConfig struct {
-	Name         string       `json:"name"`
-	Repositories []RepoConfig `json:"repositories"`
-}
-
-type RepoConfig struct {
-	Path      string            `json:"path"`
-	Name      string            `json:"name"`
-	Revisions []string          `json:"revisions"`
-	Metadata  map[string]string `json:"metadata"`
-}
-
 var (
 	flagCodesearch    = flag.String("codesearch", path.Join(path.Dir(os.Args[0]), "codesearch"), "Path to the `codesearch` binary")
 	flagIndexPath     = flag.String("out", "livegrep.idx", "Path to write the index")
 	flagRevparse      = flag.Bool("revparse", true, "whether to `git rev-parse` the provided revision in generated links")
 	flagSkipMissing   = flag.Bool("skip-missing", false, "skip repositories where the specified revision is missing")
 	flagReloadBackend = flag.String("reload-backend", "", "Backend to send a Reload RPC to")
+	flagTLS           = grpcdial.AddFlags(flag.CommandLine)
 )
 
 const Workers = 8
 
 func main() {
 	flag.Parse()
-	log.SetFlags(0)
+	ctx := context.Background()
+	log.SetOutput(os.Stderr)
 
 	if len(flag.Args()) != 1 {
-		log.Fatal("Expected exactly one argument (the index json configuration)")
+		log.Fatalf(ctx, "Expected exactly one argument (the index json configuration)")
 	}
 
 	data, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 
-	var cfg IndexConfig
+	var cfg config.IndexConfig
 	if err = json.Unmarshal(data, &cfg); err != nil {
-		log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+		log.Fatalf(ctx, "reading %s: %s", flag.Arg(0), err.Error())
 	}
 
 	if err := checkoutRepos(&cfg.Repositories); err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 
 	tmp := *flagIndexPath + ".tmp"
@@ -78,22 +70,22 @@ func main() {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		log.Fatalln(err)
+		log.Fatalf(ctx, "%s", err)
 	}
 
 	if err := os.Rename(tmp, *flagIndexPath); err != nil {
-		log.Fatalln("rename:", err.Error())
+		log.Fatalf(ctx, "rename: %s", err.Error())
 	}
 
 	if *flagReloadBackend != "" {
-		if err := reloadBackend(*flagReloadBackend); err != nil {
-			log.Fatalln("reload:", err.Error())
+		if err := reloadBackend(*flagReloadBackend, flagTLS); err != nil {
+			log.Fatalf(ctx, "reload: %s", err.Error())
 		}
 	}
 }
 
-func checkoutRepos(repos *[]RepoConfig) error {
-	repoc := make(chan *RepoConfig)
+func checkoutRepos(repos *[]config.RepoConfig) error {
+	repoc := make(chan *config.RepoConfig)
 	errc := make(chan error, Workers)
 	stop := make(chan struct{})
 	wg := sync.WaitGroup{}
@@ -126,7 +118,7 @@ Repos:
 	return err
 }
 
-func checkoutWorker(c <-chan *RepoConfig,
+func checkoutWorker(c <-chan *config.RepoConfig,
 	stop <-chan struct{}, errc chan error) {
 	for {
 		select {
@@ -157,8 +149,8 @@ func retryCommand(program string, args []string) error {
 	return fmt.Errorf("%s %v: %s", program, args, err.Error())
 }
 
-func checkoutOne(r *RepoConfig) error {
-	log.Println("Updating", r.Name)
+func checkoutOne(r *config.RepoConfig) error {
+	log.Printf(context.Background(), "Updating %s", r.Name)
 
 	remote, ok := r.Metadata["remote"]
 	if !ok {
@@ -188,8 +180,8 @@ func checkoutOne(r *RepoConfig) error {
 	return retryCommand("git", []string{"-C", r.Path, "fetch", "-p"})
 }
 
-func reloadBackend(addr string) error {
-	client, err := grpc.Dial(addr, grpc.WithInsecure())
+func reloadBackend(addr string, tls *config.ClientTLS) error {
+	client, err := grpcdial.Dial(addr, tls)
 	if err != nil {
 		return err
 	}
@@ -19,25 +19,30 @@ quickly during startup.
 package main
 
 import (
-	"log"
+	"context"
 	"os"
 
 	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/log"
 )
 
 func main() {
+	ctx := context.Background()
+	// The stripped log is written to stdout.
+	log.SetOutput(os.Stderr)
+
 	target := "HEAD"
 	if len(os.Args) == 3 {
 		target = os.Args[2]
 	} else if len(os.Args) != 2 {
-		log.Fatalf("usage: %s <repo path> [<revision range>]")
+		log.Fatalf(ctx, "usage: %s <repo path> [<revision range>]", os.Args[0])
 	}
 	input, err := blameworthy.RunGitLog(os.Args[1], target)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf(ctx, "%s", err)
 	}
 	err = blameworthy.StripGitLog(input)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf(ctx, "%s", err)
 	}
 }
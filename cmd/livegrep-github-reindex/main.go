@@ -5,7 +5,6 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,6 +15,8 @@ import (
 	"sync"
 
 	"github.com/google/go-github/github"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -54,12 +55,13 @@ const Workers = 8
 
 func main() {
 	flag.Parse()
-	log.SetFlags(0)
+	ctx := context.Background()
+	log.SetOutput(os.Stderr)
 
 	if flagRepos.strings == nil &&
 		flagOrgs.strings == nil &&
 		flagUsers.strings == nil {
-		log.Fatal("You must specify at least one repo or organization to index")
+		log.Fatalf(ctx, "You must specify at least one repo or organization to index")
 	}
 
 	var blacklist map[string]struct{}
@@ -67,7 +69,7 @@ func main() {
 		var err error
 		blacklist, err = loadBlacklist(*flagBlacklist)
 		if err != nil {
-			log.Fatalf("loading %s: %s", *flagBlacklist, err)
+			log.Fatalf(ctx, "loading %s: %s", *flagBlacklist, err)
 		}
 	}
 
@@ -77,7 +79,7 @@ func main() {
 	} else {
 		tok := &oauth2.Token{AccessToken: *flagGithubKey}
 		h = oauth2.NewClient(
-			context.Background(),
+			ctx,
 			oauth2.StaticTokenSource(tok),
 		)
 	}
@@ -86,11 +88,11 @@ func main() {
 
 	if *flagApiBaseUrl != "" {
 		if !strings.HasSuffix(*flagApiBaseUrl, "/") {
-			log.Fatalf("API base URL must include trailing slash: %s", *flagApiBaseUrl)
+			log.Fatalf(ctx, "API base URL must include trailing slash: %s", *flagApiBaseUrl)
 		}
 		baseURL, err := url.Parse(*flagApiBaseUrl)
 		if err != nil {
-			log.Fatalf("parsing base url %s: %v", *flagApiBaseUrl, err)
+			log.Fatalf(ctx, "parsing base url %s: %v", *flagApiBaseUrl, err)
 		}
 		gh.BaseURL = baseURL
 	}
@@ -100,7 +102,7 @@ func main() {
 		flagOrgs.strings,
 		flagUsers.strings)
 	if err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 
 	repos = filterRepos(repos, blacklist, !*flagForks)
@@ -108,16 +110,16 @@ func main() {
 	sort.Sort(ReposByName(repos))
 
 	if err := checkoutRepos(repos, *flagRepoDir, *flagDepth, *flagHTTP); err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 
-	config, err := buildConfig(*flagName, *flagRepoDir, repos, *flagRevision)
+	data, err := buildConfig(*flagName, *flagRepoDir, repos, *flagRevision)
 	if err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 	configPath := path.Join(*flagRepoDir, "livegrep.json")
-	if err := writeConfig(config, configPath); err != nil {
-		log.Fatalln(err.Error())
+	if err := writeConfig(data, configPath); err != nil {
+		log.Fatalf(ctx, "%s", err.Error())
 	}
 
 	index := flagIndexPath.Get().(string)
@@ -138,11 +140,11 @@ func main() {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		log.Fatalln(err)
+		log.Fatalf(ctx, "%s", err)
 	}
 
 	if err := os.Rename(tmp, index); err != nil {
-		log.Fatalln("rename:", err.Error())
+		log.Fatalf(ctx, "rename: %s", err.Error())
 	}
 }
 
@@ -259,7 +261,7 @@ func filterRepos(repos []*github.Repository,
 
 	for _, r := range repos {
 		if excludeForks && r.Fork != nil && *r.Fork {
-			log.Printf("Excluding fork %s...", *r.FullName)
+			log.Printf(context.Background(), "Excluding fork %s...", *r.FullName)
 			continue
 		}
 		if blacklist != nil {
@@ -393,7 +395,7 @@ func retryCommand(program string, args []string) error {
 }
 
 func checkoutOne(dir string, depth int, http bool, r *github.Repository) error {
-	log.Println("Updating", *r.FullName)
+	log.Printf(context.Background(), "Updating %s", *r.FullName)
 	checkout := path.Join(dir, *r.FullName)
 	out, err := exec.Command("git", "--git-dir", checkout, "rev-parse", "--is-bare-repository").Output()
 	if err != nil {
@@ -429,31 +431,19 @@ func checkoutOne(dir string, depth int, http bool, r *github.Repository) error {
 	return retryCommand("git", args)
 }
 
-type IndexConfig struct {
-	Name         string       `json:"name"`
-	Repositories []RepoConfig `json:"repositories"`
-}
-
-type RepoConfig struct {
-	Path      string            `json:"path"`
-	Name      string            `json:"name"`
-	Revisions []string          `json:"revisions"`
-	Metadata  map[string]string `json:"metadata"`
-}
-
-func writeConfig(config []byte, file string) error {
+func writeConfig(data []byte, file string) error {
 	dir := path.Dir(file)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(file, config, 0644)
+	return ioutil.WriteFile(file, data, 0644)
 }
 
 func buildConfig(name string,
 	dir string,
 	repos []*github.Repository,
 	revision string) ([]byte, error) {
-	cfg := IndexConfig{
+	cfg := config.IndexConfig{
 		Name: name,
 	}
 
@@ -467,13 +457,13 @@ func buildConfig(name string,
 				revision,
 			)
 			if e := cmd.Run(); e != nil {
-				log.Printf("Skipping missing revision repo=%s rev=%s",
+				log.Warnf(context.Background(), "Skipping missing revision repo=%s rev=%s",
 					*r.FullName, revision,
 				)
 				continue
 			}
 		}
-		cfg.Repositories = append(cfg.Repositories, RepoConfig{
+		cfg.Repositories = append(cfg.Repositories, config.RepoConfig{
 			Path:      path.Join(dir, *r.FullName),
 			Name:      *r.FullName,
 			Revisions: []string{revision},
@@ -3,27 +3,33 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"os"
 
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/grpcdial"
+	"github.com/livegrep/livegrep/server/log"
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 	"google.golang.org/grpc"
 )
 
+var flagTLS = grpcdial.AddFlags(flag.CommandLine)
+
 func main() {
 	flag.Parse()
-	log.SetFlags(0)
+	ctx := context.Background()
+	log.SetOutput(os.Stderr)
 
 	if len(flag.Args()) != 1 {
-		log.Fatal("You must provide a HOST:PORT to reload")
+		log.Fatalf(ctx, "You must provide a HOST:PORT to reload")
 	}
 
-	if err := reloadBackend(flag.Arg(0)); err != nil {
-		log.Fatalln("reload:", err.Error())
+	if err := reloadBackend(flag.Arg(0), flagTLS); err != nil {
+		log.Fatalf(ctx, "reload: %s", err.Error())
 	}
 }
 
-func reloadBackend(addr string) error {
-	client, err := grpc.Dial(addr, grpc.WithInsecure())
+func reloadBackend(addr string, tls *config.ClientTLS) error {
+	client, err := grpcdial.Dial(addr, tls)
 	if err != nil {
 		return err
 	}
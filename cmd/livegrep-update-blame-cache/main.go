@@ -1,33 +1,33 @@
 package main
 
 import (
+	"context"
 	// "flag"
-	"fmt"
-	"log"
 	"os"
 	"time"
 
 	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/log"
 )
 
 func main() {
 	// flag.Parse()
-	// log.SetFlags(0)
+	ctx := context.Background()
 	file, err := os.Open("/home/brhodes/log3.server")
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf(ctx, "%s", err)
 	}
 	defer file.Close()
 
 	start := time.Now()
 	histories, _ := blameworthy.ParseGitLog(file)
 	elapsed := time.Since(start)
-	log.Printf("Git log loaded in %s", elapsed)
+	log.Printf(ctx, "Git log loaded in %s", elapsed)
 
 	// fmt.Printf("%d commits\n", len(*commits))
 
-	fmt.Printf("%d commits\n", len(histories.Commits))
-	fmt.Printf("%d files\n", len(histories.Files))
+	log.Printf(ctx, "%d commits", len(histories.Commits))
+	log.Printf(ctx, "%d files", len(histories.Files))
 
 	// Which file has the longest history?
 
@@ -56,7 +56,7 @@ func main() {
 
 	small_history := histories.Files[target_path]
 
-	fmt.Printf("history length: %d\n", len(small_history))
+	log.Printf(ctx, "history length: %d", len(small_history))
 
 	// start = time.Now()
 	// small_history.FileBlame(len(small_history) - 2)
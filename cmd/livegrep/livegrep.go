@@ -2,19 +2,21 @@ package main
 
 import (
 	"encoding/json"
-	_ "expvar"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 
 	libhoney "github.com/honeycombio/libhoney-go"
 	"github.com/livegrep/livegrep/server"
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/httpserve"
+	"github.com/livegrep/livegrep/server/log"
 	"github.com/livegrep/livegrep/server/middleware"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -35,17 +37,9 @@ func runfilesPath(sourcePath string) (string, error) {
 	return path.Join(programPath+".runfiles", "com_github_livegrep_livegrep", sourcePath), nil
 }
 
-func main() {
-	flag.Parse()
-
-	if *docRoot == "" {
-		var err error
-		*docRoot, err = runfilesPath("web")
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
-	}
-
+// loadConfig builds the configuration from the flags and the config
+// files named on the command line. It is called again to reload it.
+func loadConfig() (*config.Config, error) {
 	cfg := &config.Config{
 		DocRoot: *docRoot,
 		Listen:  *serveAddr,
@@ -62,24 +56,60 @@ func main() {
 	if *indexConfig != "" {
 		data, err := ioutil.ReadFile(*indexConfig)
 		if err != nil {
-			log.Fatalf(err.Error())
+			return nil, err
 		}
 
 		if err = json.Unmarshal(data, &cfg.IndexConfig); err != nil {
-			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+			return nil, fmt.Errorf("reading %s: %s", *indexConfig, err.Error())
 		}
 	}
 
 	if len(flag.Args()) != 0 {
 		data, err := ioutil.ReadFile(flag.Arg(0))
 		if err != nil {
-			log.Fatalf(err.Error())
+			return nil, err
 		}
 
 		if err = json.Unmarshal(data, &cfg); err != nil {
-			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+			return nil, fmt.Errorf("reading %s: %s", flag.Arg(0), err.Error())
 		}
 	}
+	return cfg, nil
+}
+
+// reloadOnHangup reloads the config whenever the process receives
+// SIGHUP, keeping the current one if the new one is invalid.
+func reloadOnHangup(ctx context.Context, r server.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf(ctx, "SIGHUP: reloading config")
+		cfg, err := loadConfig()
+		if err == nil {
+			err = r.Reload(cfg)
+		}
+		if err != nil {
+			log.Errorf(ctx, "reloading config, keeping the current one: %s", err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	ctx := context.Background()
+
+	if *docRoot == "" {
+		var err error
+		*docRoot, err = runfilesPath("web")
+		if err != nil {
+			log.Fatalf(ctx, "%s", err.Error())
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf(ctx, "%s", err.Error())
+	}
 
 	libhoney.Init(libhoney.Config{})
 
@@ -88,12 +118,28 @@ func main() {
 		panic(err.Error())
 	}
 
+	if r, ok := handler.(server.Reloader); ok {
+		r.SetLoader(loadConfig)
+		go reloadOnHangup(ctx, r)
+	}
+
 	if cfg.ReverseProxy {
 		handler = middleware.UnwrapProxyHeaders(handler)
 	}
 
-	http.DefaultServeMux.Handle("/", handler)
+	srv, err := httpserve.New(&cfg.HTTP, handler)
+	if err != nil {
+		log.Fatalf(ctx, "%s", err.Error())
+	}
+	l, err := httpserve.Listen(cfg.Listen)
+	if err != nil {
+		log.Fatalf(ctx, "%s", err.Error())
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
 
-	log.Printf("Listening on %s.", cfg.Listen)
-	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
+	log.Printf(ctx, "Listening on %s.", cfg.Listen)
+	if err := srv.Serve(l, stop); err != nil {
+		log.Fatalf(ctx, "%s", err.Error())
+	}
 }
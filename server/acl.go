@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// repoACL decides which repositories a user can see, as described by
+// config.ACL. A nil *repoACL allows everything.
+type repoACL struct {
+	rules      []aclRule
+	userGroups map[string]map[string]bool
+}
+
+type aclRule struct {
+	repos  *regexp.Regexp
+	users  map[string]bool
+	groups []string
+}
+
+func newRepoACL(cfg *config.ACL) (*repoACL, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	acl := &repoACL{userGroups: make(map[string]map[string]bool)}
+	for group, users := range cfg.Groups {
+		for _, u := range users {
+			if acl.userGroups[u] == nil {
+				acl.userGroups[u] = make(map[string]bool)
+			}
+			acl.userGroups[u][group] = true
+		}
+	}
+	for i, r := range cfg.Rules {
+		re, err := regexp.Compile("^(?:" + r.Repos + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %s", i, err)
+		}
+		rule := aclRule{repos: re, users: make(map[string]bool), groups: r.Groups}
+		for _, u := range r.Users {
+			rule.users[u] = true
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+func (a *repoACL) allowed(user, repo string) bool {
+	if a == nil {
+		return true
+	}
+	restricted := false
+	for _, r := range a.rules {
+		if !r.repos.MatchString(repo) {
+			continue
+		}
+		restricted = true
+		if user == "" {
+			continue
+		}
+		if r.users[user] {
+			return true
+		}
+		for _, g := range r.groups {
+			if a.userGroups[user][g] {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
+
+// repoAllowed reports whether the user making a request can see repo.
+func (s *server) repoAllowed(ctx context.Context, repo string) bool {
+	if s.acl == nil {
+		return true
+	}
+	id, _ := auth.FromContext(ctx)
+	return s.acl.allowed(id.User, repo)
+}
+
+// lookupRepo returns the browsable repository called name, if it
+// exists and the user making a request can see it.
+func (s *server) lookupRepo(ctx context.Context, name string) (config.RepoConfig, bool) {
+	repo, ok := s.repoMap()[name]
+	if !ok || !s.repoAllowed(ctx, name) {
+		return config.RepoConfig{}, false
+	}
+	return repo, true
+}
+
+// visibleRepos returns the browsable repositories that the user
+// making a request can see.
+func (s *server) visibleRepos(ctx context.Context) map[string]config.RepoConfig {
+	all := s.repoMap()
+	if s.acl == nil {
+		return all
+	}
+	repos := make(map[string]config.RepoConfig, len(all))
+	for name, repo := range all {
+		if s.repoAllowed(ctx, name) {
+			repos[name] = repo
+		}
+	}
+	return repos
+}
+
+// restrictQuery returns q, rewritten if necessary so that it won't
+// match any of backend's trees that the user making a request can't
+// see.
+func (s *server) restrictQuery(ctx context.Context, backend *Backend, q *pb.Query) *pb.Query {
+	if s.acl == nil {
+		return q
+	}
+	var hidden []string
+	backend.I.Lock()
+	for _, t := range backend.I.Trees {
+		if !s.repoAllowed(ctx, t.Name) {
+			hidden = append(hidden, regexp.QuoteMeta(t.Name))
+		}
+	}
+	backend.I.Unlock()
+	if len(hidden) == 0 {
+		return q
+	}
+
+	restricted := *q
+	notRepo := "^(?:" + strings.Join(hidden, "|") + ")$"
+	if q.NotRepo != "" {
+		notRepo = "(?:" + q.NotRepo + ")|" + notRepo
+	}
+	restricted.NotRepo = notRepo
+	return &restricted
+}
+
+// filterReply removes any results that the user making a request
+// can't see from reply. This catches trees that a backend started
+// serving after restrictQuery looked at it.
+func (s *server) filterReply(ctx context.Context, reply *api.ReplySearch) *api.ReplySearch {
+	if s.acl == nil {
+		return reply
+	}
+	// The result slices may be shared with the search cache, so
+	// build new ones rather than filtering in place.
+	results := make([]*api.Result, 0, len(reply.Results))
+	for _, r := range reply.Results {
+		if s.repoAllowed(ctx, r.Tree) {
+			results = append(results, r)
+		}
+	}
+	fileResults := make([]*api.FileResult, 0, len(reply.FileResults))
+	for _, r := range reply.FileResults {
+		if s.repoAllowed(ctx, r.Tree) {
+			fileResults = append(fileResults, r)
+		}
+	}
+	reply.Results = results
+	reply.FileResults = fileResults
+	return reply
+}
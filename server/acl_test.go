@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func testACL(t *testing.T) *repoACL {
+	acl, err := newRepoACL(&config.ACL{
+		Groups: map[string][]string{"security": {"alice"}},
+		Rules: []config.ACLRule{
+			{Repos: "secret/.*", Groups: []string{"security"}},
+			{Repos: "secret/shared", Users: []string{"bob"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+func TestRepoACL(t *testing.T) {
+	acl := testACL(t)
+	cases := []struct {
+		user, repo string
+		want       bool
+	}{
+		{"", "public/repo", true},
+		{"", "secret/keys", false},
+		{"bob", "secret/keys", false},
+		{"bob", "secret/shared", true},
+		{"alice", "secret/keys", true},
+		{"alice", "secret/shared", true},
+		{"alice", "notsecret/keys", true},
+	}
+	for _, tc := range cases {
+		if got := acl.allowed(tc.user, tc.repo); got != tc.want {
+			t.Errorf("allowed(%q, %q) = %v, want %v", tc.user, tc.repo, got, tc.want)
+		}
+	}
+
+	var none *repoACL
+	if !none.allowed("", "secret/keys") {
+		t.Errorf("expected a nil ACL to allow everything")
+	}
+}
+
+func TestRestrictSearch(t *testing.T) {
+	s := &server{acl: testACL(t)}
+	bk := &Backend{Id: "a", I: &I{Trees: []Tree{
+		{Name: "public/repo"},
+		{Name: "secret/keys"},
+		{Name: "secret/shared"},
+	}}}
+	ctx := auth.NewContext(context.Background(), auth.Identity{User: "bob"})
+
+	q := &pb.Query{Line: "x", NotRepo: "vendor"}
+	got := s.restrictQuery(ctx, bk, q)
+	if want := `(?:vendor)|^(?:secret/keys)$`; got.NotRepo != want {
+		t.Errorf("NotRepo: got %q, want %q", got.NotRepo, want)
+	}
+	if q.NotRepo != "vendor" {
+		t.Errorf("restrictQuery modified its argument: %q", q.NotRepo)
+	}
+
+	results := []*api.Result{
+		{Tree: "public/repo"},
+		{Tree: "secret/keys"},
+		{Tree: "secret/shared"},
+	}
+	reply := s.filterReply(ctx, &api.ReplySearch{Results: results})
+	if len(reply.Results) != 2 || reply.Results[1].Tree != "secret/shared" {
+		t.Errorf("filterReply: got %v", reply.Results)
+	}
+	if results[1].Tree != "secret/keys" {
+		t.Errorf("filterReply modified the original results")
+	}
+}
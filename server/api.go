@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"regexp/syntax"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -18,6 +20,7 @@ import (
 	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/log"
 	"github.com/livegrep/livegrep/server/reqid"
+	"github.com/livegrep/livegrep/server/trace"
 
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 )
@@ -26,25 +29,56 @@ func replyJSON(ctx context.Context, w http.ResponseWriter, status int, obj inter
 	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(obj); err != nil {
-		log.Printf(ctx, "writing http response, data=%s err=%q",
+		log.Errorf(ctx, "writing http response, data=%s err=%q",
 			asJSON{obj},
 			err.Error())
 	}
 }
 
+// errorLevel is the level to log an error response with the given
+// status at: client errors are routine, server errors are not.
+func errorLevel(status int) log.Level {
+	if status >= 500 {
+		return log.Error
+	}
+	return log.Info
+}
+
 func writeError(ctx context.Context, w http.ResponseWriter, status int, code, message string) {
-	log.Printf(ctx, "error status=%d code=%s message=%q",
-		status, code, message)
+	log.Log(ctx, errorLevel(status), fmt.Sprintf("error status=%d code=%s message=%q",
+		status, code, message), nil)
 	replyJSON(ctx, w, status, &api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
 }
 
-func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
+// apiError is an error to be reported to an API client as an
+// api.ReplyError.
+type apiError struct {
+	status int
+	inner  api.InnerError
+}
+
+func (e *apiError) Error() string {
+	return e.inner.Message
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status, api.InnerError{Code: code, Message: message}}
+}
+
+func writeAPIError(ctx context.Context, w http.ResponseWriter, e *apiError) {
+	log.Log(ctx, errorLevel(e.status), fmt.Sprintf("error status=%d code=%s field=%s message=%q",
+		e.status, e.inner.Code, e.inner.Field, e.inner.Message), nil)
+	replyJSON(ctx, w, e.status, &api.ReplyError{Err: e.inner})
+}
+
+// queryError converts an error returned by a backend search into an
+// API error.
+func queryError(err error) *apiError {
 	if code := grpc.Code(err); code == codes.InvalidArgument {
-		writeError(ctx, w, 400, "query", grpc.ErrorDesc(err))
-	} else {
-		writeError(ctx, w, 500, "internal_error",
-			fmt.Sprintf("Talking to backend: %s", err.Error()))
+		return newAPIError(400, "query", grpc.ErrorDesc(err))
 	}
+	return newAPIError(500, "internal_error",
+		fmt.Sprintf("Talking to backend: %s", err.Error()))
 }
 
 func extractQuery(ctx context.Context, r *http.Request) (pb.Query, error) {
@@ -58,7 +92,11 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, error) {
 	}
 
 	if q, ok := params["q"]; ok {
+		_, span := trace.Start(ctx, "ParseQuery")
+		span.SetAttr("query", q[0])
 		query, err = ParseQuery(q[0], regex)
+		span.SetError(err)
+		span.Finish()
 		log.Printf(ctx, "parsing query q=%q out=%s", q[0], asJSON{query})
 	}
 
@@ -116,25 +154,62 @@ func stringSlice(ss []string) []string {
 	return []string{}
 }
 
+// doSearch runs q against a single backend, answering from the search
+// cache when possible. Trees that the user can't see are excluded.
 func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearch, error) {
+	q = s.restrictQuery(ctx, backend, q)
+
+	backend.I.Lock()
+	indexTime := backend.I.IndexTime
+	backend.I.Unlock()
+
+	reply, cached, err := s.cache.Do(ctx, searchCacheKey(backend, q), indexTime,
+		func(ctx context.Context) (*api.ReplySearch, error) {
+			return s.searchBackend(ctx, backend, q)
+		})
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		log.Log(ctx, log.Info, "search cache hit", log.Fields{"backend": backend.Id})
+	}
+	return s.filterReply(ctx, reply), nil
+}
+
+// searchTimeout is how long a backend has to answer a search. A
+// search shared through the cache is only bounded by this, not by the
+// deadline of the request that started it.
+const searchTimeout = 30 * time.Second
+
+func (s *server) searchBackend(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearch, error) {
 	var search *pb.CodeSearchResult
 	var err error
 
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout)
 	defer cancel()
 
+	ctx = log.NewContext(ctx, log.Fields{"backend": backend.Id})
+	ctx, span := trace.Start(ctx, "codesearch.Search")
+	defer span.Finish()
+	span.Kind = trace.Client
+	span.SetAttr("backend", backend.Id)
+	span.SetAttr("backend.addr", backend.Addr)
+
+	md := []string{"traceparent", span.Traceparent()}
 	if id, ok := reqid.FromContext(ctx); ok {
-		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("Request-Id", string(id)))
+		md = append(md, "request-id", string(id))
 	}
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(md...))
 
 	search, err = backend.Codesearch.Search(
 		ctx, q,
 		grpc.FailFast(false),
 	)
 	if err != nil {
-		log.Printf(ctx, "error talking to backend err=%s", err)
+		span.SetError(err)
+		log.Errorf(ctx, "error talking to backend err=%s", err)
 		return nil, err
 	}
 
@@ -179,81 +254,415 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 		TotalTime:   int64(time.Since(start) / time.Millisecond),
 		ExitReason:  search.Stats.ExitReason.String(),
 	}
+	observeSearch(backend.Id, reply.Info)
+	span.SetAttr("results", len(reply.Results)+len(reply.FileResults))
+	span.SetAttr("exit_reason", reply.Info.ExitReason)
 	return reply, nil
 }
 
-func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	backendName := r.URL.Query().Get(":backend")
-	var backend *Backend
-	if backendName != "" {
-		backend = s.bk[backendName]
-		if backend == nil {
-			writeError(ctx, w, 400, "bad_backend",
-				fmt.Sprintf("Unknown backend: %s", backendName))
-			return
+// exitReasonRank orders exit reasons so that merging the stats of
+// several backends reports the most significant one.
+var exitReasonRank = map[string]int{
+	pb.SearchStats_NONE.String():        0,
+	pb.SearchStats_MATCH_LIMIT.String(): 1,
+	pb.SearchStats_TIMEOUT.String():     2,
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// backendReply is the outcome of searching one backend as part of a
+// fanned-out search.
+type backendReply struct {
+	index int
+	reply *api.ReplySearch
+	err   error
+}
+
+// fanOut searches every backend in parallel, delivering each reply on
+// the returned channel as soon as it arrives. The channel is closed
+// once every backend has replied.
+func (s *server) fanOut(ctx context.Context, backends []*Backend, q *pb.Query) <-chan backendReply {
+	out := make(chan backendReply, len(backends))
+	var wg sync.WaitGroup
+	for i, bk := range backends {
+		wg.Add(1)
+		go func(i int, bk *Backend) {
+			defer wg.Done()
+			reply, err := s.doSearch(ctx, bk, q)
+			out <- backendReply{i, reply, err}
+		}(i, bk)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// doSearchAll runs q against every backend in parallel and merges
+// the replies. A backend that fails only contributes a warning, unless
+// every backend fails, in which case the first error is returned.
+func (s *server) doSearchAll(ctx context.Context, backends []*Backend, q *pb.Query) (*api.ReplySearch, error) {
+	start := time.Now()
+
+	replies := make([]*api.ReplySearch, len(backends))
+	errs := make([]error, len(backends))
+	for br := range s.fanOut(ctx, backends, q) {
+		replies[br.index], errs[br.index] = br.reply, br.err
+	}
+
+	reply, err := mergeReplies(backends, replies, errs, q)
+	if err != nil {
+		return nil, err
+	}
+	reply.Info.TotalTime = int64(time.Since(start) / time.Millisecond)
+	return reply, nil
+}
+
+// mergeStats folds the stats reported by one backend into the stats
+// for a fanned-out search.
+func mergeStats(merged, info *api.Stats) {
+	// The backends run in parallel, so the slowest one determines
+	// how long each phase took.
+	merged.RE2Time = maxInt64(merged.RE2Time, info.RE2Time)
+	merged.GitTime = maxInt64(merged.GitTime, info.GitTime)
+	merged.SortTime = maxInt64(merged.SortTime, info.SortTime)
+	merged.IndexTime = maxInt64(merged.IndexTime, info.IndexTime)
+	merged.AnalyzeTime = maxInt64(merged.AnalyzeTime, info.AnalyzeTime)
+	merged.TotalTime = maxInt64(merged.TotalTime, info.TotalTime)
+	if exitReasonRank[info.ExitReason] > exitReasonRank[merged.ExitReason] {
+		merged.ExitReason = info.ExitReason
+	}
+}
+
+// mergeReplies combines the per-backend replies to a fanned-out search,
+// in backend order, truncating the merged set to q.MaxMatches. The
+// merged facets count every result, including those truncated.
+func mergeReplies(backends []*Backend, replies []*api.ReplySearch, errs []error, q *pb.Query) (*api.ReplySearch, error) {
+	merged := &api.ReplySearch{
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+		Results:     make([]*api.Result, 0),
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Backends:    make(map[string]*api.Stats, len(backends)),
+	}
+	if q.FilenameOnly {
+		merged.SearchType = "filename_only"
+	}
+
+	var firstErr error
+	cached := 0
+	for i, bk := range backends {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			merged.Warnings = append(merged.Warnings,
+				fmt.Sprintf("backend %s: %s", bk.Id, grpc.ErrorDesc(errs[i])))
+			continue
 		}
-	} else {
-		for _, backend = range s.bk {
-			break
+		r := replies[i]
+		merged.Results = append(merged.Results, r.Results...)
+		merged.FileResults = append(merged.FileResults, r.FileResults...)
+		merged.Backends[bk.Id] = r.Info
+		mergeStats(merged.Info, r.Info)
+		if r.Info.Cached {
+			cached++
 		}
 	}
+	// Only a reply every queried backend served from the cache is
+	// cached; one that failed may answer if the search is retried.
+	merged.Info.Cached = cached > 0 && cached == len(backends)
+
+	if len(merged.Backends) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+
+	merged.Facets = countFacets(merged, q.FilenameOnly)
+
+	if max := int(q.MaxMatches); max > 0 {
+		truncated := false
+		if len(merged.Results) > max {
+			merged.Results = merged.Results[:max]
+			truncated = true
+		}
+		if len(merged.FileResults) > max {
+			merged.FileResults = merged.FileResults[:max]
+			truncated = true
+		}
+		if truncated && merged.Info.ExitReason == pb.SearchStats_NONE.String() {
+			merged.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+		}
+	}
+
+	return merged, nil
+}
+
+// searchBackends returns the backends a search should be sent to:
+// the named backend, or every backend if name is empty.
+func (s *server) searchBackends(name string) ([]*Backend, error) {
+	if name != "" {
+		backend := s.backend(name)
+		if backend == nil {
+			return nil, fmt.Errorf("Unknown backend: %s", name)
+		}
+		return []*Backend{backend}, nil
+	}
+	return s.backendList(), nil
+}
+
+// checkQuery validates a parsed query and fills in server defaults.
+func (s *server) checkQuery(q *pb.Query) error {
+	if q.Line == "" {
+		return errors.New("You must specify a regex to match")
+	}
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.cfg().DefaultMaxMatches
+	}
+	return nil
+}
+
+// sendSearchEvent reports a completed search to the configured event
+// sinks.
+func (s *server) sendSearchEvent(ctx context.Context, backends []*Backend, q *pb.Query, resultCount int, info *api.Stats) {
+	if s.events == nil {
+		return
+	}
+
+	bkIds := make([]string, len(backends))
+	for i, bk := range backends {
+		bkIds[i] = bk.Id
+	}
+
+	s.sendEvent(ctx, "search", map[string]interface{}{
+		"backend":        strings.Join(bkIds, ","),
+		"query_line":     q.Line,
+		"query_file":     q.File,
+		"query_repo":     q.Repo,
+		"query_foldcase": q.FoldCase,
+		"query_not_file": q.NotFile,
+		"query_not_repo": q.NotRepo,
+		"max_matches":    q.MaxMatches,
+
+		"result_count": resultCount,
+		"re2_time":     info.RE2Time,
+		"git_time":     info.GitTime,
+		"sort_time":    info.SortTime,
+		"index_time":   info.IndexTime,
+		"analyze_time": info.AnalyzeTime,
+
+		"exit_reason": info.ExitReason,
+	})
+}
+
+func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	backendName := r.URL.Query().Get(":backend")
+	backends, err := s.searchBackends(backendName)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_backend", err.Error())
+		return
+	}
 
 	q, err := extractQuery(ctx, r)
 
 	if err != nil {
+		writeAPIError(ctx, w, queryParseError(r.URL.Query().Get("q"), err))
+		return
+	}
+
+	if err := s.checkQuery(&q); err != nil {
 		writeError(ctx, w, 400, "bad_query", err.Error())
 		return
 	}
 
-	if q.Line == "" {
-		writeError(ctx, w, 400, "bad_query",
-			"You must specify a regex to match")
+	reply, e := s.runSearch(ctx, backendName, backends, &q,
+		r.URL.Query().Get("cursor"), r.URL.Query().Get("facets") == "true")
+	if e != nil {
+		writeAPIError(ctx, w, e)
 		return
 	}
 
-	if q.MaxMatches == 0 {
-		q.MaxMatches = s.config.DefaultMaxMatches
+	replyJSON(ctx, w, 200, reply)
+}
+
+// maxSearchRequestBytes bounds the size of a POSTed search request.
+const maxSearchRequestBytes = 1 << 20
+
+// fieldError reports a problem with one field of a search request.
+func fieldError(field, format string, args ...interface{}) *apiError {
+	e := newAPIError(400, "bad_query", field+": "+fmt.Sprintf(format, args...))
+	e.inner.Field = field
+	return e
+}
+
+// decodeError reports a search request body that could not be parsed,
+// naming the offending field when encoding/json tells us which one it
+// was.
+func decodeError(err error) *apiError {
+	e := newAPIError(400, "bad_request", fmt.Sprintf("Parsing request body: %s", err))
+	const unknownField = `json: unknown field "`
+	if te, ok := err.(*json.UnmarshalTypeError); ok {
+		e.inner.Field = te.Field
+	} else if msg := err.Error(); strings.HasPrefix(msg, unknownField) {
+		e.inner.Field = strings.TrimSuffix(strings.TrimPrefix(msg, unknownField), `"`)
 	}
+	return e
+}
 
-	reply, err := s.doSearch(ctx, backend, &q)
+// queryFromRequest validates a structured search request and converts
+// it into a backend query and the backends to send it to.
+func (s *server) queryFromRequest(req *api.SearchRequest) (pb.Query, []*Backend, *apiError) {
+	q := pb.Query{
+		Line:         req.Line,
+		File:         req.File,
+		NotFile:      req.NotFile,
+		Repo:         req.Repo,
+		NotRepo:      req.NotRepo,
+		Tags:         req.Tags,
+		NotTags:      req.NotTags,
+		MaxMatches:   req.MaxMatches,
+		FilenameOnly: req.FilenameOnly,
+	}
 
-	if err != nil {
-		log.Printf(ctx, "error in search err=%s", err)
-		writeQueryError(ctx, w, err)
+	if q.Line == "" {
+		return q, nil, fieldError("line", "You must specify a regex to match")
+	}
+	regexes := []struct{ field, value string }{
+		{"line", q.Line},
+		{"file", q.File},
+		{"not_file", q.NotFile},
+		{"repo", q.Repo},
+		{"not_repo", q.NotRepo},
+		{"tags", q.Tags},
+		{"not_tags", q.NotTags},
+	}
+	for _, re := range regexes {
+		if re.value == "" {
+			continue
+		}
+		if _, err := syntax.Parse(re.value, syntax.Perl); err != nil {
+			return q, nil, fieldError(re.field, "invalid regex: %s", err)
+		}
+	}
+	if q.MaxMatches < 0 {
+		return q, nil, fieldError("max_matches", "must not be negative")
+	}
+
+	if req.FoldCase != nil {
+		q.FoldCase = *req.FoldCase
+	} else {
+		q.FoldCase = strings.IndexAny(q.Line, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1
+	}
+
+	var backends []*Backend
+	if len(req.Backends) == 0 {
+		backends, _ = s.searchBackends("")
+	} else {
+		seen := make(map[string]bool, len(req.Backends))
+		for i, id := range req.Backends {
+			field := fmt.Sprintf("backends[%d]", i)
+			bk := s.backend(id)
+			if bk == nil {
+				return q, nil, fieldError(field, "Unknown backend: %s", id)
+			}
+			if seen[id] {
+				return q, nil, fieldError(field, "Duplicate backend: %s", id)
+			}
+			seen[id] = true
+			backends = append(backends, bk)
+		}
+	}
+
+	if err := s.checkQuery(&q); err != nil {
+		return q, nil, newAPIError(400, "bad_query", err.Error())
+	}
+	return q, backends, nil
+}
+
+func (s *server) ServeAPISearchPost(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req api.SearchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSearchRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeAPIError(ctx, w, decodeError(err))
 		return
 	}
 
-	if s.honey != nil {
-		e := s.honey.NewEvent()
-		reqid, ok := reqid.FromContext(ctx)
-		if ok {
-			e.AddField("request_id", reqid)
+	q, backends, e := s.queryFromRequest(&req)
+	if e != nil {
+		writeAPIError(ctx, w, e)
+		return
+	}
+	log.Printf(ctx, "structured query out=%s", asJSON{q})
+
+	reply, e := s.runSearch(ctx, strings.Join(req.Backends, ","), backends, &q, req.Cursor, req.Facets)
+	if e != nil {
+		writeAPIError(ctx, w, e)
+		return
+	}
+
+	replyJSON(ctx, w, 200, reply)
+}
+
+func (s *server) maxCursorOffset() int {
+	if n := s.cfg().MaxCursorOffset; n > 0 {
+		return n
+	}
+	return defaultMaxCursorOffset
+}
+
+// runSearch runs a validated query against backends, continuing from
+// cursor if one is given, and including facet counts if facets is set.
+// bkKey identifies the set of backends for the purposes of pagination.
+func (s *server) runSearch(ctx context.Context, bkKey string, backends []*Backend, q *pb.Query, cursor string, facets bool) (*api.ReplySearch, *apiError) {
+	fingerprint := queryFingerprint(bkKey, q)
+	var prev *searchCursor
+	if cursor != "" {
+		var err error
+		prev, err = decodeCursor(cursor, fingerprint, s.maxCursorOffset())
+		if err != nil {
+			return nil, newAPIError(400, "bad_cursor", err.Error())
 		}
-		e.AddField("backend", backend.Id)
-		e.AddField("query_line", q.Line)
-		e.AddField("query_file", q.File)
-		e.AddField("query_repo", q.Repo)
-		e.AddField("query_foldcase", q.FoldCase)
-		e.AddField("query_not_file", q.NotFile)
-		e.AddField("query_not_repo", q.NotRepo)
-		e.AddField("max_matches", q.MaxMatches)
-
-		e.AddField("result_count", len(reply.Results))
-		e.AddField("re2_time", reply.Info.RE2Time)
-		e.AddField("git_time", reply.Info.GitTime)
-		e.AddField("sort_time", reply.Info.SortTime)
-		e.AddField("index_time", reply.Info.IndexTime)
-		e.AddField("analyze_time", reply.Info.AnalyzeTime)
-
-		e.AddField("exit_reason", reply.Info.ExitReason)
-		e.Send()
+		q.MaxMatches += int32(prev.Offset)
+	}
+
+	var reply *api.ReplySearch
+	var err error
+	if len(backends) == 1 {
+		reply, err = s.doSearch(ctx, backends[0], q)
+	} else {
+		reply, err = s.doSearchAll(ctx, backends, q)
 	}
 
+	if err != nil {
+		log.Warnf(ctx, "error in search err=%s", err)
+		return nil, queryError(err)
+	}
+
+	if !facets {
+		reply.Facets = nil
+	} else if reply.Facets == nil {
+		reply.Facets = countFacets(reply, q.FilenameOnly)
+	}
+
+	paginate(reply, prev, fingerprint, q.FilenameOnly, s.maxCursorOffset())
+
+	for _, warning := range reply.Warnings {
+		log.Warnf(ctx, "partial search results warning=%q", warning)
+	}
+
+	s.sendSearchEvent(ctx, backends, q, len(reply.Results), reply.Info)
+
 	log.Printf(ctx,
 		"responding success results=%d why=%s stats=%s",
 		len(reply.Results),
 		reply.Info.ExitReason,
 		asJSON{reply.Info})
 
-	replyJSON(ctx, w, 200, reply)
+	return reply, nil
 }
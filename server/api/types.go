@@ -3,6 +3,10 @@ package api
 type InnerError struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	// Field names the request field that failed validation, if any.
+	Field string `json:"field,omitempty"`
+	// Span locates the error within a query string, if any.
+	Span *Span `json:"span,omitempty"`
 }
 
 // ReplyError is returned along with any non-200 status reply
@@ -10,12 +14,88 @@ type ReplyError struct {
 	Err InnerError `json:"error"`
 }
 
+// SearchRequest is the JSON body accepted by POST /api/v1/search/.
+// Its fields map directly onto the backend's Query message.
+type SearchRequest struct {
+	Line    string `json:"line"`
+	File    string `json:"file"`
+	NotFile string `json:"not_file"`
+	Repo    string `json:"repo"`
+	NotRepo string `json:"not_repo"`
+	Tags    string `json:"tags"`
+	NotTags string `json:"not_tags"`
+	// If FoldCase is omitted, the search is case-insensitive
+	// unless Line contains an upper-case letter.
+	FoldCase     *bool `json:"fold_case"`
+	MaxMatches   int32 `json:"max_matches"`
+	FilenameOnly bool  `json:"filename_only"`
+	// Backends to search; every backend if empty.
+	Backends []string `json:"backends"`
+	// Cursor continues a previous search; see ReplySearch.NextCursor.
+	Cursor string `json:"cursor"`
+	// Facets requests facet counts over the results; see
+	// ReplySearch.Facets.
+	Facets bool `json:"facets"`
+}
+
 // ReplySearch is returned to /api/v1/search/:backend
 type ReplySearch struct {
 	Info        *Stats        `json:"info"`
 	Results     []*Result     `json:"results"`
 	FileResults []*FileResult `json:"file_results"`
 	SearchType  string        `json:"search_type"`
+	// Backends holds the stats reported by each backend when a
+	// search was fanned out across every configured backend.
+	Backends map[string]*Stats `json:"backends,omitempty"`
+	// Warnings lists backends that failed during a fanned-out
+	// search; the results are partial if this is non-empty.
+	Warnings []string `json:"warnings,omitempty"`
+	// NextCursor is set when the search stopped at the match
+	// limit. Pass it back as the "cursor" parameter, along with the
+	// same query, to fetch the next page of results. Each page
+	// re-runs the search for every result before it, so paging far
+	// into a search is slow, and stops at the server's configured
+	// max_cursor_offset.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Facets is set if facet counts were requested.
+	Facets *Facets `json:"facets,omitempty"`
+}
+
+// Facets counts the results of a search, across every backend
+// searched, by where they were found. Filename-only searches count
+// matching files; other searches count matching lines.
+type Facets struct {
+	// Trees counts results by repository.
+	Trees map[string]int `json:"trees"`
+	// Paths counts results by top-level directory, such as "src/".
+	// Results for files at the top level are counted under the
+	// file's own path.
+	Paths map[string]int `json:"paths"`
+	// Languages counts results by file type, as used for syntax
+	// highlighting. Extensions with no known file type are counted
+	// under the extension itself, and files with no extension under
+	// "".
+	Languages map[string]int `json:"languages"`
+}
+
+// BatchRequest is the JSON body accepted by /api/v1/search/batch.
+type BatchRequest struct {
+	Queries []SearchRequest `json:"queries"`
+}
+
+// BatchResult is the outcome of one query in a batch. It is shaped
+// like a ReplySearch if the query succeeded, or like a ReplyError if
+// it failed.
+type BatchResult struct {
+	*ReplySearch
+	Error *InnerError `json:"error,omitempty"`
+}
+
+// ReplyBatch is returned to /api/v1/search/batch. Results are in the
+// same order as the request's queries.
+type ReplyBatch struct {
+	Results   []*BatchResult `json:"results"`
+	TotalTime int64          `json:"total_time"`
 }
 
 type Stats struct {
@@ -26,6 +106,9 @@ type Stats struct {
 	AnalyzeTime int64  `json:"analyze_time"`
 	TotalTime   int64  `json:"total_time"`
 	ExitReason  string `json:"why"`
+	// Cached is true if the reply was served from the frontend's
+	// search cache rather than by the backend.
+	Cached bool `json:"cached,omitempty"`
 }
 
 type Result struct {
@@ -45,3 +128,268 @@ type FileResult struct {
 	Path    string `json:"path"`
 	Bounds  [2]int `json:"bounds"`
 }
+
+// StreamFrame is one frame of a streamed reply to
+// /api/v1/search/stream/:backend. Type determines which other fields
+// are set:
+//
+//	"result"      Backend, Result
+//	"file_result" Backend, FileResult
+//	"backend"     Backend, Info: that backend has finished
+//	"warning"     Backend, Message: that backend failed
+//	"error"       Error: the whole search failed; this is the last frame
+//	"done"        Info, SearchType: the final stats frame
+type StreamFrame struct {
+	Type       string      `json:"type"`
+	Backend    string      `json:"backend,omitempty"`
+	Result     *Result     `json:"result,omitempty"`
+	FileResult *FileResult `json:"file_result,omitempty"`
+	Info       *Stats      `json:"info,omitempty"`
+	SearchType string      `json:"search_type,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Error      *InnerError `json:"error,omitempty"`
+}
+
+// ReplyBackends is returned to /api/v1/backends
+type ReplyBackends struct {
+	Backends []*Backend `json:"backends"`
+}
+
+type Backend struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// IndexTime is when the backend's index was built, as a unix
+	// timestamp, or 0 if the backend has not reported it yet.
+	IndexTime int64   `json:"index_time"`
+	Trees     []*Tree `json:"trees"`
+}
+
+type Tree struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// URLPattern links to a line in the tree, with {path},
+	// {version} and {lno} placeholders.
+	URLPattern string            `json:"url_pattern,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// ReplyRepos is returned to /api/v1/repos
+type ReplyRepos struct {
+	Repos []*Repo `json:"repos"`
+}
+
+// Repo is a repository that can be browsed with /view, and possibly
+// /blame and /log.
+type Repo struct {
+	Name      string   `json:"name"`
+	Revisions []string `json:"revisions"`
+	Blame     bool     `json:"blame"`
+}
+
+// ReplyFile is returned to /api/v1/file/:repo/*path. Exactly one of
+// File and Entries is set, depending on Type.
+type ReplyFile struct {
+	Repo string `json:"repo"`
+	Path string `json:"path"`
+	// Commit is the commit that was requested, and CommitHash the
+	// full hash it resolved to.
+	Commit     string `json:"commit"`
+	CommitHash string `json:"commit_hash"`
+	// Type is "blob" or "tree".
+	Type    string      `json:"type"`
+	File    *FileBlob   `json:"file,omitempty"`
+	Entries []*DirEntry `json:"entries,omitempty"`
+}
+
+type FileBlob struct {
+	// Content holds lines StartLine through EndLine (1-based,
+	// inclusive) of the file.
+	Content   string `json:"content"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	LineCount int    `json:"line_count"`
+	Language  string `json:"language,omitempty"`
+	// Binary is set, and the other fields are left empty, if the
+	// file isn't text.
+	Binary bool `json:"binary,omitempty"`
+}
+
+type DirEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Type is "dir", "file" or "symlink".
+	Type          string `json:"type"`
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+}
+
+// CommitInfo describes a commit in the blame, diff and log APIs.
+type CommitInfo struct {
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// BlameRef points at a line as it appears in another commit.
+type BlameRef struct {
+	Commit     string `json:"commit"`
+	Author     string `json:"author"`
+	Date       string `json:"date"`
+	LineNumber int    `json:"lno"`
+}
+
+type BlameLine struct {
+	LineNumber int    `json:"lno"`
+	Line       string `json:"line"`
+	// Previous is the commit that last changed this line, and
+	// Next the commit that next changes or removes it. Either is
+	// omitted if there is no such commit.
+	Previous *BlameRef `json:"previous,omitempty"`
+	Next     *BlameRef `json:"next,omitempty"`
+}
+
+// ReplyBlame is returned to /api/v1/blame/:repo/:hash/*path
+type ReplyBlame struct {
+	Repo   string      `json:"repo"`
+	Path   string      `json:"path"`
+	Commit *CommitInfo `json:"commit"`
+	// The previous and next commits that changed this file.
+	PreviousCommit string       `json:"previous_commit,omitempty"`
+	NextCommit     string       `json:"next_commit,omitempty"`
+	Lines          []*BlameLine `json:"lines"`
+}
+
+type DiffLine struct {
+	// Op is "+" for an added line, "-" for a removed line, " " for
+	// context, or "..." where unchanged lines have been elided.
+	Op            string    `json:"op"`
+	OldLineNumber int       `json:"old_lno,omitempty"`
+	NewLineNumber int       `json:"new_lno,omitempty"`
+	Line          string    `json:"line"`
+	Previous      *BlameRef `json:"previous,omitempty"`
+	Next          *BlameRef `json:"next,omitempty"`
+}
+
+type DiffFile struct {
+	Path  string      `json:"path"`
+	Lines []*DiffLine `json:"lines"`
+}
+
+// ReplyDiff is returned to /api/v1/diff/:repo/:hash
+type ReplyDiff struct {
+	Repo   string      `json:"repo"`
+	Commit *CommitInfo `json:"commit"`
+	// The previous and next commits in the repository's history.
+	PreviousCommit string      `json:"previous_commit,omitempty"`
+	NextCommit     string      `json:"next_commit,omitempty"`
+	Files          []*DiffFile `json:"files"`
+}
+
+type LogCommit struct {
+	CommitInfo
+	// Changes summarizes the lines changed, e.g. "-3,+5".
+	Changes string `json:"changes"`
+}
+
+// ReplyLog is returned to /api/v1/log/:repo/*path. Commits are newest
+// first. Pass NextOffset or PrevOffset as the "offset" parameter to
+// page forwards or backwards; either is -1 if there is no such page.
+type ReplyLog struct {
+	Repo       string       `json:"repo"`
+	Path       string       `json:"path"`
+	Commits    []*LogCommit `json:"commits"`
+	NextOffset int          `json:"next_offset"`
+	PrevOffset int          `json:"prev_offset"`
+}
+
+// Span is a range of characters (not bytes) in a query string, from
+// Start up to but not including End.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// QueryTerm is one operator in a parsed query, such as "file:foo",
+// or the main search term.
+type QueryTerm struct {
+	// Operator is the operator without its colon, or "" for the
+	// main search term.
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+	// Regex is false if Value is matched literally.
+	Regex bool `json:"regex"`
+	// Span covers the whole term, and ValueSpan just its value.
+	Span      Span `json:"span"`
+	ValueSpan Span `json:"value_span"`
+}
+
+// ParsedQuery is the query that a search string is sent to the
+// backends as.
+type ParsedQuery struct {
+	Line         string `json:"line"`
+	File         string `json:"file"`
+	NotFile      string `json:"not_file"`
+	Repo         string `json:"repo"`
+	NotRepo      string `json:"not_repo"`
+	Tags         string `json:"tags"`
+	NotTags      string `json:"not_tags"`
+	FoldCase     bool   `json:"fold_case"`
+	MaxMatches   int32  `json:"max_matches"`
+	FilenameOnly bool   `json:"filename_only"`
+}
+
+// ReplyParse is returned to /api/v1/parse.
+type ReplyParse struct {
+	Input string       `json:"input"`
+	Terms []*QueryTerm `json:"terms"`
+	Query *ParsedQuery `json:"query"`
+}
+
+// SavedSearch is a search that is re-run whenever a backend it
+// searches loads a new index. It is both the body accepted by, and
+// the reply from, /api/v1/saved; only Name, Query, and WebhookURL may
+// be set by clients.
+type SavedSearch struct {
+	Id    string        `json:"id"`
+	Name  string        `json:"name"`
+	Query SearchRequest `json:"query"`
+	// WebhookURL receives a SavedSearchAlert whenever the search's
+	// results change. It defaults to the server's configured URL,
+	// and may only be set to a URL on a host the server allows.
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// Owner is the user who saved the search. The search is run
+	// with their access, so only they and admins can see or change
+	// it.
+	Owner   string `json:"owner,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+	// LastRun is when the search was last run, and LastError why
+	// that run failed, if it did.
+	LastRun   int64  `json:"last_run,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	// MatchCount is the number of matches found by the last
+	// successful run.
+	MatchCount int `json:"match_count"`
+}
+
+// ReplySavedSearches is returned to GET /api/v1/saved. It lists the
+// user's own saved searches, or every saved search for admins.
+type ReplySavedSearches struct {
+	Searches []*SavedSearch `json:"searches"`
+}
+
+// SavedMatch identifies a match found by a saved search. Line is
+// empty for filename-only searches.
+type SavedMatch struct {
+	Tree string `json:"tree"`
+	Path string `json:"path"`
+	Line string `json:"line"`
+}
+
+// SavedSearchAlert is POSTed to a saved search's webhook when its
+// results change, and returned from /api/v1/saved/:id/run.
+type SavedSearchAlert struct {
+	Search  *SavedSearch  `json:"search"`
+	Added   []*SavedMatch `json:"added"`
+	Removed []*SavedMatch `json:"removed"`
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bmizerany/pat"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// blameRef converts one side of a BlameLine for the API, returning nil
+// for the placeholder commits used by the HTML views.
+func blameRef(c *blameworthy.Commit, lineNumber int) *api.BlameRef {
+	if c == nil || c.Hash == "" {
+		return nil
+	}
+	ref := &api.BlameRef{
+		Commit:     c.Hash,
+		Author:     c.Author,
+		LineNumber: lineNumber,
+	}
+	if c.Date > 0 {
+		ref.Date = fmt.Sprintf("%04d-%02d-%02d",
+			c.Date/10000, c.Date%10000/100, c.Date%100)
+	}
+	return ref
+}
+
+func commitInfo(data *BlameData) *api.CommitInfo {
+	return &api.CommitInfo{
+		Hash:    data.CommitHash,
+		Author:  data.Author,
+		Date:    data.Date,
+		Subject: data.Subject,
+	}
+}
+
+// blameRepo looks up a repository that has blame history loaded,
+// writing an error and returning false if there isn't one.
+func (s *server) blameRepo(ctx context.Context, w http.ResponseWriter, repoName string) (config.RepoConfig, *blameworthy.GitHistory, bool) {
+	if len(s.repoMap()) == 0 {
+		writeError(ctx, w, 404, "not_found", "File browsing not enabled")
+		return config.RepoConfig{}, nil, false
+	}
+	repo, ok := s.lookupRepo(ctx, repoName)
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such repo")
+		return config.RepoConfig{}, nil, false
+	}
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
+		writeError(ctx, w, 404, "not_found", "Repo not configured for blame")
+		return config.RepoConfig{}, nil, false
+	}
+	return repo, gitHistory, true
+}
+
+func (s *server) ServeAPIBlame(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo, gitHistory, ok := s.blameRepo(ctx, w, r.URL.Query().Get(":repo"))
+	if !ok {
+		return
+	}
+	hash := r.URL.Query().Get(":hash")
+	path := strings.TrimSuffix(pat.Tail("/api/v1/blame/:repo/:hash/", r.URL.Path), "/")
+	if path == "" {
+		writeError(ctx, w, 400, "bad_request", "You must specify a path")
+		return
+	}
+	if !validRevision(hash) {
+		writeError(ctx, w, 400, "bad_request", fmt.Sprint("Invalid commit: ", hash))
+		return
+	}
+
+	data := BlameData{}
+	if err := resolveCommit(ctx, repo, hash, path, &data); err != nil {
+		writeError(ctx, w, 404, "not_found", fmt.Sprint("No such commit: ", hash))
+		return
+	}
+	if err := buildBlameData(ctx, repo, data.CommitHash, gitHistory, path, false, &data); err != nil {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+
+	content := splitLines(data.Content)
+	reply := &api.ReplyBlame{
+		Repo:           repo.Name,
+		Path:           path,
+		Commit:         commitInfo(&data),
+		PreviousCommit: data.PreviousCommit,
+		NextCommit:     data.NextCommit,
+		Lines:          make([]*api.BlameLine, 0, len(data.Lines)),
+	}
+	for i, l := range data.Lines {
+		line := &api.BlameLine{
+			LineNumber: l.OldLineNumber,
+			Previous:   blameRef(l.PreviousCommit, l.PreviousLineNumber),
+			Next:       blameRef(l.NextCommit, l.NextLineNumber),
+		}
+		if i < len(content) {
+			line.Line = content[i]
+		}
+		reply.Lines = append(reply.Lines, line)
+	}
+
+	s.sendBrowseEvent(ctx, "blame", repo.Name, path, data.CommitHash, true)
+	replyJSON(ctx, w, 200, reply)
+}
+
+// diffLines converts the lines of one file's diff for the API,
+// collapsing each run of elided context into a single "..." line.
+func diffLines(f *DiffFileData) []*api.DiffLine {
+	content := strings.Split(f.Content, "\n")
+	out := make([]*api.DiffLine, 0, len(f.Lines))
+	for i, l := range f.Lines {
+		if l.PreviousCommit == &ellipsisCommit {
+			if len(out) == 0 || out[len(out)-1].Op != "..." {
+				out = append(out, &api.DiffLine{Op: "..."})
+			}
+			continue
+		}
+		line := &api.DiffLine{
+			Op:            l.Symbol,
+			OldLineNumber: l.OldLineNumber,
+			NewLineNumber: l.NewLineNumber,
+			Previous:      blameRef(l.PreviousCommit, l.PreviousLineNumber),
+			Next:          blameRef(l.NextCommit, l.NextLineNumber),
+		}
+		if line.Op == "" {
+			line.Op = " "
+		}
+		if i < len(content) {
+			line.Line = content[i]
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func (s *server) ServeAPIDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo, _, ok := s.blameRepo(ctx, w, r.URL.Query().Get(":repo"))
+	if !ok {
+		return
+	}
+	hash := r.URL.Query().Get(":hash")
+	if !validRevision(hash) {
+		writeError(ctx, w, 400, "bad_request", fmt.Sprint("Invalid commit: ", hash))
+		return
+	}
+
+	commit := BlameData{}
+	if err := resolveCommit(ctx, repo, hash, "", &commit); err != nil {
+		writeError(ctx, w, 404, "not_found", fmt.Sprint("No such commit: ", hash))
+		return
+	}
+	data := DiffData{}
+	if err := buildDiffData(ctx, repo, commit.CommitHash, &data); err != nil {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+
+	reply := &api.ReplyDiff{
+		Repo:           repo.Name,
+		Commit:         commitInfo(&commit),
+		PreviousCommit: data.PreviousCommit,
+		NextCommit:     data.NextCommit,
+		Files:          make([]*api.DiffFile, 0, len(data.FileDiffs)),
+	}
+	for i := range data.FileDiffs {
+		f := &data.FileDiffs[i]
+		reply.Files = append(reply.Files, &api.DiffFile{
+			Path:  f.Path,
+			Lines: diffLines(f),
+		})
+	}
+
+	s.sendBrowseEvent(ctx, "diff", repo.Name, "", commit.CommitHash, true)
+	replyJSON(ctx, w, 200, reply)
+}
+
+func (s *server) ServeAPILog(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo, gitHistory, ok := s.blameRepo(ctx, w, r.URL.Query().Get(":repo"))
+	if !ok {
+		return
+	}
+	path := pat.Tail("/api/v1/log/:repo/", r.URL.Path)
+
+	offset := 0
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			writeError(ctx, w, 400, "bad_request", "Invalid offset")
+			return
+		}
+	}
+
+	logData, err := buildLogData(ctx, repo, gitHistory, path, offset)
+	if err != nil {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+
+	reply := &api.ReplyLog{
+		Repo:       repo.Name,
+		Path:       path,
+		Commits:    make([]*api.LogCommit, 0, len(logData.Blames)),
+		NextOffset: logData.NextOffset,
+		PrevOffset: logData.PrevOffset,
+	}
+	for i := range logData.Blames {
+		b := &logData.Blames[i]
+		reply.Commits = append(reply.Commits, &api.LogCommit{
+			CommitInfo: *commitInfo(b),
+			Changes:    b.Content,
+		})
+	}
+
+	s.sendBrowseEvent(ctx, "log", repo.Name, path, "", true)
+	replyJSON(ctx, w, 200, reply)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// testBlameServer serves testGitRepo as "blamed", with its history
+// loaded, and as "plain", without.
+func testBlameServer(t *testing.T) (*server, func()) {
+	dir := testGitRepo(t)
+	blamed := config.RepoConfig{Name: "blamed", Path: dir, Metadata: map[string]string{"blame": "git"}}
+	loadBlame(context.Background(), []config.RepoConfig{blamed})
+	if getHistory("blamed") == nil {
+		os.RemoveAll(dir)
+		t.Fatalf("blame history not loaded")
+	}
+	s := &server{
+		config: &config.Config{},
+		repos: map[string]config.RepoConfig{
+			"blamed": blamed,
+			"plain":  {Name: "plain", Path: dir},
+		},
+	}
+	return s, func() {
+		setHistory("blamed", nil)
+		os.RemoveAll(dir)
+	}
+}
+
+func getJSON(t *testing.T, s *server, url string, reply interface{}) (int, *api.ReplyError) {
+	code, body := serveAPI(s, url)
+	if code != 200 {
+		var e api.ReplyError
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatalf("%s: bad error %q: %v", url, body, err)
+		}
+		return code, &e
+	}
+	if err := json.Unmarshal(body, reply); err != nil {
+		t.Fatalf("%s: bad reply %q: %v", url, body, err)
+	}
+	return code, nil
+}
+
+func TestServeAPIBlame(t *testing.T) {
+	s, cleanup := testBlameServer(t)
+	defer cleanup()
+
+	var reply api.ReplyBlame
+	if code, e := getJSON(t, s, "/api/v1/blame/blamed/HEAD/README.md", &reply); code != 200 {
+		t.Fatalf("got %d %+v", code, e)
+	}
+	if reply.Repo != "blamed" || reply.Path != "README.md" || reply.Commit == nil || len(reply.Commit.Hash) != blameworthy.HashLength {
+		t.Errorf("got %+v", reply)
+	}
+	var lines []string
+	for _, l := range reply.Lines {
+		lines = append(lines, l.Line)
+	}
+	if len(lines) != 3 || lines[0] != "one" || lines[2] != "three" {
+		t.Errorf("lines = %q", lines)
+	}
+}
+
+func TestServeAPIDiff(t *testing.T) {
+	s, cleanup := testBlameServer(t)
+	defer cleanup()
+
+	var reply api.ReplyDiff
+	if code, e := getJSON(t, s, "/api/v1/diff/blamed/HEAD", &reply); code != 200 {
+		t.Fatalf("got %d %+v", code, e)
+	}
+	paths := map[string]bool{}
+	for _, f := range reply.Files {
+		paths[f.Path] = true
+	}
+	if reply.Commit == nil || len(reply.Commit.Hash) != blameworthy.HashLength || !paths["README.md"] {
+		t.Errorf("got %+v with files %v", reply, paths)
+	}
+}
+
+func TestServeAPILog(t *testing.T) {
+	s, cleanup := testBlameServer(t)
+	defer cleanup()
+
+	var reply api.ReplyLog
+	if code, e := getJSON(t, s, "/api/v1/log/blamed/README.md", &reply); code != 200 {
+		t.Fatalf("got %d %+v", code, e)
+	}
+	if reply.Path != "README.md" || len(reply.Commits) != 1 || reply.Commits[0].Subject != "init" {
+		t.Errorf("got %+v", reply)
+	}
+}
+
+func TestServeAPIBlameErrors(t *testing.T) {
+	s, cleanup := testBlameServer(t)
+	defer cleanup()
+
+	const unknown = "0123456789abcdef0123456789abcdef01234567"
+	cases := []struct {
+		url  string
+		code int
+		err  string
+	}{
+		{"/api/v1/blame/nope/HEAD/README.md", 404, "not_found"},
+		{"/api/v1/diff/nope/HEAD", 404, "not_found"},
+		{"/api/v1/log/nope/README.md", 404, "not_found"},
+		{"/api/v1/blame/plain/HEAD/README.md", 404, "not_found"},
+		{"/api/v1/diff/plain/HEAD", 404, "not_found"},
+		{"/api/v1/log/plain/README.md", 404, "not_found"},
+		{"/api/v1/blame/blamed/" + unknown + "/README.md", 404, "not_found"},
+		{"/api/v1/blame/blamed/nosuchbranch/README.md", 404, "not_found"},
+		{"/api/v1/diff/blamed/" + unknown, 404, "not_found"},
+		{"/api/v1/blame/blamed/HEAD/", 400, "bad_request"},
+		{"/api/v1/log/blamed/README.md?offset=-1", 400, "bad_request"},
+		{"/api/v1/blame/blamed/--output=x/README.md", 400, "bad_request"},
+		{"/api/v1/diff/blamed/--output=x", 400, "bad_request"},
+	}
+	for _, tc := range cases {
+		var reply interface{}
+		code, e := getJSON(t, s, tc.url, &reply)
+		if code != tc.code || e == nil || e.Err.Code != tc.err {
+			t.Errorf("%s: got %d %+v, want %d %s", tc.url, code, e, tc.code, tc.err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bmizerany/pat"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// fullCommitHash resolves a commit name, which may already be a full
+// hash, to a full hash.
+func fullCommitHash(ctx context.Context, repo config.RepoConfig, commit string) (string, error) {
+	if len(commit) == 40 && strings.Trim(commit, "0123456789abcdef") == "" {
+		return commit, nil
+	}
+	out, err := gitShowCommit(ctx, commit, repo.Path)
+	if err != nil {
+		return "", err
+	}
+	return out[:strings.Index(out, "\n")], nil
+}
+
+// lineRange parses the optional 1-based, inclusive "start" and "end"
+// parameters, returning 0 for any that are absent.
+func lineRange(r *http.Request) (int, int, error) {
+	var bounds [2]int
+	for i, name := range []string{"start", "end"} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("Invalid %s: must be a positive line number", name)
+		}
+		bounds[i] = n
+	}
+	if bounds[0] != 0 && bounds[1] != 0 && bounds[1] < bounds[0] {
+		return 0, 0, fmt.Errorf("Invalid range: end (%d) is before start (%d)", bounds[1], bounds[0])
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// sliceLines returns lines start through end (1-based, inclusive) of
+// content, clamping the range to the file.
+func sliceLines(content string, start, end int) *api.FileBlob {
+	lines := []string{}
+	if content != "" {
+		lines = splitLines(content)
+	}
+	blob := &api.FileBlob{LineCount: len(lines)}
+	if start == 0 {
+		start = 1
+	}
+	if end == 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if start > end {
+		blob.StartLine, blob.EndLine = start, start-1
+		return blob
+	}
+	blob.StartLine, blob.EndLine = start, end
+	blob.Content = strings.Join(lines[start-1:end], "\n")
+	if end < len(lines) || strings.HasSuffix(content, "\n") {
+		blob.Content += "\n"
+	}
+	return blob
+}
+
+// isBinary reports whether content looks like a binary file, which
+// can't be returned as a JSON string without mangling it.
+func isBinary(content string) bool {
+	return strings.IndexByte(content, 0) != -1 || !utf8.ValidString(content)
+}
+
+// validRevision reports whether rev may be passed to git as a
+// revision. git would parse one starting with "-" as an option.
+func validRevision(rev string) bool {
+	return rev != "" && !strings.HasPrefix(rev, "-")
+}
+
+func (s *server) ServeAPIFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repoName := r.URL.Query().Get(":repo")
+	relPath := pat.Tail("/api/v1/file/:repo/", r.URL.Path)
+	commit := r.URL.Query().Get("commit")
+	if commit == "" {
+		commit = "HEAD"
+	}
+	if !validRevision(commit) {
+		writeError(ctx, w, 400, "bad_request", fmt.Sprint("Invalid commit: ", commit))
+		return
+	}
+
+	if len(s.repoMap()) == 0 {
+		writeError(ctx, w, 404, "not_found", "File browsing not enabled")
+		return
+	}
+
+	repo, ok := s.lookupRepo(ctx, repoName)
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such repo")
+		return
+	}
+
+	start, end, err := lineRange(r)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_range", err.Error())
+		return
+	}
+
+	data, err := buildFileData(ctx, relPath, repo, commit)
+	if err != nil {
+		writeError(ctx, w, 404, "not_found", fmt.Sprint("Error reading file: ", err))
+		return
+	}
+
+	commitHash, err := fullCommitHash(ctx, repo, data.CommitHash)
+	if err != nil {
+		writeError(ctx, w, 404, "not_found", fmt.Sprint("Error resolving commit: ", err))
+		return
+	}
+
+	cleanPath := path.Clean(relPath)
+	if cleanPath == "." {
+		cleanPath = ""
+	}
+
+	reply := &api.ReplyFile{
+		Repo:       repo.Name,
+		Path:       cleanPath,
+		Commit:     commit,
+		CommitHash: commitHash,
+	}
+
+	if data.FileContent != nil {
+		reply.Type = "blob"
+		if content := data.FileContent.Content; isBinary(content) {
+			reply.File = &api.FileBlob{Binary: true}
+		} else {
+			reply.File = sliceLines(content, start, end)
+			reply.File.Language = data.FileContent.Language
+		}
+	} else if data.DirContent != nil {
+		reply.Type = "tree"
+		reply.Entries = make([]*api.DirEntry, 0, len(data.DirContent.Entries))
+		for _, e := range data.DirContent.Entries {
+			entry := &api.DirEntry{
+				Name:          e.Name,
+				Path:          path.Join(cleanPath, e.Name),
+				Type:          "file",
+				SymlinkTarget: e.SymlinkTarget,
+			}
+			if e.IsDir {
+				entry.Type = "dir"
+			} else if e.IsSymlink {
+				entry.Type = "symlink"
+			}
+			reply.Entries = append(reply.Entries, entry)
+		}
+	} else {
+		writeError(ctx, w, 404, "not_found", "Not a file or directory")
+		return
+	}
+
+	s.sendBrowseEvent(ctx, "file", repo.Name, cleanPath, commit, true)
+	replyJSON(ctx, w, 200, reply)
+}
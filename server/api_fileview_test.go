@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/pat"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// testGitRepo creates a git repository with one commit containing a
+// text file, a file in a subdirectory, a symlink and a binary file.
+func testGitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "livegrep-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"README.md":   "one\ntwo\nthree\n",
+		"sub/main.go": "package main\n",
+		"image.png":   "\x89PNG\x00\xff",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("README.md", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=x", "-c", "user.email=x@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+	return dir
+}
+
+// serveAPI routes a GET for url through the same handlers New
+// registers, returning the status and the raw body.
+func serveAPI(s *server, url string) (int, []byte) {
+	m := pat.New()
+	m.Add("GET", "/api/v1/file/:repo/", s.Handler(s.ServeAPIFile))
+	m.Add("GET", "/api/v1/blame/:repo/:hash/", s.Handler(s.ServeAPIBlame))
+	m.Add("GET", "/api/v1/diff/:repo/:hash", s.Handler(s.ServeAPIDiff))
+	m.Add("GET", "/api/v1/log/:repo/", s.Handler(s.ServeAPILog))
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w.Code, w.Body.Bytes()
+}
+
+func getFile(t *testing.T, s *server, url string) (int, *api.ReplyFile, *api.ReplyError) {
+	code, body := serveAPI(s, url)
+	if code != 200 {
+		var e api.ReplyError
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatalf("%s: bad error %q: %v", url, body, err)
+		}
+		return code, nil, &e
+	}
+	var reply api.ReplyFile
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Fatalf("%s: bad reply %q: %v", url, body, err)
+	}
+	return code, &reply, nil
+}
+
+func testRepoServer(t *testing.T) (*server, func()) {
+	dir := testGitRepo(t)
+	s := &server{
+		config: &config.Config{},
+		repos: map[string]config.RepoConfig{
+			"repo": {Name: "repo", Path: dir},
+		},
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestServeAPIFileRange(t *testing.T) {
+	s, cleanup := testRepoServer(t)
+	defer cleanup()
+
+	cases := []struct {
+		query      string
+		content    string
+		start, end int
+	}{
+		{"", "one\ntwo\nthree\n", 1, 3},
+		{"?start=2", "two\nthree\n", 2, 3},
+		{"?start=2&end=2", "two\n", 2, 2},
+		{"?end=1", "one\n", 1, 1},
+		// Ranges past the end of the file are clamped to it.
+		{"?start=2&end=100", "two\nthree\n", 2, 3},
+		{"?start=10", "", 10, 9},
+	}
+	for _, tc := range cases {
+		code, reply, _ := getFile(t, s, "/api/v1/file/repo/README.md"+tc.query)
+		if code != 200 {
+			t.Errorf("%q: got %d", tc.query, code)
+			continue
+		}
+		f := reply.File
+		if reply.Type != "blob" || f == nil {
+			t.Errorf("%q: got %+v, want a blob", tc.query, reply)
+			continue
+		}
+		if f.Content != tc.content || f.StartLine != tc.start || f.EndLine != tc.end || f.LineCount != 3 {
+			t.Errorf("%q: got %q lines %d-%d of %d, want %q lines %d-%d",
+				tc.query, f.Content, f.StartLine, f.EndLine, f.LineCount, tc.content, tc.start, tc.end)
+		}
+		if f.Language != "markdown" {
+			t.Errorf("%q: language %q", tc.query, f.Language)
+		}
+		if len(reply.CommitHash) != 40 {
+			t.Errorf("%q: commit hash %q not resolved", tc.query, reply.CommitHash)
+		}
+	}
+
+	for _, query := range []string{"?start=0", "?start=-1", "?end=x", "?start=3&end=2"} {
+		code, _, e := getFile(t, s, "/api/v1/file/repo/README.md"+query)
+		if code != 400 || e.Err.Code != "bad_range" {
+			t.Errorf("%q: got %d %+v, want a bad_range error", query, code, e)
+		}
+	}
+}
+
+func TestServeAPIFileTree(t *testing.T) {
+	s, cleanup := testRepoServer(t)
+	defer cleanup()
+
+	code, reply, _ := getFile(t, s, "/api/v1/file/repo/")
+	if code != 200 || reply.Type != "tree" || reply.File != nil {
+		t.Fatalf("got %d %+v, want a tree", code, reply)
+	}
+	var got []api.DirEntry
+	for _, e := range reply.Entries {
+		got = append(got, *e)
+	}
+	want := []api.DirEntry{
+		{Name: "sub", Path: "sub", Type: "dir"},
+		{Name: "README.md", Path: "README.md", Type: "file"},
+		{Name: "image.png", Path: "image.png", Type: "file"},
+		{Name: "link", Path: "link", Type: "symlink", SymlinkTarget: "README.md"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("entries = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	code, reply, _ = getFile(t, s, "/api/v1/file/repo/sub")
+	if code != 200 || reply.Type != "tree" || reply.Path != "sub" || len(reply.Entries) != 1 ||
+		reply.Entries[0].Path != "sub/main.go" {
+		t.Errorf("subdirectory: got %d %+v", code, reply)
+	}
+}
+
+func TestServeAPIFileBinary(t *testing.T) {
+	s, cleanup := testRepoServer(t)
+	defer cleanup()
+
+	code, reply, _ := getFile(t, s, "/api/v1/file/repo/image.png")
+	if code != 200 || reply.Type != "blob" || reply.File == nil {
+		t.Fatalf("got %d %+v, want a blob", code, reply)
+	}
+	if !reply.File.Binary || reply.File.Content != "" {
+		t.Errorf("got %+v, want a binary file without content", reply.File)
+	}
+}
+
+func TestServeAPIFileNotFound(t *testing.T) {
+	s, cleanup := testRepoServer(t)
+	defer cleanup()
+
+	for _, url := range []string{
+		"/api/v1/file/nope/README.md",
+		"/api/v1/file/repo/missing.txt",
+		"/api/v1/file/repo/README.md?commit=0123456789abcdef0123456789abcdef01234567",
+	} {
+		if code, _, e := getFile(t, s, url); code != 404 || e.Err.Code != "not_found" {
+			t.Errorf("%s: got %d %+v, want not_found", url, code, e)
+		}
+	}
+}
+
+func TestServeAPIFileBadCommit(t *testing.T) {
+	s, cleanup := testRepoServer(t)
+	defer cleanup()
+
+	for _, commit := range []string{"--output=/tmp/x", "-p"} {
+		code, _, e := getFile(t, s, "/api/v1/file/repo/README.md?commit="+commit)
+		if code != 400 || e.Err.Code != "bad_request" {
+			t.Errorf("%s: got %d %+v, want a bad_request error", commit, code, e)
+		}
+	}
+}
+
+func TestGitOutputCancelled(t *testing.T) {
+	dir := testGitRepo(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := gitOutput(context.Background(), dir, "rev-parse", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := gitOutput(ctx, dir, "rev-parse", "HEAD"); err == nil {
+		t.Errorf("git ran after its request was cancelled")
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// charSpan converts a span of byte offsets in s to character offsets.
+func charSpan(s string, start, end int) api.Span {
+	return api.Span{
+		Start: utf8.RuneCountInString(s[:start]),
+		End:   utf8.RuneCountInString(s[:end]),
+	}
+}
+
+// queryParseError reports an error parsing input, locating it within
+// input if possible.
+func queryParseError(input string, err error) *apiError {
+	e := newAPIError(400, "bad_query", err.Error())
+	if qe, ok := err.(*QueryError); ok {
+		span := charSpan(input, qe.Start, qe.End)
+		e.inner.Span = &span
+	}
+	return e
+}
+
+func (s *server) ServeAPIParse(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	input := params.Get("q")
+	regex := params.Get("regex") != "false"
+
+	q, terms, err := parseQuery(input, regex)
+	if err != nil {
+		writeAPIError(ctx, w, queryParseError(input, err))
+		return
+	}
+
+	reply := &api.ReplyParse{
+		Input: input,
+		Terms: make([]*api.QueryTerm, 0, len(terms)),
+		Query: &api.ParsedQuery{
+			Line:         q.Line,
+			File:         q.File,
+			NotFile:      q.NotFile,
+			Repo:         q.Repo,
+			NotRepo:      q.NotRepo,
+			Tags:         q.Tags,
+			NotTags:      q.NotTags,
+			FoldCase:     q.FoldCase,
+			MaxMatches:   q.MaxMatches,
+			FilenameOnly: q.FilenameOnly,
+		},
+	}
+	for _, t := range terms {
+		reply.Terms = append(reply.Terms, &api.QueryTerm{
+			Operator:  t.key,
+			Value:     t.value,
+			Regex:     regex && t.key != "lit" && t.key != "max_matches",
+			Span:      charSpan(input, t.start, t.end),
+			ValueSpan: charSpan(input, t.valueStart, t.end),
+		})
+	}
+
+	replyJSON(ctx, w, 200, reply)
+}
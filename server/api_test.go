@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func searchReply(why string, paths ...string) *api.ReplySearch {
+	reply := &api.ReplySearch{
+		Info: &api.Stats{ExitReason: why},
+	}
+	for _, p := range paths {
+		reply.Results = append(reply.Results, &api.Result{Path: p})
+	}
+	return reply
+}
+
+func resultPaths(reply *api.ReplySearch) []string {
+	var paths []string
+	for _, r := range reply.Results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestMergeReplies(t *testing.T) {
+	backends := []*Backend{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+
+	cases := []struct {
+		name     string
+		replies  []*api.ReplySearch
+		errs     []error
+		max      int32
+		paths    []string
+		why      string
+		warnings int
+	}{
+		{
+			"all succeed",
+			[]*api.ReplySearch{
+				searchReply("NONE", "a1", "a2"),
+				searchReply("NONE", "b1"),
+				searchReply("NONE"),
+			},
+			[]error{nil, nil, nil},
+			0,
+			[]string{"a1", "a2", "b1"},
+			"NONE",
+			0,
+		},
+		{
+			"truncated to max_matches",
+			[]*api.ReplySearch{
+				searchReply("NONE", "a1", "a2"),
+				searchReply("NONE", "b1"),
+				searchReply("NONE", "c1"),
+			},
+			[]error{nil, nil, nil},
+			3,
+			[]string{"a1", "a2", "b1"},
+			"MATCH_LIMIT",
+			0,
+		},
+		{
+			"timeout wins over match limit",
+			[]*api.ReplySearch{
+				searchReply("MATCH_LIMIT", "a1"),
+				searchReply("TIMEOUT", "b1"),
+				searchReply("NONE"),
+			},
+			[]error{nil, nil, nil},
+			0,
+			[]string{"a1", "b1"},
+			"TIMEOUT",
+			0,
+		},
+		{
+			"partial failure",
+			[]*api.ReplySearch{
+				searchReply("NONE", "a1"),
+				nil,
+				searchReply("NONE", "c1"),
+			},
+			[]error{nil, errors.New("connection refused"), nil},
+			0,
+			[]string{"a1", "c1"},
+			"NONE",
+			1,
+		},
+	}
+
+	for _, tc := range cases {
+		merged, err := mergeReplies(backends, tc.replies, tc.errs, &pb.Query{MaxMatches: tc.max})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if got := resultPaths(merged); len(got) != len(tc.paths) {
+			t.Errorf("%s: expected results %v, got %v", tc.name, tc.paths, got)
+		} else {
+			for i := range got {
+				if got[i] != tc.paths[i] {
+					t.Errorf("%s: expected results %v, got %v", tc.name, tc.paths, got)
+					break
+				}
+			}
+		}
+		if merged.Info.ExitReason != tc.why {
+			t.Errorf("%s: expected why=%s, got %s", tc.name, tc.why, merged.Info.ExitReason)
+		}
+		if len(merged.Warnings) != tc.warnings {
+			t.Errorf("%s: expected %d warnings, got %v", tc.name, tc.warnings, merged.Warnings)
+		}
+		if len(merged.Backends)+len(merged.Warnings) != len(backends) {
+			t.Errorf("%s: expected stats or a warning for every backend, got %v", tc.name, merged.Backends)
+		}
+	}
+}
+
+func TestMergeRepliesCached(t *testing.T) {
+	backends := []*Backend{{Id: "a"}, {Id: "b"}}
+	cached := func() *api.ReplySearch {
+		r := searchReply("NONE", "x")
+		r.Info.Cached = true
+		return r
+	}
+
+	merged, err := mergeReplies(backends, []*api.ReplySearch{cached(), cached()}, make([]error, 2), &pb.Query{})
+	if err != nil || !merged.Info.Cached {
+		t.Errorf("every backend cached: cached = %v, %v", merged.Info.Cached, err)
+	}
+	merged, err = mergeReplies(backends, []*api.ReplySearch{cached(), nil},
+		[]error{nil, errors.New("b is down")}, &pb.Query{})
+	if err != nil || merged.Info.Cached {
+		t.Errorf("one backend cached, one failed: cached = %v, %v", merged.Info.Cached, err)
+	}
+}
+
+func TestMergeRepliesAllFail(t *testing.T) {
+	backends := []*Backend{{Id: "a"}, {Id: "b"}}
+	errs := []error{errors.New("a is down"), errors.New("b is down")}
+	_, err := mergeReplies(backends, make([]*api.ReplySearch, 2), errs, &pb.Query{})
+	if err != errs[0] {
+		t.Errorf("expected the first backend's error, got %v", err)
+	}
+}
+
+func TestQueryFromRequest(t *testing.T) {
+	s := &server{
+		config:  &config.Config{DefaultMaxMatches: 50},
+		bk:      map[string]*Backend{"a": {Id: "a"}, "b": {Id: "b"}},
+		bkOrder: []string{"a", "b"},
+	}
+	no := false
+
+	q, backends, e := s.queryFromRequest(&api.SearchRequest{
+		Line:     "Foo",
+		NotFile:  `_test\.go$`,
+		Backends: []string{"b"},
+	})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	want := pb.Query{Line: "Foo", NotFile: `_test\.go$`, MaxMatches: 50}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("expected %#v got %#v", want, q)
+	}
+	if len(backends) != 1 || backends[0].Id != "b" {
+		t.Errorf("expected backend b, got %v", backends)
+	}
+
+	q, backends, e = s.queryFromRequest(&api.SearchRequest{Line: "foo", FoldCase: &no})
+	if e != nil {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if q.FoldCase {
+		t.Errorf("expected an explicit fold_case to be respected")
+	}
+	if len(backends) != 2 {
+		t.Errorf("expected every backend, got %v", backends)
+	}
+
+	errCases := []struct {
+		req   api.SearchRequest
+		field string
+	}{
+		{api.SearchRequest{}, "line"},
+		{api.SearchRequest{Line: "a("}, "line"},
+		{api.SearchRequest{Line: "a", Repo: "[z-a]"}, "repo"},
+		{api.SearchRequest{Line: "a", MaxMatches: -1}, "max_matches"},
+		{api.SearchRequest{Line: "a", Backends: []string{"a", "c"}}, "backends[1]"},
+		{api.SearchRequest{Line: "a", Backends: []string{"a", "a"}}, "backends[1]"},
+	}
+	for _, tc := range errCases {
+		_, _, e := s.queryFromRequest(&tc.req)
+		if e == nil {
+			t.Errorf("expected an error for %#v", tc.req)
+		} else if e.inner.Field != tc.field {
+			t.Errorf("expected an error on %s for %#v, got %q", tc.field, tc.req, e.inner.Field)
+		}
+	}
+}
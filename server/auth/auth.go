@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"golang.org/x/net/context"
+)
+
+type key int
+
+const identityKey key = 0
+
+// Identity is the authenticated user making a request.
+type Identity struct {
+	// User is the user's name, such as an email address.
+	User string
+	// Provider is how the user was authenticated: "header",
+	// "token", or "oidc".
+	Provider string
+}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey).(Identity)
+	return id, ok
+}
@@ -2,19 +2,23 @@ package server
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/grpcdial"
+	"github.com/livegrep/livegrep/server/log"
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
-	"google.golang.org/grpc"
 )
 
 type Tree struct {
-	Name    string
-	Version string
-	Url     string
+	Name     string
+	Version  string
+	Url      string
+	Metadata map[string]string
 }
 
 type I struct {
@@ -22,25 +26,64 @@ type I struct {
 	Trees []Tree
 	sync.Mutex
 	IndexTime time.Time
+
+	// The results of polling the backend for its info.
+	LastPoll            time.Time
+	LastSuccess         time.Time
+	ConsecutiveFailures int
+	LastError           string
 }
 
 type Backend struct {
-	Id         string
-	Addr       string
-	I          *I
+	Id string
+	// The addresses of the backend's replicas, separated by commas.
+	Addr string
+	I    *I
+	// Searches go through Codesearch, which spreads them across
+	// Replicas if there's more than one.
 	Codesearch pb.CodeSearchClient
+	Replicas   []*Replica
+	// OnReindex, if set, is called whenever poll sees that the
+	// backend has loaded a new index.
+	OnReindex func(bk *Backend)
+
+	// The configuration the backend was created from.
+	cfg  config.Backend
+	stop chan struct{}
 }
 
-func NewBackend(id string, addr string) (*Backend, error) {
-	client, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
-		return nil, err
+func NewBackend(cfg *config.Backend) (*Backend, error) {
+	addrs := cfg.Replicas
+	if cfg.Addr != "" {
+		addrs = append([]string{cfg.Addr}, addrs...)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("backend %s has no addr", cfg.Id)
 	}
 	bk := &Backend{
-		Id:         id,
-		Addr:       addr,
-		I:          &I{Name: id},
-		Codesearch: pb.NewCodeSearchClient(client),
+		Id:   cfg.Id,
+		Addr: strings.Join(addrs, ","),
+		I:    &I{Name: cfg.Id},
+		cfg:  *cfg,
+	}
+	for _, addr := range addrs {
+		client, err := grpcdial.Dial(addr, cfg.TLS)
+		if err != nil {
+			for _, r := range bk.Replicas {
+				r.conn.Close()
+			}
+			return nil, err
+		}
+		bk.Replicas = append(bk.Replicas, &Replica{
+			Addr:       addr,
+			Codesearch: pb.NewCodeSearchClient(client),
+			conn:       client,
+		})
+	}
+	if len(bk.Replicas) == 1 {
+		bk.Codesearch = bk.Replicas[0].Codesearch
+	} else {
+		bk.Codesearch = newReplicaSet(cfg, bk.Replicas)
 	}
 	return bk, nil
 }
@@ -49,29 +92,112 @@ func (bk *Backend) Start() {
 	if bk.I == nil {
 		bk.I = &I{Name: bk.Id}
 	}
-	go bk.poll()
+	bk.stop = make(chan struct{})
+	go bk.poll(bk.stop)
 }
 
-func (bk *Backend) poll() {
+// Stop stops polling the backend and, once any searches still using
+// it have had time to finish, closes its connections.
+func (bk *Backend) Stop() {
+	if bk.stop != nil {
+		close(bk.stop)
+	}
+	time.AfterFunc(2*searchTimeout, func() {
+		for _, r := range bk.Replicas {
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	})
+}
+
+// pollInterval is how often backends are asked for their info.
+const pollInterval = 60 * time.Second
+
+func (bk *Backend) poll(stop <-chan struct{}) {
 	for {
-		info, e := bk.Codesearch.Info(context.Background(), &pb.InfoRequest{}, grpc.FailFast(false))
-		if e == nil {
-			bk.refresh(info)
-		} else {
-			log.Printf("refresh %s: %v", bk.Id, e)
+		bk.pollOnce()
+		select {
+		case <-stop:
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// pollOnce asks each of the backend's replicas for its info once,
+// recording the results. The backend is up if any replica answers,
+// and its info is taken from the one with the newest index.
+func (bk *Backend) pollOnce() {
+	replicas := bk.Replicas
+	if len(replicas) == 0 {
+		replicas = []*Replica{{Addr: bk.Addr, Codesearch: bk.Codesearch}}
+	}
+	infos := make([]*pb.ServerInfo, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, r := range replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			infos[i], errs[i] = r.poll()
+		}(i, r)
+	}
+	wg.Wait()
+
+	var newest *pb.ServerInfo
+	var failures []string
+	for i, e := range errs {
+		if e != nil {
+			backendPolls.Inc(bk.Id, "failure")
+			log.Log(context.Background(), log.Warn, "refresh failed",
+				log.Fields{"backend": bk.Id, "replica": replicas[i].Addr, "error": e.Error()})
+			if len(replicas) > 1 {
+				failures = append(failures, fmt.Sprintf("%s: %s", replicas[i].Addr, e))
+			} else {
+				failures = append(failures, e.Error())
+			}
+			continue
 		}
-		time.Sleep(60 * time.Second)
+		backendPolls.Inc(bk.Id, "success")
+		if newest == nil || infos[i].IndexTime > newest.IndexTime {
+			newest = infos[i]
+		}
+	}
+
+	bk.I.Lock()
+	bk.I.LastPoll = time.Now()
+	if newest != nil {
+		bk.I.LastSuccess = bk.I.LastPoll
+		bk.I.ConsecutiveFailures = 0
+		bk.I.LastError = ""
+	} else {
+		bk.I.ConsecutiveFailures++
+		bk.I.LastError = strings.Join(failures, "; ")
+	}
+	bk.I.Unlock()
+
+	if newest != nil && bk.refresh(newest) && bk.OnReindex != nil {
+		bk.OnReindex(bk)
 	}
 }
 
-func (bk *Backend) refresh(info *pb.ServerInfo) {
+// refresh updates bk.I from info, returning whether the backend has
+// loaded a newer index since the last refresh. The index time never
+// moves backwards, so that a replica with an older index answering
+// while the newest one is down doesn't look like a reindex.
+func (bk *Backend) refresh(info *pb.ServerInfo) bool {
 	bk.I.Lock()
 	defer bk.I.Unlock()
 
 	if info.Name != "" {
 		bk.I.Name = info.Name
 	}
-	bk.I.IndexTime = time.Unix(info.IndexTime, 0)
+	indexTime := time.Unix(info.IndexTime, 0)
+	reindexed := indexTime.After(bk.I.IndexTime)
+	if reindexed {
+		bk.I.IndexTime = indexTime
+	}
 	if len(info.Trees) > 0 {
 		bk.I.Trees = nil
 		for _, r := range info.Trees {
@@ -91,7 +217,8 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 				pattern = base + "/blob/{version}/{path}#L{lno}"
 			}
 			bk.I.Trees = append(bk.I.Trees,
-				Tree{r.Name, r.Version, pattern})
+				Tree{r.Name, r.Version, pattern, r.Metadata})
 		}
 	}
+	return reindexed
 }
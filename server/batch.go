@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+const (
+	defaultBatchConcurrency = 8
+	defaultBatchTimeout     = 60 * time.Second
+	// maxBatchQueries bounds the number of queries in a single
+	// batch request.
+	maxBatchQueries = 1000
+)
+
+func (s *server) batchConcurrency() int {
+	if s.cfg().BatchConcurrency > 0 {
+		return s.cfg().BatchConcurrency
+	}
+	return defaultBatchConcurrency
+}
+
+// batchTimeout is how long a whole batch may take. It is not limited
+// by RequestTimeout, since a batch runs many searches.
+func (s *server) batchTimeout() time.Duration {
+	if n := s.cfg().BatchTimeoutSeconds; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultBatchTimeout
+}
+
+func (s *server) ServeAPISearchBatch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.batchTimeout())
+	defer cancel()
+
+	var req api.BatchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSearchRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeAPIError(ctx, w, decodeError(err))
+		return
+	}
+
+	if len(req.Queries) == 0 {
+		writeError(ctx, w, 400, "bad_request", "You must specify at least one query")
+		return
+	}
+	if len(req.Queries) > maxBatchQueries {
+		writeError(ctx, w, 400, "bad_request",
+			fmt.Sprintf("Too many queries: %d (the limit is %d)", len(req.Queries), maxBatchQueries))
+		return
+	}
+
+	log.Printf(ctx, "batch search queries=%d concurrency=%d",
+		len(req.Queries), s.batchConcurrency())
+
+	results := make([]*api.BatchResult, len(req.Queries))
+	sem := make(chan struct{}, s.batchConcurrency())
+	var wg sync.WaitGroup
+	for i := range req.Queries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = s.batchSearch(ctx, &req.Queries[i])
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		if res.Error != nil {
+			failed++
+		}
+	}
+	totalTime := int64(time.Since(start) / time.Millisecond)
+	log.Printf(ctx, "responding batch queries=%d failed=%d total_time=%d",
+		len(results), failed, totalTime)
+
+	replyJSON(ctx, w, 200, &api.ReplyBatch{
+		Results:   results,
+		TotalTime: totalTime,
+	})
+}
+
+// batchSearch runs a single query from a batch request.
+func (s *server) batchSearch(ctx context.Context, req *api.SearchRequest) *api.BatchResult {
+	q, backends, e := s.queryFromRequest(req)
+	if e != nil {
+		return &api.BatchResult{Error: &e.inner}
+	}
+	reply, e := s.runSearch(ctx, strings.Join(req.Backends, ","), backends, &q, req.Cursor, req.Facets)
+	if e != nil {
+		return &api.BatchResult{Error: &e.inner}
+	}
+	return &api.BatchResult{ReplySearch: reply}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// slowCodeSearch is a fake backend whose searches take delay, and
+// which records how many of them ran at once.
+type slowCodeSearch struct {
+	fakeCodeSearch
+	delay time.Duration
+
+	mu          sync.Mutex
+	running     int
+	maxParallel int
+}
+
+func (c *slowCodeSearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	c.mu.Lock()
+	c.running++
+	if c.running > c.maxParallel {
+		c.maxParallel = c.running
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+
+	time.Sleep(c.delay)
+	return &pb.CodeSearchResult{
+		Stats:   &pb.SearchStats{},
+		Results: []*pb.SearchResult{{Tree: "repo", Path: in.Line, Bounds: &pb.Bounds{}}},
+	}, nil
+}
+
+func serveBatch(t *testing.T, s *server, queries []api.SearchRequest) (int, *api.ReplyBatch) {
+	body, err := json.Marshal(&api.BatchRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.untimedHandler(s.ServeAPISearchBatch).ServeHTTP(w,
+		httptest.NewRequest("POST", "/api/v1/search/batch", strings.NewReader(string(body))))
+	var reply api.ReplyBatch
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("bad reply %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, &reply
+}
+
+func TestBatchOrder(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{
+		"slow": &slowCodeSearch{delay: 50 * time.Millisecond},
+		"fast": &slowCodeSearch{},
+	}, "slow", "fast")
+	code, reply := serveBatch(t, s, []api.SearchRequest{
+		{Line: "first", Backends: []string{"slow"}},
+		{Line: "second", Backends: []string{"fast"}},
+		{Line: "third", Backends: []string{"fast"}},
+	})
+	if code != 200 {
+		t.Fatalf("batch failed: %d", code)
+	}
+	var got []string
+	for _, res := range reply.Results {
+		if res.ReplySearch == nil || len(res.Results) != 1 {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		got = append(got, res.Results[0].Path)
+	}
+	if strings.Join(got, ",") != "first,second,third" {
+		t.Errorf("results in order %v, want the order of the queries", got)
+	}
+}
+
+func TestBatchQueryErrors(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{"a": &slowCodeSearch{}}, "a")
+	code, reply := serveBatch(t, s, []api.SearchRequest{
+		{Line: "ok"},
+		{Line: ""},
+		{Line: "x", Backends: []string{"nope"}},
+		{Line: "("},
+	})
+	if code != 200 {
+		t.Fatalf("one bad query failed the whole batch: %d", code)
+	}
+	if len(reply.Results) != 4 {
+		t.Fatalf("got %d results, want 4", len(reply.Results))
+	}
+	if res := reply.Results[0]; res.Error != nil || res.ReplySearch == nil {
+		t.Errorf("good query: %+v", res)
+	}
+	for i, field := range []string{"line", "backends[0]", "line"} {
+		res := reply.Results[i+1]
+		if res.Error == nil || res.ReplySearch != nil {
+			t.Errorf("query %d: got %+v, want an error", i+1, res)
+			continue
+		}
+		if res.Error.Field != field {
+			t.Errorf("query %d: error %+v, want field %q", i+1, res.Error, field)
+		}
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	cs := &slowCodeSearch{delay: 10 * time.Millisecond}
+	s := newTestServer(map[string]pb.CodeSearchClient{"a": cs}, "a")
+	s.config = &config.Config{DefaultMaxMatches: 50, BatchConcurrency: 2}
+
+	var queries []api.SearchRequest
+	for i := 0; i < 10; i++ {
+		queries = append(queries, api.SearchRequest{Line: fmt.Sprintf("q%d", i)})
+	}
+	if code, _ := serveBatch(t, s, queries); code != 200 {
+		t.Fatalf("batch failed: %d", code)
+	}
+	if cs.maxParallel > 2 {
+		t.Errorf("ran %d searches at once, want at most 2", cs.maxParallel)
+	}
+}
+
+func TestBatchTooManyQueries(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{"a": &slowCodeSearch{}}, "a")
+	queries := make([]api.SearchRequest, maxBatchQueries+1)
+	for i := range queries {
+		queries[i].Line = "x"
+	}
+	if code, _ := serveBatch(t, s, queries); code != 400 {
+		t.Errorf("got %d for %d queries, want 400", code, len(queries))
+	}
+	if code, _ := serveBatch(t, s, nil); code != 400 {
+		t.Errorf("got %d for no queries, want 400", code)
+	}
+}
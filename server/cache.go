@@ -0,0 +1,200 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+const (
+	defaultSearchCacheSize = 1000
+	defaultSearchCacheTTL  = 5 * time.Minute
+)
+
+// searchCache is an LRU cache of backend search replies. An entry is
+// only served while its backend is still serving the index the entry
+// was computed from, and identical searches that arrive while one is
+// already in flight wait for and share its reply.
+//
+// A nil *searchCache is valid and caches nothing.
+type searchCache struct {
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	lru      *list.List // of *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+	inflight map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	key       string
+	indexTime time.Time
+	expires   time.Time
+	reply     *api.ReplySearch
+}
+
+type cacheCall struct {
+	indexTime time.Time
+	done      chan struct{}
+	reply     *api.ReplySearch
+	err       error
+}
+
+func newSearchCache(size int, ttl time.Duration) *searchCache {
+	if size == 0 {
+		size = defaultSearchCacheSize
+	}
+	if size < 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = defaultSearchCacheTTL
+	}
+	return &searchCache{
+		size:     size,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*cacheCall),
+	}
+}
+
+func searchCacheKey(bk *Backend, q *pb.Query) string {
+	return bk.Id + "\x00" + asJSON{q}.String()
+}
+
+// copyReply returns a copy of reply that can be modified without
+// affecting the cached copy. The individual results are shared and
+// must be treated as read-only.
+func copyReply(reply *api.ReplySearch) *api.ReplySearch {
+	out := *reply
+	info := *reply.Info
+	out.Info = &info
+	return &out
+}
+
+// Do returns the reply to the search identified by key against the
+// index built at indexTime, calling search only if the reply is
+// neither cached nor already being computed. The boolean result
+// reports whether the reply came from the cache.
+//
+// A search that may be shared runs on a context that carries ctx's
+// values but not its deadline, so that a caller that gives up doesn't
+// fail the search for everyone else waiting on it. search must set
+// its own deadline. Each caller stops waiting when its own ctx is
+// done.
+func (c *searchCache) Do(ctx context.Context, key string, indexTime time.Time, search func(ctx context.Context) (*api.ReplySearch, error)) (*api.ReplySearch, bool, error) {
+	if c == nil || indexTime.IsZero() {
+		reply, err := search(ctx)
+		return reply, false, err
+	}
+
+	c.mu.Lock()
+	if reply := c.get(key, indexTime); reply != nil {
+		c.mu.Unlock()
+		return c.hit(reply), true, nil
+	}
+	call, ok := c.inflight[key]
+	shared := ok && call.indexTime.Equal(indexTime)
+	if !shared {
+		call = &cacheCall{indexTime: indexTime, done: make(chan struct{})}
+		c.inflight[key] = call
+	}
+	c.mu.Unlock()
+
+	if !shared {
+		go c.run(detachedContext{ctx}, key, call, search)
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, false, call.err
+	}
+	if shared {
+		return c.hit(call.reply), true, nil
+	}
+	return copyReply(call.reply), false, nil
+}
+
+// run performs call, caching its reply if it succeeds.
+func (c *searchCache) run(ctx context.Context, key string, call *cacheCall, search func(ctx context.Context) (*api.ReplySearch, error)) {
+	call.reply, call.err = search(ctx)
+
+	c.mu.Lock()
+	if c.inflight[key] == call {
+		delete(c.inflight, key)
+	}
+	if call.err == nil && call.reply.Info.ExitReason != pb.SearchStats_TIMEOUT.String() {
+		c.add(key, call.indexTime, call.reply)
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// detachedContext carries the values of a request's context, such as
+// its request ID and trace, but is never cancelled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+func (c *searchCache) hit(reply *api.ReplySearch) *api.ReplySearch {
+	out := copyReply(reply)
+	out.Info.Cached = true
+	return out
+}
+
+// get must be called with c.mu held.
+func (c *searchCache) get(key string, indexTime time.Time) *api.ReplySearch {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.indexTime.Equal(indexTime) || time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return entry.reply
+}
+
+// add must be called with c.mu held.
+func (c *searchCache) add(key string, indexTime time.Time, reply *api.ReplySearch) {
+	entry := &cacheEntry{
+		key:       key,
+		indexTime: indexTime,
+		expires:   time.Now().Add(c.ttl),
+		reply:     reply,
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+type countingSearch struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingSearch) search(ctx context.Context) (*api.ReplySearch, error) {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	return &api.ReplySearch{
+		Info:    &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+		Results: []*api.Result{{Path: "a"}},
+	}, nil
+}
+
+func TestSearchCacheHit(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(10, time.Minute)
+	var cs countingSearch
+	index := time.Unix(1000, 0)
+
+	reply, cached, err := c.Do(ctx, "q", index, cs.search)
+	if err != nil || cached {
+		t.Fatalf("first search: cached=%v err=%v", cached, err)
+	}
+	// Modifying a reply must not affect the cached copy.
+	reply.Results = nil
+	reply.Info.ExitReason = "modified"
+
+	reply, cached, err = c.Do(ctx, "q", index, cs.search)
+	if err != nil || !cached || !reply.Info.Cached {
+		t.Fatalf("second search: cached=%v info=%+v err=%v", cached, reply.Info, err)
+	}
+	if len(reply.Results) != 1 || reply.Info.ExitReason != "NONE" {
+		t.Errorf("cached reply was modified: %+v", reply)
+	}
+	if cs.calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", cs.calls)
+	}
+
+	if _, cached, _ = c.Do(ctx, "q", time.Unix(2000, 0), cs.search); cached {
+		t.Errorf("expected a new index to invalidate the cache")
+	}
+	if cs.calls != 2 {
+		t.Errorf("expected 2 backend calls, got %d", cs.calls)
+	}
+}
+
+func TestSearchCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(2, time.Minute)
+	var cs countingSearch
+	index := time.Unix(1000, 0)
+
+	c.Do(ctx, "a", index, cs.search)
+	c.Do(ctx, "b", index, cs.search)
+	c.Do(ctx, "a", index, cs.search)
+	c.Do(ctx, "c", index, cs.search) // evicts b, the least recently used
+
+	if _, cached, _ := c.Do(ctx, "a", index, cs.search); !cached {
+		t.Errorf("expected a to still be cached")
+	}
+	if _, cached, _ := c.Do(ctx, "b", index, cs.search); cached {
+		t.Errorf("expected b to have been evicted")
+	}
+}
+
+func TestSearchCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(10, time.Nanosecond)
+	var cs countingSearch
+	index := time.Unix(1000, 0)
+
+	c.Do(ctx, "q", index, cs.search)
+	time.Sleep(time.Millisecond)
+	if _, cached, _ := c.Do(ctx, "q", index, cs.search); cached {
+		t.Errorf("expected the entry to have expired")
+	}
+}
+
+func TestSearchCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(10, time.Minute)
+	index := time.Unix(1000, 0)
+	fail := func(ctx context.Context) (*api.ReplySearch, error) { return nil, errors.New("down") }
+
+	if _, _, err := c.Do(ctx, "q", index, fail); err == nil {
+		t.Fatalf("expected an error")
+	}
+	var cs countingSearch
+	if _, cached, _ := c.Do(ctx, "q", index, cs.search); cached {
+		t.Errorf("errors should not be cached")
+	}
+}
+
+func TestSearchCacheCoalesce(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(10, time.Minute)
+	index := time.Unix(1000, 0)
+
+	release := make(chan struct{})
+	var cs countingSearch
+	slow := func(ctx context.Context) (*api.ReplySearch, error) {
+		<-release
+		return cs.search(ctx)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.Do(ctx, "q", index, slow); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	// Give the goroutines a chance to pile up on the first call.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if cs.calls != 1 {
+		t.Errorf("expected concurrent searches to share 1 backend call, got %d", cs.calls)
+	}
+}
+
+func TestSearchCacheDisabled(t *testing.T) {
+	ctx := context.Background()
+	c := newSearchCache(-1, 0)
+	var cs countingSearch
+	index := time.Unix(1000, 0)
+	c.Do(ctx, "q", index, cs.search)
+	if _, cached, _ := c.Do(ctx, "q", index, cs.search); cached || cs.calls != 2 {
+		t.Errorf("expected a disabled cache to always call the backend")
+	}
+}
+
+func TestSearchCacheWaiterGivesUp(t *testing.T) {
+	c := newSearchCache(10, time.Minute)
+	index := time.Unix(1000, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var cs countingSearch
+	slow := func(ctx context.Context) (*api.ReplySearch, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return cs.search(ctx)
+	}
+
+	// The caller that starts the search gives up on it, which must
+	// neither stop the search nor fail another caller waiting on it.
+	first, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.Do(first, "q", index, slow)
+		errc <- err
+	}()
+	<-started
+	type result struct {
+		cached bool
+		err    error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		_, cached, err := c.Do(context.Background(), "q", index, slow)
+		waiter <- result{cached, err}
+	}()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("first caller got %v, want context.Canceled", err)
+	}
+	close(release)
+	if res := <-waiter; res.err != nil || !res.cached {
+		t.Errorf("waiter got cached=%v err=%v", res.cached, res.err)
+	}
+	if _, cached, _ := c.Do(context.Background(), "q", index, slow); !cached {
+		t.Errorf("expected the shared reply to be cached")
+	}
+	if cs.calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", cs.calls)
+	}
+}
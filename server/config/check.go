@@ -0,0 +1,428 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Problem is a mistake found in a config file.
+type Problem struct {
+	// Where in the file the problem is, such as
+	// "repositories[2].metadata.github".
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+type checker struct {
+	problems []Problem
+}
+
+func (c *checker) addf(path, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{path, fmt.Sprintf(format, args...)})
+}
+
+// CheckConfig checks a frontend config file, including its
+// index_config.
+func CheckConfig(data []byte) []Problem {
+	c := &checker{}
+	var cfg Config
+	if !c.decode(data, &cfg, func(raw map[string]interface{}) {
+		if idx, ok := raw["index_config"].(map[string]interface{}); ok {
+			normalizeIndex(idx)
+		}
+	}) {
+		return c.problems
+	}
+	c.checkServer(&cfg)
+	c.checkIndex(&cfg.IndexConfig, "index_config.")
+	return c.problems
+}
+
+// CheckIndexConfig checks an index config file, as read by
+// codesearch and livegrep-fetch-reindex.
+func CheckIndexConfig(data []byte) []Problem {
+	c := &checker{}
+	var cfg IndexConfig
+	if !c.decode(data, &cfg, normalizeIndex) {
+		return c.problems
+	}
+	c.checkIndex(&cfg, "")
+	return c.problems
+}
+
+// normalizeIndex rewrites the single-object forms of "fs_paths" and
+// "repositories", which codesearch accepts, as lists.
+func normalizeIndex(raw map[string]interface{}) {
+	for _, key := range []string{"fs_paths", "repositories"} {
+		if obj, ok := raw[key].(map[string]interface{}); ok {
+			raw[key] = []interface{}{obj}
+		}
+	}
+}
+
+// decode parses data into out, reporting syntax errors, fields that
+// would be ignored, and values of the wrong type. It returns false
+// if out couldn't be filled in, in which case there is no point
+// checking it further.
+func (c *checker) decode(data []byte, out interface{}, normalize func(map[string]interface{})) bool {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			// The offset is just past the bad character.
+			line, col := position(data, serr.Offset-1)
+			c.addf("", "line %d, column %d: %s", line, col, serr.Error())
+		} else {
+			c.addf("", "%s", err.Error())
+		}
+		return false
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		c.addf("", "expected a JSON object")
+		return false
+	}
+	normalize(obj)
+
+	n := len(c.problems)
+	c.walk(obj, reflect.TypeOf(out).Elem(), "")
+	normalized, err := json.Marshal(obj)
+	if err == nil {
+		err = json.Unmarshal(normalized, out)
+	}
+	if err != nil {
+		// walk has normally explained why already.
+		if len(c.problems) == n {
+			c.addf("", "%s", err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// position returns the line and column of the byte at offset.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndex(before, []byte("\n"))
+	return line, col
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonField returns the field of struct type t that the JSON key
+// decodes into, matching the way encoding/json does.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name == key {
+			return f, true
+		}
+		if fold == nil && strings.EqualFold(name, key) {
+			fold = &f
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return reflect.StructField{}, false
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// walk compares the JSON value v with the type t that it will be
+// decoded into, reporting unknown fields and mismatched types.
+func (c *checker) walk(v interface{}, t reflect.Type, path string) {
+	if v == nil {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	wrong := func(want string) {
+		c.addf(path, "expected %s, found %s", want, describe(v))
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			wrong("an object")
+			return
+		}
+		for _, k := range sortedKeys(obj) {
+			f, ok := jsonField(t, k)
+			if !ok {
+				c.addf(join(path, k), "unknown field")
+				continue
+			}
+			c.walk(obj[k], f.Type, join(path, k))
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			wrong("an object")
+			return
+		}
+		for _, k := range sortedKeys(obj) {
+			c.walk(obj[k], t.Elem(), join(path, k))
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]interface{})
+		if !ok {
+			wrong("a list")
+			return
+		}
+		for i, e := range list {
+			c.walk(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			wrong("a string")
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			wrong("a boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			wrong("an integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(float64); !ok {
+			wrong("a number")
+		}
+	}
+}
+
+func (c *checker) checkFile(path, file string) {
+	if _, err := os.Stat(file); err != nil {
+		c.addf(path, "%s", err.Error())
+	}
+}
+
+func (c *checker) checkServer(cfg *Config) {
+	if cfg.DocRoot != "" {
+		if fi, err := os.Stat(filepath.Join(cfg.DocRoot, "templates")); err != nil || !fi.IsDir() {
+			c.addf("docroot", "%s has no templates directory", cfg.DocRoot)
+		}
+	}
+	if cfg.Auth.TrustedHeader != "" && !cfg.ReverseProxy {
+		c.addf("auth.trusted_header", "requires reverse_proxy, since clients could otherwise set the header themselves")
+	}
+	if (cfg.HTTP.CertFile == "") != (cfg.HTTP.KeyFile == "") {
+		c.addf("http", "cert_file and key_file must be set together")
+	}
+	if cfg.HTTP.CertFile != "" {
+		c.checkFile("http.cert_file", cfg.HTTP.CertFile)
+	}
+	if cfg.HTTP.KeyFile != "" {
+		c.checkFile("http.key_file", cfg.HTTP.KeyFile)
+	}
+	ids := make(map[string]int)
+	for i, bk := range cfg.Backends {
+		path := fmt.Sprintf("backends[%d]", i)
+		if j, ok := ids[bk.Id]; ok {
+			c.addf(path+".id", "%q is also the id of backends[%d]", bk.Id, j)
+		} else {
+			ids[bk.Id] = i
+		}
+		if bk.Addr == "" && len(bk.Replicas) == 0 {
+			c.addf(path+".addr", "missing, and there are no replicas")
+		}
+		if tls := bk.TLS; tls != nil {
+			if (tls.CertFile == "") != (tls.KeyFile == "") {
+				c.addf(path+".tls", "cert_file and key_file must be set together")
+			}
+			files := []struct{ key, file string }{
+				{"ca_file", tls.CAFile},
+				{"cert_file", tls.CertFile},
+				{"key_file", tls.KeyFile},
+			}
+			for _, f := range files {
+				if f.file != "" {
+					c.checkFile(path+".tls."+f.key, f.file)
+				}
+			}
+		}
+	}
+}
+
+func (c *checker) checkIndex(cfg *IndexConfig, prefix string) {
+	for i, p := range cfg.FsPaths {
+		path := fmt.Sprintf("%sfs_paths[%d]", prefix, i)
+		if p.Path == "" {
+			c.addf(path+".path", "missing")
+		} else {
+			c.checkFile(path+".path", p.Path)
+		}
+		c.checkMetadata(path+".metadata", p.Metadata)
+	}
+
+	names := make(map[string]int)
+	for i, r := range cfg.Repositories {
+		path := fmt.Sprintf("%srepositories[%d]", prefix, i)
+		if r.Name == "" {
+			c.addf(path+".name", "missing")
+		} else if j, ok := names[r.Name]; ok {
+			c.addf(path+".name", "%q is also the name of %srepositories[%d]", r.Name, prefix, j)
+		} else {
+			names[r.Name] = i
+		}
+
+		if len(r.Revisions) == 0 && r.Revision == "" {
+			c.addf(path+".revisions", "no revisions to index")
+		}
+
+		exists := false
+		switch _, err := os.Stat(r.Path); {
+		case r.Path == "":
+			c.addf(path+".path", "missing")
+		case err == nil:
+			exists = true
+		case r.Metadata["remote"] == "":
+			c.addf(path+".path", "%s", err.Error())
+		}
+		// A repository with a remote that hasn't been cloned yet
+		// will be by livegrep-fetch-reindex.
+		if exists {
+			for j, rev := range r.Revisions {
+				c.checkRevision(fmt.Sprintf("%s.revisions[%d]", path, j), r.Path, rev)
+			}
+			if r.Revision != "" {
+				c.checkRevision(path+".revision", r.Path, r.Revision)
+			}
+		}
+		c.checkMetadata(path+".metadata", r.Metadata)
+	}
+}
+
+func (c *checker) checkRevision(path, repo, rev string) {
+	out, err := exec.Command("git", "-C", repo, "rev-parse", "--verify", "--quiet", rev+"^{commit}").CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			c.addf(path, "running git: %s", err.Error())
+			return
+		}
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = "not a commit"
+		}
+		c.addf(path, "%q doesn't resolve in %s: %s", rev, repo, msg)
+	}
+}
+
+var (
+	placeholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+	githubRepoRegex  = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+)
+
+func (c *checker) checkMetadata(path string, md map[string]string) {
+	if pattern, ok := md["url-pattern"]; ok {
+		c.checkURLPattern(path+".url-pattern", pattern)
+	}
+	if gh, ok := md["github"]; ok {
+		c.checkGitHub(path+".github", gh)
+	}
+	if blame, ok := md["blame"]; ok && blame != "git" {
+		c.checkFile(path+".blame", blame)
+	}
+}
+
+func (c *checker) checkURLPattern(path, pattern string) {
+	u, err := url.Parse(pattern)
+	if err != nil {
+		c.addf(path, "%s", err.Error())
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.addf(path, "%q is not an http or https URL", pattern)
+	}
+	hasPath := false
+	for _, p := range placeholderRegex.FindAllString(pattern, -1) {
+		switch p {
+		case "{path}":
+			hasPath = true
+		case "{name}", "{version}", "{lno}":
+		default:
+			c.addf(path, "unknown placeholder %s; expected {name}, {version}, {path} or {lno}", p)
+		}
+	}
+	if !hasPath {
+		c.addf(path, "has no {path} placeholder")
+	}
+}
+
+func (c *checker) checkGitHub(path, value string) {
+	if strings.Contains(value, "://") {
+		u, err := url.ParseRequestURI(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.addf(path, "%q is not an http or https URL", value)
+		}
+		return
+	}
+	if !githubRepoRegex.MatchString(value) {
+		c.addf(path, "%q is neither OWNER/REPO nor a URL", value)
+	}
+}
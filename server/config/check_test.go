@@ -0,0 +1,155 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func problemStrings(problems []Problem) []string {
+	var out []string
+	for _, p := range problems {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func TestCheckSyntax(t *testing.T) {
+	got := problemStrings(CheckIndexConfig([]byte("{\n  \"name\": \"x\",\n  \"repositories\": [,]\n}")))
+	if len(got) != 1 || !strings.HasPrefix(got[0], "line 3, column 20:") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	data := `{
+		"docroot": "",
+		"listen": 8910,
+		"backends": [{"id": "a", "adr": "localhost:9999"}],
+		"index_config": {"repositories": {"name": "r", "path": "/", "revisions": "HEAD"}}
+	}`
+	got := problemStrings(CheckConfig([]byte(data)))
+	want := []string{
+		"backends[0].adr: unknown field",
+		"index_config.repositories[0].revisions: expected a list, found a string",
+		"listen: expected a string, found a number",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckBackends(t *testing.T) {
+	data := `{
+		"backends": [
+			{"id": "a", "addr": "localhost:9001"},
+			{"id": "b", "replicas": ["localhost:9002", "localhost:9003"]},
+			{"id": "c"}
+		]
+	}`
+	var got []string
+	for _, p := range CheckConfig([]byte(data)) {
+		if strings.HasPrefix(p.Path, "backends") {
+			got = append(got, p.String())
+		}
+	}
+	want := []string{"backends[2].addr: missing, and there are no replicas"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckTrustedHeader(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		ok   bool
+	}{
+		{`{"auth": {"trusted_header": "X-Forwarded-User"}}`, false},
+		{`{"auth": {"trusted_header": "X-Forwarded-User"}, "reverse_proxy": true}`, true},
+		{`{"auth": {}}`, true},
+	} {
+		var got []string
+		for _, p := range CheckConfig([]byte(tc.data)) {
+			if p.Path == "auth.trusted_header" {
+				got = append(got, p.String())
+			}
+		}
+		if ok := len(got) == 0; ok != tc.ok {
+			t.Errorf("%s: problems %q", tc.data, got)
+		}
+	}
+}
+
+func TestCheckMetadata(t *testing.T) {
+	cases := []struct {
+		key, value string
+		ok         bool
+	}{
+		{"url-pattern", "https://github.com/{name}/blob/{version}/{path}#L{lno}", true},
+		{"url-pattern", "github.com/{name}/{path}", false},
+		{"url-pattern", "https://example.com/{name}#L{lno}", false},
+		{"url-pattern", "https://example.com/{repo}/{path}", false},
+		{"github", "livegrep/livegrep", true},
+		{"github", "https://github.example.com/livegrep/livegrep", true},
+		{"github", "livegrep", false},
+		{"github", "ftp://github.com/livegrep", false},
+		{"blame", "git", true},
+		{"blame", "/nonexistent/git.log", false},
+	}
+	for _, tc := range cases {
+		c := &checker{}
+		c.checkMetadata("metadata", map[string]string{tc.key: tc.value})
+		if ok := len(c.problems) == 0; ok != tc.ok {
+			t.Errorf("%s=%q: problems %q", tc.key, tc.value, problemStrings(c.problems))
+		}
+	}
+}
+
+func TestCheckRepositories(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "livegrep-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo")
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "-c", "user.name=x", "-c", "user.email=x@example.com",
+			"commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+
+	data := `{
+		"repositories": [
+			{"name": "ok", "path": "` + repo + `", "revisions": ["HEAD"]},
+			{"name": "ok", "path": "` + repo + `", "revisions": ["HEAD", "nope"]},
+			{"name": "gone", "path": "` + filepath.Join(dir, "gone") + `", "revisions": ["HEAD"]},
+			{"name": "cloned", "path": "` + filepath.Join(dir, "cloned") + `", "revisions": ["HEAD"],
+			 "metadata": {"remote": "https://github.com/livegrep/livegrep"}},
+			{"name": "norev", "path": "` + repo + `"}
+		]
+	}`
+	var paths []string
+	for _, p := range CheckIndexConfig([]byte(data)) {
+		paths = append(paths, p.Path)
+	}
+	want := []string{
+		"repositories[1].name",
+		"repositories[1].revisions[1]",
+		"repositories[2].path",
+		"repositories[4].revisions",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("problems at %q, want %q", paths, want)
+	}
+}
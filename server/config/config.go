@@ -7,6 +7,69 @@ import (
 type Backend struct {
 	Id   string `json:"id"`
 	Addr string `json:"addr"`
+	// The addresses of further replicas serving the same index.
+	// Searches are spread across the replicas that are answering
+	// polls, and a failed search is retried on another replica.
+	Replicas []string `json:"replicas"`
+	// How many polls in a row a replica must fail before searches
+	// stop being sent to it. Defaults to 1.
+	UnhealthyAfter int `json:"unhealthy_after"`
+	// If set, hedge searches across replicas.
+	Hedge *Hedge `json:"hedge"`
+	// How to secure the connection to the backend. If unset, the
+	// connection is unencrypted.
+	TLS *ClientTLS `json:"tls"`
+}
+
+// Discovery finds backends while the server is running, in addition
+// to those listed in Config.Backends. Backends that appear are added
+// straight away, and those that disappear are removed once the
+// searches using them have finished.
+type Discovery struct {
+	// A JSON file of the form {"backends": [...]}, listing
+	// backends as in the main config. It is re-read whenever it
+	// changes.
+	File string `json:"file"`
+	// A DNS name, such as "_livegrep._tcp.example.com", whose SRV
+	// records list backends. Each target host becomes a backend
+	// whose id is its full hostname, with a replica for each of
+	// its ports.
+	SRV string `json:"srv"`
+	// Settings, such as tls, for the backends found in SRV
+	// records.
+	SRVBackend Backend `json:"srv_backend"`
+	// How often, in seconds, to check for changes. Defaults to 10.
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+// Hedge configures sending a search to a second replica when the
+// first is slow to answer, using whichever reply arrives first.
+type Hedge struct {
+	// The percentile, such as 95, of recent search times after
+	// which to send the search to a second replica.
+	Percentile float64 `json:"percentile"`
+	// The least time, in milliseconds, to wait before hedging.
+	// Defaults to 10.
+	MinDelayMs int `json:"min_delay_ms"`
+}
+
+// ClientTLS configures a TLS connection to a codesearch backend.
+// Certificates are re-read whenever their files change, so they can
+// be rotated without a restart.
+type ClientTLS struct {
+	// Use TLS even if no files are given below, verifying the
+	// backend against the system's root CAs.
+	Enabled bool `json:"enabled"`
+	// A PEM file of CA certificates to verify the backend with,
+	// instead of the system's.
+	CAFile string `json:"ca_file"`
+	// A PEM client certificate and key, for backends that require
+	// mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// The name to verify the backend's certificate against, if it
+	// differs from the host in its address.
+	ServerName string `json:"server_name"`
 }
 
 type Honeycomb struct {
@@ -14,6 +77,169 @@ type Honeycomb struct {
 	Dataset  string `json:"dataset"`
 }
 
+// Events configures where usage events, such as searches and file
+// views, are sent, in addition to honeycomb.
+type Events struct {
+	// A file to append events to as JSON, one per line.
+	File string `json:"file"`
+	// The size at which the file is rotated. Defaults to 100MB.
+	FileMaxBytes int64 `json:"file_max_bytes"`
+	// How many rotated files to keep. Defaults to 5.
+	FileBackups int `json:"file_backups"`
+	// A URL to POST each event to as JSON.
+	WebhookURL string `json:"webhook_url"`
+	// Extra headers to send with each webhook request, such as
+	// credentials.
+	WebhookHeaders map[string]string `json:"webhook_headers"`
+}
+
+// Health configures when the healthcheck endpoints report a problem.
+// Backends are polled for their info once a minute.
+type Health struct {
+	// How long, in seconds, a backend may go without answering a
+	// poll before it is considered down, failing readiness.
+	// Defaults to 180.
+	MaxPollAgeSeconds int `json:"max_poll_age_seconds"`
+	// If set, readiness also fails if a backend's index is older
+	// than this many seconds.
+	MaxIndexAgeSeconds int `json:"max_index_age_seconds"`
+	// If set, liveness fails once every backend has gone this many
+	// seconds without answering a poll, on the theory that
+	// restarting the web server might help. By default, liveness
+	// only checks that the server is responding.
+	LiveMaxPollAgeSeconds int `json:"live_max_poll_age_seconds"`
+}
+
+type SearchCache struct {
+	// Maximum number of backend replies to cache. Defaults to
+	// 1000; a negative value disables the cache.
+	Size int `json:"size"`
+	// How long, in seconds, a cached reply may be served.
+	// Defaults to 300. Replies are never served once the
+	// backend has loaded a new index.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type SavedSearches struct {
+	// The file saved searches are stored in. Saved searches are
+	// disabled if this is empty.
+	Path string `json:"path"`
+	// The default URL to POST alerts to when a saved search's
+	// results change.
+	WebhookURL string `json:"webhook_url"`
+	// The hosts a saved search may send its alerts to instead. If
+	// this is empty, alerts only go to WebhookURL.
+	WebhookHosts []string `json:"webhook_hosts"`
+}
+
+type Log struct {
+	// The minimum level to log: "debug", "info", "warn", or
+	// "error". Defaults to "info".
+	Level string `json:"level"`
+	// "text" or "json". Defaults to "text".
+	Format string `json:"format"`
+}
+
+// HTTP configures the frontend's HTTP server.
+type HTTP struct {
+	// If set, serve HTTPS with this PEM certificate and key. They
+	// are re-read whenever the files change.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// How long a client may take to send a request, and the
+	// server to write a response. They default to 10 and 90
+	// seconds. Streamed searches aren't subject to the write
+	// timeout over HTTP/1.1, but are over HTTP/2, so keep it above
+	// stream_timeout_seconds.
+	ReadTimeoutSeconds  int `json:"read_timeout_seconds"`
+	WriteTimeoutSeconds int `json:"write_timeout_seconds"`
+	// How long to keep idle connections open. Defaults to 120
+	// seconds.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds"`
+	// How long to wait for requests in flight to finish when
+	// shutting down on SIGTERM. Defaults to 30 seconds.
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+}
+
+// Tracing configures where trace spans are sent. Tracing is
+// disabled if neither an endpoint nor a file is set.
+type Tracing struct {
+	// An OTLP/HTTP endpoint accepting JSON, such as
+	// "http://localhost:4318/v1/traces".
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	// Extra headers to send with each OTLP request, such as
+	// credentials.
+	OTLPHeaders map[string]string `json:"otlp_headers"`
+	// A file to append spans to as JSON, one per line, for local
+	// testing.
+	File string `json:"file"`
+	// The service name reported with each span. Defaults to
+	// "livegrep".
+	ServiceName string `json:"service_name"`
+}
+
+// Auth configures how users are authenticated. Each configured
+// method is tried in turn, and a request is allowed if any of them
+// identifies its user. If none are configured, every request is
+// allowed.
+type Auth struct {
+	// A header, such as "X-Forwarded-User", that a trusted
+	// reverse proxy sets to the name of the authenticated user.
+	// Only set this if every request passes through the proxy,
+	// since clients can otherwise set the header themselves. It
+	// requires reverse_proxy.
+	TrustedHeader string `json:"trusted_header"`
+
+	// Static bearer tokens for API clients, each mapped to the
+	// user name it authenticates as.
+	BearerTokens map[string]string `json:"bearer_tokens"`
+
+	// OpenID Connect login for browsers.
+	OIDC *OIDC `json:"oidc"`
+
+	// Users allowed to use administrative endpoints, such as
+	// /debug/reload-config.
+	Admins []string `json:"admins"`
+}
+
+type OIDC struct {
+	// The issuer URL, used to discover the provider's endpoints.
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// The URL of livegrep's /auth/callback, as registered with
+	// the provider.
+	RedirectURL string `json:"redirect_url"`
+	// Defaults to "openid", "email", and "profile".
+	Scopes []string `json:"scopes"`
+	// The userinfo claim to use as the user name. Defaults to
+	// "email".
+	UserClaim string `json:"user_claim"`
+	// The key used to sign session cookies. It must be at least
+	// 32 bytes long, and changing it logs everyone out.
+	CookieSecret string `json:"cookie_secret"`
+	// How long, in seconds, a login lasts. Defaults to 86400.
+	SessionTTLSeconds int `json:"session_ttl_seconds"`
+}
+
+// ACL restricts who can see which repositories. A repository whose
+// name matches any rule can only be seen by the users and groups
+// allowed by one of the rules it matches; other repositories can be
+// seen by everyone.
+type ACL struct {
+	// Maps each group name to the user names of its members.
+	Groups map[string][]string `json:"groups"`
+	Rules  []ACLRule           `json:"rules"`
+}
+
+type ACLRule struct {
+	// A regex that must match the whole repository name.
+	Repos  string   `json:"repos"`
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
 type Config struct {
 	// Location of the directory containing templates and static
 	// assets. This should point at the "web" directory of the
@@ -29,13 +255,27 @@ type Config struct {
 	// Should we respect X-Real-Ip, X-Real-Proto, and X-Forwarded-Host?
 	ReverseProxy bool `json:"reverse_proxy"`
 
+	// How to authenticate users.
+	Auth Auth `json:"auth"`
+
+	// Which users can see which repositories.
+	ACL ACL `json:"acl"`
+
 	// List of backends to connect to. Each backend must include
 	// the "id" and "addr" fields.
 	Backends []Backend `json:"backends"`
 
-	// The address to listen on, as HOST:PORT.
+	// Where to find more backends while running
+	Discovery Discovery `json:"discovery"`
+
+	// The address to listen on: HOST:PORT, "unix:PATH" for a unix
+	// socket, or "systemd" to use the socket passed by systemd
+	// socket activation.
 	Listen string `json:"listen"`
 
+	// How to serve HTTP
+	HTTP HTTP `json:"http"`
+
 	// HTML injected into layout template
 	// for site-specific customizations
 	HeaderHTML template.HTML `json:"header_html"`
@@ -47,11 +287,47 @@ type Config struct {
 	// Whether to re-load templates on every request
 	Reload bool `json:"reload"`
 
+	// How to log
+	Log Log `json:"log"`
+
 	// honeycomb API write key
 	Honeycomb Honeycomb `json:"honeycomb"`
 
+	// Other places to send usage events
+	Events Events `json:"events"`
+
+	// Where to send trace spans
+	Tracing Tracing `json:"tracing"`
+
 	DefaultMaxMatches int32 `json:"default_max_matches"`
 
+	// How many results into a search clients may page with
+	// cursors. Each page re-runs the search for the results on
+	// every page before it, so this bounds the work one client can
+	// ask of the backends. Defaults to 10000.
+	MaxCursorOffset int `json:"max_cursor_offset"`
+
+	// When to report backends as unhealthy
+	Health Health `json:"health"`
+
+	// Cache of recent search results
+	SearchCache SearchCache `json:"search_cache"`
+
+	// Searches to re-run whenever the backends reindex.
+	SavedSearches SavedSearches `json:"saved_searches"`
+
+	// The maximum number of queries from a single
+	// /api/v1/search/batch request to run at once. Defaults to 8.
+	BatchConcurrency int `json:"batch_concurrency"`
+	// How long a whole batch request may run, in seconds.
+	// Defaults to 60.
+	BatchTimeoutSeconds int `json:"batch_timeout_seconds"`
+
+	// How long a search streamed from /api/v1/search/stream may
+	// run, in seconds. Requests other than streamed and batch
+	// searches are cut off after 8 seconds. Defaults to 60.
+	StreamTimeoutSeconds int `json:"stream_timeout_seconds"`
+
 	// Same json config structure that the backend uses when building indexes;
 	// used here for repository browsing.
 	IndexConfig IndexConfig `json:"index_config"`
@@ -59,14 +335,33 @@ type Config struct {
 	DefaultSearchRepos []string `json:"default_search_repos"`
 }
 
+// IndexConfig describes what codesearch indexes. The same file is
+// read by codesearch, livegrep-fetch-reindex, and (as index_config)
+// the frontend.
 type IndexConfig struct {
-	Name         string       `json:"name"`
+	Name string `json:"name"`
+	// Directories to index as they are on disk.
+	FsPaths      []FsPath     `json:"fs_paths,omitempty"`
 	Repositories []RepoConfig `json:"repositories"`
 }
 
+type FsPath struct {
+	Path     string            `json:"path"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+	// A file listing the paths to index, in order.
+	OrderedContents string `json:"ordered-contents,omitempty"`
+}
+
+// RepoConfig is a git repository to index. The metadata can include
+// "url-pattern" or "github", for linking to another viewer; "blame",
+// which is "git" or the path of a git log file; and "remote", the
+// URL that livegrep-fetch-reindex fetches from.
 type RepoConfig struct {
 	Path      string            `json:"path"`
 	Name      string            `json:"name"`
 	Revisions []string          `json:"revisions"`
 	Metadata  map[string]string `json:"metadata"`
+	// A revision to index in addition to Revisions.
+	Revision string `json:"revision,omitempty"`
 }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+
+	"github.com/livegrep/livegrep/server/api"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// searchCursor records how far into a result set a client has paged.
+// It is handed to clients as an opaque string in
+// api.ReplySearch.NextCursor.
+//
+// The backends have no notion of an offset, so fetching the next page
+// re-runs the search with a larger max_matches and drops everything up
+// to and including the last result the client saw. Fetching page N
+// thus costs the backends as much as fetching pages 1 through N at
+// once; the maximum offset bounds that cost.
+type searchCursor struct {
+	// Fingerprint of the query and backend the cursor belongs to.
+	Query uint64 `json:"q"`
+	// Number of results returned on earlier pages.
+	Offset int `json:"o"`
+	// The last result returned.
+	Tree string `json:"t"`
+	Path string `json:"p"`
+	Line int    `json:"l,omitempty"`
+}
+
+var errBadCursor = errors.New("Invalid or expired cursor")
+
+// defaultMaxCursorOffset is how many results clients may page through
+// unless the config says otherwise. Each page re-runs the search for
+// every result before it, so this bounds how much work a cursor can
+// ask the backends to do.
+const defaultMaxCursorOffset = 10000
+
+// queryFingerprint identifies a query independently of max_matches,
+// which changes from page to page.
+func queryFingerprint(backend string, q *pb.Query) uint64 {
+	key := *q
+	key.MaxMatches = 0
+	h := fnv.New64a()
+	h.Write([]byte(backend))
+	h.Write([]byte{0})
+	h.Write([]byte(asJSON{key}.String()))
+	return h.Sum64()
+}
+
+func (c *searchCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(asJSON{c}.String()))
+}
+
+// decodeCursor parses a cursor handed out for the query with the given
+// fingerprint. Cursors more than maxOffset results in are rejected,
+// since they can only have been made up by the client.
+func decodeCursor(s string, fingerprint uint64, maxOffset int) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errBadCursor
+	}
+	if c.Query != fingerprint || c.Offset < 0 || c.Offset > maxOffset {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// start returns the index of the first result after the cursor. If the
+// last result seen can't be found, because the index changed in
+// the meantime, it falls back to skipping Offset results.
+func (c *searchCursor) start(n int, key func(i int) (string, string, int)) int {
+	for i := 0; i < n; i++ {
+		tree, path, line := key(i)
+		if tree == c.Tree && path == c.Path && line == c.Line {
+			return i + 1
+		}
+	}
+	if c.Offset < n {
+		return c.Offset
+	}
+	return n
+}
+
+// paginate trims reply down to the page following prev (if any) and,
+// if the backend stopped at the match limit, attaches a cursor for the
+// page after that, unless it would be more than maxOffset results in.
+// Filename-only searches page through FileResults; other searches page
+// through Results, and only the first page carries the FileResults.
+func paginate(reply *api.ReplySearch, prev *searchCursor, fingerprint uint64, filenameOnly bool, maxOffset int) {
+	offset := 0
+	if filenameOnly {
+		if prev != nil {
+			i := prev.start(len(reply.FileResults), func(i int) (string, string, int) {
+				r := reply.FileResults[i]
+				return r.Tree, r.Path, 0
+			})
+			reply.FileResults = reply.FileResults[i:]
+			offset = prev.Offset
+		}
+	} else if prev != nil {
+		i := prev.start(len(reply.Results), func(i int) (string, string, int) {
+			r := reply.Results[i]
+			return r.Tree, r.Path, r.LineNumber
+		})
+		reply.Results = reply.Results[i:]
+		reply.FileResults = reply.FileResults[:0]
+		offset = prev.Offset
+	}
+
+	if reply.Info.ExitReason != pb.SearchStats_MATCH_LIMIT.String() {
+		return
+	}
+
+	next := &searchCursor{Query: fingerprint}
+	if filenameOnly {
+		if len(reply.FileResults) == 0 {
+			return
+		}
+		last := reply.FileResults[len(reply.FileResults)-1]
+		next.Offset = offset + len(reply.FileResults)
+		next.Tree, next.Path = last.Tree, last.Path
+	} else {
+		if len(reply.Results) == 0 {
+			return
+		}
+		last := reply.Results[len(reply.Results)-1]
+		next.Offset = offset + len(reply.Results)
+		next.Tree, next.Path, next.Line = last.Tree, last.Path, last.LineNumber
+	}
+	if next.Offset > maxOffset {
+		return
+	}
+	reply.NextCursor = next.Encode()
+}
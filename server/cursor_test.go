@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// fakeSearch returns the first max of total results, the way a backend
+// would.
+func fakeSearch(total, max int) *api.ReplySearch {
+	reply := &api.ReplySearch{
+		Info: &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+	}
+	for i := 0; i < total; i++ {
+		if i == max {
+			reply.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+			break
+		}
+		reply.Results = append(reply.Results, &api.Result{
+			Tree:       "repo",
+			Path:       fmt.Sprintf("file%d", i/3),
+			LineNumber: i % 3,
+		})
+	}
+	return reply
+}
+
+func TestPaginate(t *testing.T) {
+	const total, pageSize = 10, 4
+	q := &pb.Query{Line: "foo"}
+	fp := queryFingerprint("", q)
+
+	var cursor *searchCursor
+	var seen []string
+	for page := 0; ; page++ {
+		if page > total {
+			t.Fatalf("pagination did not terminate")
+		}
+		offset := 0
+		if cursor != nil {
+			offset = cursor.Offset
+		}
+		reply := fakeSearch(total, offset+pageSize)
+		paginate(reply, cursor, fp, false, defaultMaxCursorOffset)
+		if len(reply.Results) > pageSize {
+			t.Errorf("page %d: got %d results, want at most %d", page, len(reply.Results), pageSize)
+		}
+		for _, r := range reply.Results {
+			seen = append(seen, fmt.Sprintf("%s:%d", r.Path, r.LineNumber))
+		}
+		if reply.NextCursor == "" {
+			break
+		}
+		var err error
+		if cursor, err = decodeCursor(reply.NextCursor, fp, defaultMaxCursorOffset); err != nil {
+			t.Fatalf("page %d: decoding cursor: %v", page, err)
+		}
+	}
+
+	if len(seen) != total {
+		t.Fatalf("expected %d results across all pages, got %d: %v", total, len(seen), seen)
+	}
+	dup := make(map[string]bool)
+	for _, s := range seen {
+		if dup[s] {
+			t.Errorf("result %s returned twice", s)
+		}
+		dup[s] = true
+	}
+}
+
+func TestDecodeCursorWrongQuery(t *testing.T) {
+	c := &searchCursor{Query: queryFingerprint("", &pb.Query{Line: "foo"}), Offset: 4}
+	if _, err := decodeCursor(c.Encode(), queryFingerprint("", &pb.Query{Line: "bar"}), 10); err == nil {
+		t.Errorf("expected a cursor for a different query to be rejected")
+	}
+	if _, err := decodeCursor("not a cursor", c.Query, 10); err == nil {
+		t.Errorf("expected a garbage cursor to be rejected")
+	}
+	other := queryFingerprint("", &pb.Query{Line: "foo", MaxMatches: 50})
+	if _, err := decodeCursor(c.Encode(), other, 10); err != nil {
+		t.Errorf("max_matches should not affect the cursor: %v", err)
+	}
+}
+
+func TestCursorMaxOffset(t *testing.T) {
+	fp := queryFingerprint("", &pb.Query{Line: "foo"})
+	c := &searchCursor{Query: fp, Offset: 1 << 30}
+	if _, err := decodeCursor(c.Encode(), fp, defaultMaxCursorOffset); err == nil {
+		t.Errorf("accepted a cursor past the maximum offset")
+	}
+
+	// No cursor is handed out for a page that couldn't be fetched.
+	reply := fakeSearch(10, 4)
+	paginate(reply, nil, fp, false, 3)
+	if reply.NextCursor != "" {
+		t.Errorf("got a cursor past the maximum offset")
+	}
+	reply = fakeSearch(10, 4)
+	paginate(reply, nil, fp, false, 4)
+	if reply.NextCursor == "" {
+		t.Errorf("expected a cursor up to the maximum offset")
+	}
+}
+
+// pagedCodeSearch is a backend with total results, which records the
+// max_matches of every search it runs.
+type pagedCodeSearch struct {
+	fakeCodeSearch
+	total      int
+	maxMatches []int32
+}
+
+func (c *pagedCodeSearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	c.maxMatches = append(c.maxMatches, in.MaxMatches)
+	out := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+	for i := 0; i < c.total; i++ {
+		if i == int(in.MaxMatches) {
+			out.Stats.ExitReason = pb.SearchStats_MATCH_LIMIT
+			break
+		}
+		out.Results = append(out.Results, &pb.SearchResult{
+			Tree:   "repo",
+			Path:   fmt.Sprintf("file%d", i),
+			Bounds: &pb.Bounds{},
+		})
+	}
+	return out, nil
+}
+
+// TestCursorPageCost pins how much work each page asks of the
+// backend: page N re-runs the search for N pages of results.
+func TestCursorPageCost(t *testing.T) {
+	cs := &pagedCodeSearch{total: 100}
+	s := newTestServer(map[string]pb.CodeSearchClient{"a": cs}, "a")
+
+	cursor := ""
+	for page := 1; page <= 3; page++ {
+		q := &pb.Query{Line: "x", MaxMatches: 10}
+		reply, e := s.runSearch(context.Background(), "a", s.backendList(), q, cursor, false)
+		if e != nil {
+			t.Fatalf("page %d: %v", page, e)
+		}
+		if got, want := cs.maxMatches[len(cs.maxMatches)-1], int32(10*page); got != want {
+			t.Errorf("page %d searched for %d matches, want %d", page, got, want)
+		}
+		if len(reply.Results) != 10 || reply.Results[0].Path != fmt.Sprintf("file%d", 10*(page-1)) {
+			t.Fatalf("page %d: got %d results starting at %v", page, len(reply.Results), reply.Results)
+		}
+		cursor = reply.NextCursor
+	}
+	if len(cs.maxMatches) != 3 {
+		t.Errorf("ran %d searches for 3 pages", len(cs.maxMatches))
+	}
+}
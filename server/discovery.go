@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// backend returns the backend with the given id, or nil if there is
+// none.
+func (s *server) backend(id string) *Backend {
+	s.bkMu.RLock()
+	defer s.bkMu.RUnlock()
+	return s.bk[id]
+}
+
+// backendList returns the current backends, in the order they were
+// configured.
+func (s *server) backendList() []*Backend {
+	s.bkMu.RLock()
+	defer s.bkMu.RUnlock()
+	out := make([]*Backend, 0, len(s.bkOrder))
+	for _, id := range s.bkOrder {
+		out = append(out, s.bk[id])
+	}
+	return out
+}
+
+// A backendSet is a set of backends ready to replace the current
+// ones. Backends whose configuration is unchanged are reused; added
+// holds the rest, which are created but not yet started.
+type backendSet struct {
+	bk    map[string]*Backend
+	order []string
+	cfgs  []config.Backend
+	added []*Backend
+}
+
+// newBackendSet creates the backends for cfgs that aren't already
+// running. It returns nil if cfgs is what the backends were last set
+// from. The caller must hold s.reloadMu, so that the current backends
+// don't change until the set is swapped in.
+func (s *server) newBackendSet(cfgs []config.Backend) (*backendSet, error) {
+	s.bkMu.RLock()
+	current, last := s.bk, s.bkCfgs
+	s.bkMu.RUnlock()
+
+	// Discovery usually finds what it found last time; there is
+	// nothing to do, or to warn about again.
+	if last != nil && reflect.DeepEqual(cfgs, last) {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	set := &backendSet{
+		bk:    make(map[string]*Backend, len(cfgs)),
+		order: make([]string, 0, len(cfgs)),
+		cfgs:  append([]config.Backend{}, cfgs...),
+	}
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if _, ok := set.bk[cfg.Id]; ok {
+			log.Warnf(ctx, "ignoring duplicate backend id=%s", cfg.Id)
+			continue
+		}
+		be := current[cfg.Id]
+		if be == nil || !reflect.DeepEqual(&be.cfg, cfg) {
+			var err error
+			if be, err = NewBackend(cfg); err != nil {
+				for _, b := range set.added {
+					b.Stop()
+				}
+				return nil, err
+			}
+			if s.saved != nil {
+				be.OnReindex = s.saved.trigger
+			}
+			set.added = append(set.added, be)
+		}
+		set.bk[be.Id] = be
+		set.order = append(set.order, be.Id)
+	}
+	return set, nil
+}
+
+// swapBackends makes set the backends to search, starting the new
+// ones and stopping the ones it drops. The caller must hold s.bkMu.
+// s.bk and s.bkOrder are replaced rather than modified, so that
+// requests already using them are unaffected.
+func (s *server) swapBackends(set *backendSet) {
+	ctx := context.Background()
+	for id, old := range s.bk {
+		if set.bk[id] != old {
+			log.Printf(ctx, "removing backend id=%s addr=%s", id, old.Addr)
+			old.Stop()
+		}
+	}
+	for _, be := range set.added {
+		log.Printf(ctx, "adding backend id=%s addr=%s", be.Id, be.Addr)
+		be.Start()
+	}
+	s.bk, s.bkOrder, s.bkCfgs = set.bk, set.order, set.cfgs
+}
+
+// setBackends makes cfgs the set of backends to search. Backends whose
+// configuration is unchanged are kept as they are; the rest are
+// created or stopped. The caller must hold s.reloadMu.
+func (s *server) setBackends(cfgs []config.Backend) error {
+	set, err := s.newBackendSet(cfgs)
+	if err != nil || set == nil {
+		return err
+	}
+	s.bkMu.Lock()
+	defer s.bkMu.Unlock()
+	s.swapBackends(set)
+	return nil
+}
+
+// A discoverer finds backends.
+type discoverer interface {
+	discover() ([]config.Backend, error)
+}
+
+func newDiscoverers(cfg *config.Discovery) []discoverer {
+	var out []discoverer
+	if cfg.File != "" {
+		out = append(out, &fileDiscoverer{path: cfg.File})
+	}
+	if cfg.SRV != "" {
+		out = append(out, &srvDiscoverer{
+			name:     cfg.SRV,
+			template: cfg.SRVBackend,
+			lookup:   net.LookupSRV,
+		})
+	}
+	return out
+}
+
+// fileDiscoverer reads backends from a JSON file. It only reads the
+// file again once its modification time or size changes.
+type fileDiscoverer struct {
+	path string
+
+	modTime  time.Time
+	size     int64
+	backends []config.Backend
+	err      error
+}
+
+func (d *fileDiscoverer) discover() ([]config.Backend, error) {
+	st, err := os.Stat(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if d.modTime.Equal(st.ModTime()) && d.size == st.Size() {
+		return d.backends, d.err
+	}
+	d.modTime, d.size = st.ModTime(), st.Size()
+	d.backends, d.err = d.read()
+	return d.backends, d.err
+}
+
+func (d *fileDiscoverer) read() ([]config.Backend, error) {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Backends []config.Backend `json:"backends"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", d.path, err)
+	}
+	return f.Backends, nil
+}
+
+// srvDiscoverer finds backends by looking up DNS SRV records.
+type srvDiscoverer struct {
+	name     string
+	template config.Backend
+	lookup   func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (d *srvDiscoverer) discover() ([]config.Backend, error) {
+	_, records, err := d.lookup("", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Target != records[j].Target {
+			return records[i].Target < records[j].Target
+		}
+		return records[i].Port < records[j].Port
+	})
+	out := make([]config.Backend, 0, len(records))
+	index := make(map[string]int)
+	for _, r := range records {
+		// The whole hostname is the id, since hosts in different
+		// domains may share a first label.
+		id := strings.TrimSuffix(r.Target, ".")
+		addr := net.JoinHostPort(id, fmt.Sprint(r.Port))
+		// Several ports on one host are replicas of one backend.
+		if i, ok := index[id]; ok {
+			out[i].Replicas = append(out[i].Replicas, addr)
+			continue
+		}
+		bk := d.template
+		bk.Id = id
+		bk.Addr = addr
+		bk.Replicas = nil
+		index[id] = len(out)
+		out = append(out, bk)
+	}
+	return out, nil
+}
+
+// discoverBackends returns the static backends plus any that are
+// discovered.
+func discoverBackends(static []config.Backend, discoverers []discoverer) ([]config.Backend, error) {
+	cfgs := append([]config.Backend(nil), static...)
+	for _, d := range discoverers {
+		found, err := d.discover()
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, found...)
+	}
+	return cfgs, nil
+}
+
+// refreshBackends sets the backends to the configured ones plus any
+// that are discovered. If a discoverer fails, it returns the error
+// without changing anything, so that a bad file or a DNS outage
+// doesn't remove every backend.
+func (s *server) refreshBackends(discoverers []discoverer) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	cfgs, err := discoverBackends(s.cfg().Backends, discoverers)
+	if err != nil {
+		return err
+	}
+	return s.setBackends(cfgs)
+}
+
+const defaultDiscoveryInterval = 10 * time.Second
+
+func (s *server) discoveryInterval() time.Duration {
+	if n := s.cfg().Discovery.IntervalSeconds; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultDiscoveryInterval
+}
+
+// runDiscovery periodically refreshes the backends until ctx is done.
+// A failure is only logged when it differs from the last one, so that
+// a file left broken doesn't warn on every poll.
+func (s *server) runDiscovery(ctx context.Context, discoverers []discoverer) {
+	tick := time.NewTicker(s.discoveryInterval())
+	defer tick.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if err := s.refreshBackends(discoverers); err == nil {
+			lastErr = ""
+		} else if err.Error() != lastErr {
+			log.Warnf(ctx, "discovering backends, keeping the current ones: %s", err)
+			lastErr = err.Error()
+		}
+	}
+}
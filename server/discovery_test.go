@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+func backendIds(s *server) []string {
+	var ids []string
+	for _, bk := range s.backendList() {
+		ids = append(ids, bk.Id)
+	}
+	return ids
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.json")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &server{config: &config.Config{
+		Backends: []config.Backend{{Id: "static", Addr: "localhost:9000"}},
+	}}
+	discoverers := newDiscoverers(&config.Discovery{File: path})
+	defer func() {
+		for _, bk := range s.backendList() {
+			bk.Stop()
+		}
+	}()
+
+	write(`{"backends": [{"id": "a", "addr": "localhost:9001"}, {"id": "b", "addr": "localhost:9002"}]}`)
+	if err := s.refreshBackends(discoverers); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backendIds(s), []string{"static", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+	a := s.backend("a")
+
+	write(`{"backends": [{"id": "a", "addr": "localhost:9001"}, {"id": "c", "addr": "localhost:9003"}]}`)
+	if err := s.refreshBackends(discoverers); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backendIds(s), []string{"static", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+	if s.backend("a") != a {
+		t.Errorf("an unchanged backend was replaced")
+	}
+	if s.backend("b") != nil {
+		t.Errorf("a removed backend is still searched")
+	}
+
+	write(`{"backends": [`)
+	if err := s.refreshBackends(discoverers); err == nil {
+		t.Errorf("accepted a malformed file")
+	}
+	if got, want := backendIds(s), []string{"static", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a bad file changed the backends to %v", got)
+	}
+}
+
+func TestFileDiscoveryUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends.json")
+	mtime := time.Unix(1000000, 0)
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &fileDiscoverer{path: path}
+
+	write(`{"backends": [{"id": "a"}]}`)
+	if got, err := d.discover(); err != nil || len(got) != 1 || got[0].Id != "a" {
+		t.Fatalf("discovered %+v, %v", got, err)
+	}
+	// Same size and modification time: the file isn't read again.
+	write(`{"backends": [{"id": "b"}]}`)
+	if got, err := d.discover(); err != nil || len(got) != 1 || got[0].Id != "a" {
+		t.Errorf("reread an unchanged file: %+v, %v", got, err)
+	}
+	mtime = mtime.Add(time.Second)
+	write(`{"backends": [{"id": "b"}]}`)
+	if got, err := d.discover(); err != nil || len(got) != 1 || got[0].Id != "b" {
+		t.Errorf("missed a change: %+v, %v", got, err)
+	}
+}
+
+func TestDuplicateBackendWarnedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	s := &server{config: &config.Config{}}
+	cfgs := []config.Backend{
+		{Id: "a", Addr: "localhost:9001"},
+		{Id: "a", Addr: "localhost:9002"},
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.setBackends(cfgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopBackends(s)
+	log.SetOutput(os.Stdout)
+
+	if n := strings.Count(buf.String(), "duplicate backend id=a"); n != 1 {
+		t.Errorf("warned %d times about an unchanged duplicate, want once", n)
+	}
+}
+
+func TestRunDiscoveryStops(t *testing.T) {
+	s := &server{config: &config.Config{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.runDiscovery(ctx, nil)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDiscovery didn't stop")
+	}
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	d := &srvDiscoverer{
+		name:     "_livegrep._tcp.example.com",
+		template: config.Backend{UnhealthyAfter: 3},
+		lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+			if name != "_livegrep._tcp.example.com" {
+				t.Errorf("looked up %q", name)
+			}
+			return "", []*net.SRV{
+				{Target: "linux.example.com.", Port: 9999},
+				{Target: "android.example.com.", Port: 9998},
+				{Target: "linux.example.com.", Port: 9998},
+				{Target: "linux.dc2.example.com.", Port: 9998},
+			}, nil
+		},
+	}
+	got, err := d.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []config.Backend{
+		{Id: "android.example.com", Addr: "android.example.com:9998", UnhealthyAfter: 3},
+		{Id: "linux.dc2.example.com", Addr: "linux.dc2.example.com:9998", UnhealthyAfter: 3},
+		{Id: "linux.example.com", Addr: "linux.example.com:9998", Replicas: []string{"linux.example.com:9999"}, UnhealthyAfter: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discovered %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+// An Event records something a user did, such as running a search or
+// viewing a file, for usage analytics.
+type Event struct {
+	// The kind of event: "search", "file", "blame", "diff", or
+	// "log".
+	Type   string
+	Time   time.Time
+	Fields map[string]interface{}
+}
+
+func (e *Event) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{}, len(e.Fields)+2)
+	for k, v := range e.Fields {
+		out[k] = v
+	}
+	out["type"] = e.Type
+	out["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	return json.Marshal(out)
+}
+
+// An EventSink receives events. Send is called while serving
+// requests, so it shouldn't block.
+type EventSink interface {
+	Send(e *Event)
+}
+
+type multiSink []EventSink
+
+func (m multiSink) Send(e *Event) {
+	for _, s := range m {
+		s.Send(e)
+	}
+}
+
+// newEventSink returns a sink sending events everywhere configured
+// in cfg, or nil if nowhere is.
+func newEventSink(cfg *config.Config) (EventSink, error) {
+	var sinks multiSink
+	if cfg.Honeycomb.WriteKey != "" {
+		log.Printf(context.Background(),
+			"Enabling honeycomb dataset=%s", cfg.Honeycomb.Dataset)
+		sinks = append(sinks, newHoneycombSink(&cfg.Honeycomb))
+	}
+	if cfg.Events.File != "" {
+		f, err := newFileSink(&cfg.Events)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, f)
+	}
+	if cfg.Events.WebhookURL != "" {
+		sinks = append(sinks, newWebhookSink(&cfg.Events))
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+type honeycombSink struct {
+	builder *libhoney.Builder
+}
+
+func newHoneycombSink(cfg *config.Honeycomb) *honeycombSink {
+	b := libhoney.NewBuilder()
+	b.WriteKey = cfg.WriteKey
+	b.Dataset = cfg.Dataset
+	return &honeycombSink{b}
+}
+
+func (h *honeycombSink) Send(e *Event) {
+	ev := h.builder.NewEvent()
+	ev.Timestamp = e.Time
+	ev.AddField("type", e.Type)
+	for k, v := range e.Fields {
+		ev.AddField(k, v)
+	}
+	ev.Send()
+}
+
+// fileSink appends events to a file as JSON, one per line, rotating
+// the file once it grows past maxBytes. Rotated files are renamed
+// with the suffixes .1, .2, and so on, with .1 the most recent.
+type fileSink struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newFileSink(cfg *config.Events) (*fileSink, error) {
+	s := &fileSink{
+		path:     cfg.File,
+		maxBytes: cfg.FileMaxBytes,
+		backups:  cfg.FileBackups,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = 100 << 20
+	}
+	if s.backups <= 0 {
+		s.backups = 5
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = st.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.backups))
+	for i := s.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Send(e *Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf(context.Background(), "encoding event err=%q", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			log.Errorf(context.Background(), "rotating event log path=%s err=%q", s.path, err.Error())
+		}
+	}
+	if s.f == nil {
+		// A previous rotation failed part way; try again.
+		if err := s.open(); err != nil {
+			log.Errorf(context.Background(), "opening event log path=%s err=%q", s.path, err.Error())
+			return
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		log.Errorf(context.Background(), "writing event log path=%s err=%q", s.path, err.Error())
+	}
+}
+
+// webhookSink POSTs each event as JSON to a URL from a background
+// goroutine. Events are dropped if the webhook can't keep up.
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	events  chan *Event
+}
+
+func newWebhookSink(cfg *config.Events) *webhookSink {
+	s := &webhookSink{
+		url:     cfg.WebhookURL,
+		headers: cfg.WebhookHeaders,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		events:  make(chan *Event, 1024),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Send(e *Event) {
+	select {
+	case s.events <- e:
+	default:
+		log.Warnf(context.Background(), "dropping event type=%s: webhook queue full", e.Type)
+	}
+}
+
+func (s *webhookSink) run() {
+	for e := range s.events {
+		if err := s.post(e); err != nil {
+			log.Warnf(context.Background(), "posting event url=%s err=%q", s.url, err.Error())
+		}
+	}
+}
+
+func (s *webhookSink) post(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEvent sends an event of type typ to s.events, adding the
+// request ID and user from ctx to fields.
+func (s *server) sendEvent(ctx context.Context, typ string, fields map[string]interface{}) {
+	if s.events == nil {
+		return
+	}
+	if id, ok := reqid.FromContext(ctx); ok {
+		fields["request_id"] = string(id)
+	}
+	if id, ok := auth.FromContext(ctx); ok {
+		fields["user"] = id.User
+	}
+	s.events.Send(&Event{Type: typ, Time: time.Now(), Fields: fields})
+}
+
+// sendBrowseEvent reports a successful file, blame, diff, or log
+// view.
+func (s *server) sendBrowseEvent(ctx context.Context, typ, repo, path, commit string, isAPI bool) {
+	s.sendEvent(ctx, typ, map[string]interface{}{
+		"repo":   repo,
+		"path":   path,
+		"commit": commit,
+		"api":    isAPI,
+	})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+type recordingSink struct {
+	events []*Event
+}
+
+func (r *recordingSink) Send(e *Event) {
+	r.events = append(r.events, e)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	s, err := newFileSink(&config.Events{File: path, FileMaxBytes: 100, FileBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Send(&Event{Type: "file", Time: time.Now(), Fields: map[string]interface{}{"repo": "livegrep"}})
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 100 {
+			t.Errorf("%s: %d bytes, expected at most 100", p, len(data))
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var ev map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatalf("%s: bad line %q: %v", p, line, err)
+			}
+			if ev["type"] != "file" || ev["repo"] != "livegrep" {
+				t.Errorf("%s: unexpected event %v", p, ev)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 backups")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	got := make(chan map[string]interface{}, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("missing header, got %v", r.Header)
+		}
+		var ev map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		got <- ev
+	}))
+	defer hook.Close()
+
+	s := newWebhookSink(&config.Events{
+		WebhookURL:     hook.URL,
+		WebhookHeaders: map[string]string{"X-Token": "secret"},
+	})
+	s.Send(&Event{Type: "blame", Time: time.Now(), Fields: map[string]interface{}{"path": "a.go"}})
+
+	select {
+	case ev := <-got:
+		if ev["type"] != "blame" || ev["path"] != "a.go" {
+			t.Errorf("unexpected event %v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	sink := &recordingSink{}
+	s := &server{events: sink}
+
+	ctx := reqid.NewContext(context.Background(), "req-1")
+	ctx = auth.NewContext(ctx, auth.Identity{User: "alice"})
+	s.sendBrowseEvent(ctx, "diff", "livegrep", "", "abc123", true)
+
+	if len(sink.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(sink.events))
+	}
+	ev := sink.events[0]
+	want := map[string]interface{}{
+		"repo":       "livegrep",
+		"commit":     "abc123",
+		"api":        true,
+		"request_id": "req-1",
+		"user":       "alice",
+	}
+	if ev.Type != "diff" {
+		t.Errorf("type = %q, want diff", ev.Type)
+	}
+	for k, v := range want {
+		if ev.Fields[k] != v {
+			t.Errorf("%s = %v, want %v", k, ev.Fields[k], v)
+		}
+	}
+
+	// With no sinks configured, events are dropped.
+	s.events = nil
+	s.sendBrowseEvent(ctx, "diff", "livegrep", "", "abc123", true)
+}
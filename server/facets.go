@@ -0,0 +1,52 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// pathFacet returns the top-level directory of path, with a trailing
+// slash, or path itself if it is not in a directory.
+func pathFacet(path string) string {
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i+1]
+	}
+	return path
+}
+
+// languageFacet returns the file type of path, falling back to its
+// extension if the type is unknown.
+func languageFacet(path string) string {
+	ext := filepath.Ext(path)
+	if lang, ok := extToLangMap[ext]; ok {
+		return lang
+	}
+	return ext
+}
+
+// countFacets counts the results of reply, or its file results if it
+// is a filename-only search.
+func countFacets(reply *api.ReplySearch, filenameOnly bool) *api.Facets {
+	facets := &api.Facets{
+		Trees:     make(map[string]int),
+		Paths:     make(map[string]int),
+		Languages: make(map[string]int),
+	}
+	add := func(tree, path string) {
+		facets.Trees[tree]++
+		facets.Paths[pathFacet(path)]++
+		facets.Languages[languageFacet(path)]++
+	}
+	if filenameOnly {
+		for _, r := range reply.FileResults {
+			add(r.Tree, r.Path)
+		}
+	} else {
+		for _, r := range reply.Results {
+			add(r.Tree, r.Path)
+		}
+	}
+	return facets
+}
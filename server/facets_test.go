@@ -0,0 +1,41 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func TestCountFacets(t *testing.T) {
+	reply := &api.ReplySearch{
+		Results: []*api.Result{
+			{Tree: "livegrep", Path: "server/api.go"},
+			{Tree: "livegrep", Path: "server/api.go"},
+			{Tree: "livegrep", Path: "web/src/codesearch.js"},
+			{Tree: "other", Path: "README"},
+			{Tree: "other", Path: "lib/data.csv"},
+		},
+		FileResults: []*api.FileResult{
+			{Tree: "other", Path: "main.c"},
+		},
+	}
+
+	want := &api.Facets{
+		Trees:     map[string]int{"livegrep": 3, "other": 2},
+		Paths:     map[string]int{"server/": 2, "web/": 1, "README": 1, "lib/": 1},
+		Languages: map[string]int{"go": 2, "javascript": 1, "": 1, ".csv": 1},
+	}
+	if got := countFacets(reply, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("countFacets: got %+v, want %+v", got, want)
+	}
+
+	want = &api.Facets{
+		Trees:     map[string]int{"other": 1},
+		Paths:     map[string]int{"main.c": 1},
+		Languages: map[string]int{"c": 1},
+	}
+	if got := countFacets(reply, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("countFacets(filenameOnly): got %+v, want %+v", got, want)
+	}
+}
@@ -4,17 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/livegrep/livegrep/blameworthy"
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
 )
 
 // Blame experiment.
@@ -91,11 +92,30 @@ func setHistory(key string, value *blameworthy.GitHistory) {
 	historiesLock.Unlock()
 }
 
-func initBlame(cfg *config.Config) error {
-	log.Printf("Loading blame...")
+// dropHistories forgets the history of every repository not in
+// repos, so that removing a repository frees its history.
+func dropHistories(repos map[string]config.RepoConfig) {
+	historiesLock.Lock()
+	defer historiesLock.Unlock()
+	for name := range histories {
+		if _, ok := repos[name]; !ok {
+			delete(histories, name)
+		}
+	}
+}
+
+func initBlame(ctx context.Context, cfg *config.Config) error {
+	loadBlame(ctx, cfg.IndexConfig.Repositories)
+	return nil
+}
+
+// loadBlame reads the git history of those repos that have blame
+// configured, skipping any that can't be read.
+func loadBlame(ctx context.Context, repos []config.RepoConfig) {
+	log.Printf(ctx, "Loading blame...")
 	start := time.Now()
 
-	for _, r := range cfg.IndexConfig.Repositories {
+	for _, r := range repos {
 		path, ok := r.Metadata["blame"]
 		if !ok {
 			continue
@@ -103,35 +123,33 @@ func initBlame(cfg *config.Config) error {
 		var gitLogOutput io.ReadCloser
 		if path == "git" {
 			var err error
-			log.Print("Running git log on: ", r.Path)
+			log.Printf(ctx, "Running git log on: %s", r.Path)
 			gitLogOutput, err = blameworthy.RunGitLog(r.Path, "HEAD")
 			if err != nil {
-				log.Print("Skipping blame: ", err)
+				log.Warnf(ctx, "Skipping blame: %s", err)
 				continue
 			}
 		} else {
 			var err error
-			log.Print("Reading git log file: ", path)
+			log.Printf(ctx, "Reading git log file: %s", path)
 			gitLogOutput, err = os.Open(path)
 			if err != nil {
-				log.Print("Skipping blame file: ", err)
+				log.Warnf(ctx, "Skipping blame file: %s", err)
 				continue
 			}
 		}
 		gitHistory, err := blameworthy.ParseGitLog(gitLogOutput)
 		if err != nil {
-			log.Print("Skipping blame: ", err)
+			log.Warnf(ctx, "Skipping blame: %s", err)
 			continue
 		}
 		setHistory(r.Name, gitHistory)
 	}
 	elapsed := time.Since(start)
-	log.Printf("Blame loaded in %s", elapsed)
-
-	return nil
+	log.Printf(ctx, "Blame loaded in %s", elapsed)
 }
 
-func resolveCommit(repo config.RepoConfig, commitName, path string, data *BlameData) error {
+func resolveCommit(ctx context.Context, repo config.RepoConfig, commitName, path string, data *BlameData) error {
 	// TODO: this is an awkward fix for a synchronization problem.
 	// The necessary order of operations of a server will be to "git
 	// pull" a new master before then running "git log", which means
@@ -156,7 +174,7 @@ func resolveCommit(repo config.RepoConfig, commitName, path string, data *BlameD
 			}
 		}
 	}
-	output, err := gitShowCommit(commitName, repo.Path)
+	output, err := gitShowCommit(ctx, commitName, repo.Path)
 	if err != nil {
 		return err
 	}
@@ -169,6 +187,7 @@ func resolveCommit(repo config.RepoConfig, commitName, path string, data *BlameD
 }
 
 func buildBlameData(
+	ctx context.Context,
 	repo config.RepoConfig,
 	commitHash string,
 	gitHistory *blameworthy.GitHistory,
@@ -179,7 +198,7 @@ func buildBlameData(
 	start := time.Now()
 
 	obj := commitHash + ":" + path
-	content, err := gitCatBlob(obj, repo.Path)
+	content, err := gitCatBlob(ctx, obj, repo.Path)
 	if err != nil {
 		return err
 	}
@@ -208,7 +227,7 @@ func buildBlameData(
 	}
 
 	elapsed := time.Since(start)
-	log.Print(elapsed, " to prepare blame for ", obj)
+	log.Debugf(ctx, "%s to prepare blame for %s", elapsed, obj)
 
 	data.PreviousCommit = result.PreviousCommitHash
 	data.NextCommit = result.NextCommitHash
@@ -240,7 +259,7 @@ func fileRedirect(gitHistory *blameworthy.GitHistory, repoName, hash, path, dest
 	return url, nil
 }
 
-func diffRedirect(w http.ResponseWriter, r *http.Request, repoName string, hash string, rest string) {
+func diffRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request, repoName string, hash string, rest string) {
 	gitHistory := getHistory(repoName)
 	if gitHistory == nil {
 		http.Error(w, "Repo not configured for blame", 404)
@@ -264,17 +283,15 @@ func diffRedirect(w http.ResponseWriter, r *http.Request, repoName string, hash
 		http.Error(w, "Not found", 404)
 		return
 	}
-	fmt.Print("A\n", rest, " ", rest[:j], "\n")
+	log.Debugf(ctx, "diff redirect rest=%q index=%q kind=%q", rest, rest[:j], rest[j:j+1])
 	commitIndex, err := strconv.Atoi(rest[:j])
 	if err != nil {
 		http.Error(w, "Not found", 404)
 		return
 	}
-	fmt.Print("A\n")
 	path := gitHistory.Commits[hash].Diffs[commitIndex].Path
 
 	var fragment, url string
-	fmt.Print(rest[j], "\n")
 	if rest[j] == 102 { // "f"
 		fragment = rest[j+1:]
 		url = fmt.Sprint("/blame/", repoName, "/", destHash,
@@ -288,7 +305,7 @@ func diffRedirect(w http.ResponseWriter, r *http.Request, repoName string, hash
 			"/#", destIndex, fragment)
 	}
 
-	fmt.Print(url, "\n")
+	log.Debugf(ctx, "diff redirect url=%q", url)
 	http.Redirect(w, r, url, 307)
 }
 
@@ -302,6 +319,7 @@ func indexOfFileInCommit(history *blameworthy.GitHistory, path string, hash stri
 }
 
 func buildDiffData(
+	ctx context.Context,
 	repo config.RepoConfig,
 	commitHash string,
 	data *DiffData,
@@ -333,7 +351,7 @@ this command in a local repository to at least view the diff:
 git show %s`, commitHash, commitHash)
 			return fmt.Errorf(msg)
 		}
-		lines, content_lines, err := extendDiff(repo, commitHash, gitHistory, diff.Path)
+		lines, content_lines, err := extendDiff(ctx, repo, commitHash, gitHistory, diff.Path)
 		if err != nil {
 			return err
 		}
@@ -343,7 +361,7 @@ git show %s`, commitHash, commitHash)
 	}
 
 	elapsed := time.Since(start)
-	log.Print(elapsed, " to prepare blame for ", commitHash)
+	log.Debugf(ctx, "%s to prepare blame for %s", elapsed, commitHash)
 
 	// TODO: add map so this lookup is O(1)?
 	var i int
@@ -364,6 +382,7 @@ git show %s`, commitHash, commitHash)
 }
 
 func extendDiff(
+	ctx context.Context,
 	repo config.RepoConfig,
 	commitHash string,
 	gitHistory *blameworthy.GitHistory,
@@ -385,7 +404,7 @@ func extendDiff(
 
 	if len(futureVector) > 0 {
 		obj := commitHash + ":" + path
-		content, err := gitCatBlob(obj, repo.Path)
+		content, err := gitCatBlob(ctx, obj, repo.Path)
 		if err != nil {
 			err = fmt.Errorf("Error getting blob: %s", err)
 			return lines, content_lines, err
@@ -395,7 +414,7 @@ func extendDiff(
 
 	if len(blameVector) > 0 {
 		obj := result.PreviousCommitHash + ":" + path
-		content, err := gitCatBlob(obj, repo.Path)
+		content, err := gitCatBlob(ctx, obj, repo.Path)
 		if err != nil {
 			err = fmt.Errorf("Error getting blob: %s", err)
 			return lines, content_lines, err
@@ -503,6 +522,7 @@ func extendDiff(
 }
 
 func buildLogData(
+	ctx context.Context,
 	repo config.RepoConfig,
 	gitHistory *blameworthy.GitHistory,
 	path string,
@@ -545,7 +565,7 @@ func buildLogData(
 			blameData.Content = fmt.Sprint("-", deleted)
 		}
 
-		err := resolveCommit(repo, commit.Hash, repo.Path, &blameData)
+		err := resolveCommit(ctx, repo, commit.Hash, repo.Path, &blameData)
 		if err != nil {
 			return LogData{}, err
 		}
@@ -601,12 +621,10 @@ func buildLogData(
 	return data, nil
 }
 
-func gitShowCommit(commitHash string, repoPath string) (string, error) {
+func gitShowCommit(ctx context.Context, commitHash string, repoPath string) (string, error) {
 	// git show --pretty="%H%n%an <%ae>%n%ci%n%s" --quiet master master:travisdeps.sh
-	out, err := exec.Command(
-		"git", "-C", repoPath, "show", "--quiet",
-		"--pretty=%H%n%an <%ae>%n%ci%n%s", commitHash,
-	).Output()
+	out, err := gitOutput(ctx, repoPath,
+		"show", "--quiet", "--pretty=%H%n%an <%ae>%n%ci%n%s", commitHash)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,102 @@
+// Package filereload caches values parsed from files, such as TLS
+// certificates, re-reading them when the files change.
+package filereload
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/log"
+)
+
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// A Reloader caches a value parsed from some files, parsing them
+// again whenever any of them changes.
+type Reloader struct {
+	paths []string
+	parse func() (interface{}, error)
+
+	mu     sync.Mutex
+	stamps []stamp
+	val    interface{}
+	// The last error, and the last one warned about, so that files
+	// that stay broken are neither parsed nor warned about again.
+	err    error
+	warned string
+}
+
+func New(parse func() (interface{}, error), paths ...string) *Reloader {
+	return &Reloader{paths: paths, parse: parse}
+}
+
+// Get returns the value parsed from the current files. If they can't
+// be read or parsed but were before, such as while a certificate and
+// key are being replaced one at a time, it returns the last good
+// value. Files that fail to parse aren't parsed again until they
+// change.
+func (r *Reloader) Get() (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps, err := r.stat()
+	if err == nil && sameStamps(stamps, r.stamps) {
+		if r.val != nil {
+			return r.val, nil
+		}
+		return nil, r.err
+	}
+	var val interface{}
+	if err == nil {
+		r.stamps = stamps
+		val, err = r.parse()
+	}
+	if err != nil {
+		r.err = err
+		if r.val != nil {
+			if err.Error() != r.warned {
+				log.Warnf(context.Background(), "reloading %s, keeping the old one: %s",
+					strings.Join(r.paths, ", "), err)
+				r.warned = err.Error()
+			}
+			return r.val, nil
+		}
+		return nil, err
+	}
+	if r.val != nil {
+		log.Printf(context.Background(), "reloaded %s", strings.Join(r.paths, ", "))
+	}
+	r.val, r.err, r.warned = val, nil, ""
+	return val, nil
+}
+
+func (r *Reloader) stat() ([]stamp, error) {
+	stamps := make([]stamp, len(r.paths))
+	for i, p := range r.paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = stamp{st.ModTime(), st.Size()}
+	}
+	return stamps, nil
+}
+
+func sameStamps(a, b []stamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package filereload
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloaderKeepsLastGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-filereload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "value")
+	mtime := time.Unix(1000000, 0)
+	write := func(data string) {
+		mtime = mtime.Add(time.Second)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parses := 0
+	r := New(func() (interface{}, error) {
+		parses++
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if string(data) == "bad" {
+			return nil, errors.New("bad value")
+		}
+		return string(data), nil
+	}, path)
+
+	get := func(want string, wantParses int) {
+		t.Helper()
+		v, err := r.Get()
+		if err != nil || v != want {
+			t.Errorf("Get() = %v, %v, want %q", v, err, want)
+		}
+		if parses != wantParses {
+			t.Errorf("parsed %d times, want %d", parses, wantParses)
+		}
+	}
+
+	write("one")
+	get("one", 1)
+	get("one", 1)
+
+	// A broken file is parsed once, then ignored until it changes.
+	write("bad")
+	get("one", 2)
+	get("one", 2)
+
+	write("two")
+	get("two", 3)
+}
+
+func TestReloaderFirstFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-filereload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "value")
+	if err := ioutil.WriteFile(path, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parses := 0
+	r := New(func() (interface{}, error) {
+		parses++
+		return nil, errors.New("bad value")
+	}, path)
+	for i := 0; i < 2; i++ {
+		if v, err := r.Get(); err == nil {
+			t.Errorf("Get() = %v, want an error", v)
+		}
+	}
+	if parses != 1 {
+		t.Errorf("parsed an unchanged file %d times, want once", parses)
+	}
+}
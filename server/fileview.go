@@ -8,7 +8,10 @@ import (
 	"sort"
 	"strings"
 
+	"golang.org/x/net/context"
+
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/trace"
 )
 
 // Mapping from known file extensions to filetype hinting.
@@ -52,6 +55,7 @@ type directoryListEntry struct {
 	Name          string
 	Path          string
 	IsDir         bool
+	IsSymlink     bool
 	SymlinkTarget string
 }
 
@@ -59,6 +63,7 @@ type fileViewerContext struct {
 	PathSegments     []breadCrumbEntry
 	Repo             config.RepoConfig
 	Commit           string
+	CommitHash       string
 	DirContent       *directoryContent
 	FileContent      *sourceFileContent
 	IsBlameAvailable bool
@@ -94,18 +99,28 @@ func (s DirListingSort) Less(i, j int) bool {
 	return s[i].Name < s[j].Name
 }
 
-func gitObjectType(obj string, repoPath string) (string, error) {
-	out, err := exec.Command("git", "-C", repoPath, "cat-file", "-t", obj).Output()
+// gitOutput runs a git command in repoPath, recording a span for it.
+// The command is killed once ctx is done.
+func gitOutput(ctx context.Context, repoPath string, args ...string) ([]byte, error) {
+	_, span := trace.Start(ctx, "git "+args[0])
+	defer span.Finish()
+	span.SetAttr("git.repo", repoPath)
+	span.SetAttr("git.args", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, "git", append([]string{"-C", repoPath}, args...)...).Output()
+	span.SetError(err)
+	return out, err
+}
+
+func gitObjectType(ctx context.Context, obj string, repoPath string) (string, error) {
+	out, err := gitOutput(ctx, repoPath, "cat-file", "-t", obj)
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(string(out)), nil
 }
 
-func gitCatBlob(obj string, repoPath string) (string, error) {
-	cmd := []string{"-C", repoPath, "cat-file", "blob", obj}
-	//fmt.Printf("%v\n", cmd)
-	out, err := exec.Command("git", cmd...).Output()
+func gitCatBlob(ctx context.Context, obj string, repoPath string) (string, error) {
+	out, err := gitOutput(ctx, repoPath, "cat-file", "blob", obj)
 	if err != nil {
 		return "", err
 	}
@@ -130,8 +145,8 @@ func gitParseTreeEntry(line string) gitTreeEntry {
 	}
 }
 
-func gitListDir(obj string, repoPath string) ([]gitTreeEntry, error) {
-	out, err := exec.Command("git", "-C", repoPath, "cat-file", "-p", obj).Output()
+func gitListDir(ctx context.Context, obj string, repoPath string) ([]gitTreeEntry, error) {
+	out, err := gitOutput(ctx, repoPath, "cat-file", "-p", obj)
 	if err != nil {
 		return nil, err
 	}
@@ -157,11 +172,11 @@ func getFileUrl(repo string, pathFromRoot string, name string, isDir bool) strin
 	return fileUrl
 }
 
-func buildDirectoryListEntry(treeEntry gitTreeEntry, pathFromRoot string, repo config.RepoConfig) directoryListEntry {
+func buildDirectoryListEntry(ctx context.Context, treeEntry gitTreeEntry, pathFromRoot string, repo config.RepoConfig) directoryListEntry {
 	var fileUrl string
 	var symlinkTarget string
 	if treeEntry.Mode == "120000" {
-		resolvedPath, err := gitCatBlob(treeEntry.ObjectId, repo.Path)
+		resolvedPath, err := gitCatBlob(ctx, treeEntry.ObjectId, repo.Path)
 		if err == nil {
 			symlinkTarget = resolvedPath
 		}
@@ -172,11 +187,12 @@ func buildDirectoryListEntry(treeEntry gitTreeEntry, pathFromRoot string, repo c
 		Name:          treeEntry.ObjectName,
 		Path:          fileUrl,
 		IsDir:         treeEntry.ObjectType == "tree",
+		IsSymlink:     treeEntry.Mode == "120000",
 		SymlinkTarget: symlinkTarget,
 	}
 }
 
-func buildFileData(relativePath string, repo config.RepoConfig, commit string) (*fileViewerContext, error) {
+func buildFileData(ctx context.Context, relativePath string, repo config.RepoConfig, commit string) (*fileViewerContext, error) {
 	blameHistory := getHistory(repo.Name)
 
 	commitHash := commit
@@ -189,7 +205,7 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 			h := blameHistory.Hashes
 			commitHash = h[len(h)-1]
 		} else {
-			out, err := gitShowCommit(commit, repo.Path)
+			out, err := gitShowCommit(ctx, commit, repo.Path)
 			if err == nil {
 				commitHash = out[:strings.Index(out, "\n")]
 			}
@@ -205,25 +221,25 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 	var fileContent *sourceFileContent
 	var dirContent *directoryContent
 
-	objectType, err := gitObjectType(obj, repo.Path)
+	objectType, err := gitObjectType(ctx, obj, repo.Path)
 	if err != nil {
 		return nil, err
 	}
 	if objectType == "tree" {
-		treeEntries, err := gitListDir(obj, repo.Path)
+		treeEntries, err := gitListDir(ctx, obj, repo.Path)
 		if err != nil {
 			return nil, err
 		}
 		dirEntries := make([]directoryListEntry, len(treeEntries))
 		for i, treeEntry := range treeEntries {
-			dirEntries[i] = buildDirectoryListEntry(treeEntry, cleanPath, repo)
+			dirEntries[i] = buildDirectoryListEntry(ctx, treeEntry, cleanPath, repo)
 		}
 		sort.Sort(DirListingSort(dirEntries))
 		dirContent = &directoryContent{
 			Entries: dirEntries,
 		}
 	} else if objectType == "blob" {
-		content, err := gitCatBlob(obj, repo.Path)
+		content, err := gitCatBlob(ctx, obj, repo.Path)
 		if err != nil {
 			return nil, err
 		}
@@ -264,6 +280,7 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 		PathSegments:     segments,
 		Repo:             repo,
 		Commit:           commit,
+		CommitHash:       commitHash,
 		DirContent:       dirContent,
 		FileContent:      fileContent,
 		IsBlameAvailable: blameHistory != nil,
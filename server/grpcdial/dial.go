@@ -0,0 +1,143 @@
+// Package grpcdial connects to codesearch backends over gRPC, either
+// unencrypted or using TLS, optionally with a client certificate.
+package grpcdial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/filereload"
+)
+
+// Dial connects to the backend at addr, using TLS as configured by
+// cfg. If cfg is nil or empty, the connection is unencrypted.
+func Dial(addr string, cfg *config.ClientTLS, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if !enabled(cfg) {
+		return grpc.Dial(addr, append(opts, grpc.WithInsecure())...)
+	}
+	tc, err := TLSConfig(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(addr, append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tc)))...)
+}
+
+// AddFlags registers flags for connecting to a backend with TLS on
+// fs, returning the configuration they fill in.
+func AddFlags(fs *flag.FlagSet) *config.ClientTLS {
+	cfg := &config.ClientTLS{}
+	fs.BoolVar(&cfg.Enabled, "tls", false, "Connect to the backend using TLS")
+	fs.StringVar(&cfg.CAFile, "tls-ca", "", "PEM `file` of CAs to verify the backend with (implies -tls)")
+	fs.StringVar(&cfg.CertFile, "tls-cert", "", "PEM client certificate `file` (implies -tls)")
+	fs.StringVar(&cfg.KeyFile, "tls-key", "", "PEM client key `file`")
+	fs.StringVar(&cfg.ServerName, "tls-server-name", "", "Verify the backend's certificate against this `name`")
+	return cfg
+}
+
+func enabled(cfg *config.ClientTLS) bool {
+	return cfg != nil && (cfg.Enabled || cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "")
+}
+
+// TLSConfig returns a TLS configuration for connecting to the backend
+// at addr. The certificates named in cfg are loaded immediately, so
+// that mistakes are reported at startup, and then re-read whenever
+// their files change.
+func TLSConfig(addr string, cfg *config.ClientTLS) (*tls.Config, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("tls: cert_file and key_file must be set together")
+	}
+	serverName := cfg.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		serverName = host
+	}
+	tc := &tls.Config{ServerName: serverName}
+
+	if cfg.CertFile != "" {
+		cert := filereload.New(func() (interface{}, error) {
+			c, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			return &c, err
+		}, cfg.CertFile, cfg.KeyFile)
+		if _, err := cert.Get(); err != nil {
+			return nil, err
+		}
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c, err := cert.Get()
+			if err != nil {
+				return nil, err
+			}
+			return c.(*tls.Certificate), nil
+		}
+	}
+
+	if cfg.CAFile != "" {
+		roots := filereload.New(func() (interface{}, error) {
+			return loadCAs(cfg.CAFile)
+		}, cfg.CAFile)
+		if _, err := roots.Get(); err != nil {
+			return nil, err
+		}
+		// tls.Config only verifies against a fixed set of roots, so
+		// to pick up a changed CA file we verify the backend
+		// ourselves.
+		tc.InsecureSkipVerify = true
+		tc.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			pool, err := roots.Get()
+			if err != nil {
+				return err
+			}
+			return verify(pool.(*x509.CertPool), raw, serverName)
+		}
+	}
+	return tc, nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// verify checks that the certificate chain a backend presented is
+// signed by one of roots and valid for serverName.
+func verify(roots *x509.CertPool, raw [][]byte, serverName string) error {
+	if len(raw) == 0 {
+		return errors.New("tls: backend presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, b := range raw {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+		certs[i] = c
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,218 @@
+package grpcdial
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// issue makes a certificate for name, signed by parent, or
+// self-signed if parent is nil.
+func issue(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// write writes c's certificate, and its key if keyPath is set, as PEM.
+func (c *testCert) write(t *testing.T, certPath, keyPath string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	writeFile(t, certPath, certPEM)
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is noticed even on filesystems with
+	// coarse timestamps.
+	future := time.Now().Add(time.Duration(serial) * time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve accepts TLS connections with the server config returned by
+// cfg, recording the client certificate each one presents.
+func serve(t *testing.T, cfg func() *tls.Config) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tc := tls.Server(conn, cfg())
+			if err := tc.Handshake(); err == nil {
+				clients <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			tc.Close()
+		}
+	}()
+	return ln, clients
+}
+
+func TestTLSConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-grpcdial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, "ca", nil)
+	backend := issue(t, "backend.example", ca)
+	client := issue(t, "frontend", ca)
+
+	cfg := &config.ClientTLS{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "backend.example",
+	}
+	ca.write(t, cfg.CAFile, "")
+	client.write(t, cfg.CertFile, cfg.KeyFile)
+
+	// The server's certificates, guarded by mu since they are
+	// replaced while it runs.
+	var mu sync.Mutex
+	serverCA, serverCert := ca, backend
+	ln, clients := serve(t, func() *tls.Config {
+		mu.Lock()
+		defer mu.Unlock()
+		pool := x509.NewCertPool()
+		pool.AddCert(serverCA.cert)
+		return &tls.Config{
+			Certificates: []tls.Certificate{serverCert.tls()},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+	})
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	tc, err := TLSConfig(addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func() error {
+		conn, err := tls.Dial("tcp", addr, tc)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return conn.Handshake()
+	}
+
+	if err := handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := <-clients; got != "frontend" {
+		t.Errorf("client presented %q", got)
+	}
+
+	// Rotate to a new CA, and new certificates for both ends.
+	ca2 := issue(t, "ca2", nil)
+	mu.Lock()
+	serverCA, serverCert = ca2, issue(t, "backend.example", ca2)
+	mu.Unlock()
+	issue(t, "frontend2", ca2).write(t, cfg.CertFile, cfg.KeyFile)
+	ca2.write(t, cfg.CAFile, "")
+
+	if err := handshake(); err != nil {
+		t.Fatalf("handshake after rotation: %v", err)
+	}
+	if got := <-clients; got != "frontend2" {
+		t.Errorf("client presented %q after rotation", got)
+	}
+
+	// A backend with a certificate for another name is rejected.
+	other := issue(t, "other.example", ca2)
+	mu.Lock()
+	serverCert = other
+	mu.Unlock()
+	if err := handshake(); err == nil {
+		t.Errorf("accepted a certificate for the wrong name")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	if _, err := TLSConfig("localhost:9999", &config.ClientTLS{CertFile: "client.pem"}); err == nil {
+		t.Error("accepted a certificate without a key")
+	}
+	if _, err := TLSConfig("localhost:9999", &config.ClientTLS{CAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("accepted a missing CA file")
+	}
+}
+
+func TestDialInsecure(t *testing.T) {
+	for _, cfg := range []*config.ClientTLS{nil, {}} {
+		conn, err := Dial("localhost:9999", cfg)
+		if err != nil {
+			t.Fatalf("Dial(%+v): %v", cfg, err)
+		}
+		conn.Close()
+	}
+}
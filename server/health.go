@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The states a backend can be in, as reported by /debug/backends.
+const (
+	// The backend hasn't answered a poll yet.
+	backendStarting = "starting"
+	// The backend answered its last poll.
+	backendUp = "up"
+	// The last poll failed, but the backend answered one recently.
+	backendFailing = "failing"
+	// The backend hasn't answered a poll for too long.
+	backendDown = "down"
+)
+
+type backendHealth struct {
+	Id    string `json:"id"`
+	Addr  string `json:"addr"`
+	State string `json:"state"`
+	// Seconds since the backend's index was built, or null if it
+	// hasn't reported one.
+	IndexAge *int64 `json:"index_age"`
+	Trees    int    `json:"trees"`
+	// Unix times of the last poll and the last successful one.
+	LastPoll            int64  `json:"last_poll,omitempty"`
+	LastSuccess         int64  `json:"last_success,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+	// Set if the backend has more than one replica.
+	Replicas []*replicaHealth `json:"replicas,omitempty"`
+
+	indexTime time.Time
+	// How long since the backend last answered a poll, or since
+	// the server started if it never has.
+	pollAge time.Duration
+}
+
+type replicaHealth struct {
+	Addr string `json:"addr"`
+	// Whether searches are being sent to the replica.
+	Healthy             bool   `json:"healthy"`
+	InFlight            int64  `json:"in_flight"`
+	LastSuccess         int64  `json:"last_success,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+type replyBackendsHealth struct {
+	Backends []*backendHealth `json:"backends"`
+}
+
+func (s *server) maxPollAge() time.Duration {
+	if s.cfg().Health.MaxPollAgeSeconds > 0 {
+		return time.Duration(s.cfg().Health.MaxPollAgeSeconds) * time.Second
+	}
+	return 3 * pollInterval
+}
+
+func replicasHealth(bk *Backend) []*replicaHealth {
+	rs, ok := bk.Codesearch.(*replicaSet)
+	if !ok {
+		return nil
+	}
+	out := make([]*replicaHealth, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		h := &replicaHealth{
+			Addr:     r.Addr,
+			Healthy:  r.healthy(rs.unhealthyAfter),
+			InFlight: atomic.LoadInt64(&r.inFlight),
+		}
+		r.mu.Lock()
+		if !r.lastSuccess.IsZero() {
+			h.LastSuccess = r.lastSuccess.Unix()
+		}
+		h.ConsecutiveFailures = r.consecutiveFailures
+		h.LastError = r.lastError
+		r.mu.Unlock()
+		out = append(out, h)
+	}
+	return out
+}
+
+func (s *server) backendHealth(bk *Backend, now time.Time) *backendHealth {
+	replicas := replicasHealth(bk)
+	bk.I.Lock()
+	defer bk.I.Unlock()
+
+	h := &backendHealth{
+		Id:                  bk.Id,
+		Addr:                bk.Addr,
+		Trees:               len(bk.I.Trees),
+		ConsecutiveFailures: bk.I.ConsecutiveFailures,
+		LastError:           bk.I.LastError,
+		Replicas:            replicas,
+		indexTime:           bk.I.IndexTime,
+	}
+	if !bk.I.IndexTime.IsZero() && bk.I.IndexTime.Unix() != 0 {
+		age := int64(now.Sub(bk.I.IndexTime) / time.Second)
+		h.IndexAge = &age
+	}
+	if !bk.I.LastPoll.IsZero() {
+		h.LastPoll = bk.I.LastPoll.Unix()
+	}
+
+	if bk.I.LastSuccess.IsZero() {
+		h.pollAge = now.Sub(s.started)
+		h.State = backendStarting
+		if h.pollAge > s.maxPollAge() {
+			h.State = backendDown
+		}
+		return h
+	}
+	h.LastSuccess = bk.I.LastSuccess.Unix()
+	h.pollAge = now.Sub(bk.I.LastSuccess)
+	switch {
+	case h.pollAge > s.maxPollAge():
+		h.State = backendDown
+	case bk.I.ConsecutiveFailures > 0:
+		h.State = backendFailing
+	default:
+		h.State = backendUp
+	}
+	return h
+}
+
+func (s *server) backendsHealth() []*backendHealth {
+	now := time.Now()
+	backends := s.backendList()
+	out := make([]*backendHealth, 0, len(backends))
+	for _, bk := range backends {
+		out = append(out, s.backendHealth(bk, now))
+	}
+	return out
+}
+
+// unready returns why a backend shouldn't be served from, or "" if
+// it's fine.
+func (s *server) unready(h *backendHealth) string {
+	if h.State == backendStarting || h.State == backendDown {
+		return h.State
+	}
+	if h.indexTime.IsZero() {
+		return "no index"
+	}
+	if max := s.cfg().Health.MaxIndexAgeSeconds; max > 0 && h.IndexAge != nil && *h.IndexAge > int64(max) {
+		return fmt.Sprintf("index is %ds old", *h.IndexAge)
+	}
+	return ""
+}
+
+// ServeReadiness reports whether every backend is answering polls
+// and serving a fresh enough index.
+func (s *server) ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	msg := ""
+	for _, h := range s.backendsHealth() {
+		if why := s.unready(h); why != "" {
+			msg += fmt.Sprintf("unhealthy backend '%s' '%s': %s\n", h.Id, h.Addr, why)
+		}
+	}
+	if msg != "" {
+		http.Error(w, msg, 500)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// ServeLiveness reports whether the server is working. Unless
+// configured to fail once every backend has been unreachable for a
+// while, it always succeeds.
+func (s *server) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	max := time.Duration(s.cfg().Health.LiveMaxPollAgeSeconds) * time.Second
+	if health := s.backendsHealth(); max > 0 && len(health) > 0 {
+		dead := true
+		for _, h := range health {
+			if h.pollAge <= max {
+				dead = false
+				break
+			}
+		}
+		if dead {
+			http.Error(w, fmt.Sprintf("no backend has answered for %s\n", max), 500)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
+
+func (s *server) ServeDebugBackends(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	replyJSON(ctx, w, 200, &replyBackendsHealth{Backends: s.backendsHealth()})
+}
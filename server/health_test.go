@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// flakyCodeSearch is a backend whose Info calls fail while down is
+// set.
+type flakyCodeSearch struct {
+	fakeCodeSearch
+	down bool
+}
+
+func (f *flakyCodeSearch) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	return &pb.ServerInfo{
+		IndexTime: time.Now().Add(-time.Hour).Unix(),
+		Trees:     []*pb.ServerInfo_Tree{{Name: "repo"}},
+	}, nil
+}
+
+func TestBackendHealth(t *testing.T) {
+	cs := &flakyCodeSearch{}
+	bk := &Backend{Id: "a", Addr: "localhost:9999", I: &I{}, Codesearch: cs}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"a": bk},
+		bkOrder: []string{"a"},
+		started: time.Now(),
+	}
+	ready := func() (int, string) {
+		w := httptest.NewRecorder()
+		s.ServeReadiness(w, httptest.NewRequest("GET", "/debug/healthcheck/ready", nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := ready(); code != 500 || !strings.Contains(body, "starting") {
+		t.Errorf("before polling: %d %q", code, body)
+	}
+
+	bk.pollOnce()
+	if code, body := ready(); code != 200 {
+		t.Errorf("after a successful poll: %d %q", code, body)
+	}
+
+	cs.down = true
+	bk.pollOnce()
+	bk.pollOnce()
+	h := s.backendHealth(bk, time.Now())
+	if h.State != backendFailing || h.ConsecutiveFailures != 2 || h.LastError != "connection refused" {
+		t.Errorf("after failed polls: %+v", h)
+	}
+	if code, _ := ready(); code != 200 {
+		t.Errorf("a briefly failing backend should still be ready")
+	}
+
+	// Long after the last success, the backend is down.
+	h = s.backendHealth(bk, time.Now().Add(time.Hour))
+	if h.State != backendDown {
+		t.Errorf("state = %s, want down", h.State)
+	}
+	s.config.Health.LiveMaxPollAgeSeconds = 1
+	bk.I.LastSuccess = bk.I.LastSuccess.Add(-time.Hour)
+	if code, _ := ready(); code != 500 {
+		t.Errorf("a down backend should fail readiness")
+	}
+	w := httptest.NewRecorder()
+	s.ServeLiveness(w, httptest.NewRequest("GET", "/debug/healthcheck/live", nil))
+	if w.Code != 500 {
+		t.Errorf("liveness: got %d with every backend down", w.Code)
+	}
+
+	cs.down = false
+	bk.pollOnce()
+	s.config.Health.MaxIndexAgeSeconds = 60
+	if code, body := ready(); code != 500 || !strings.Contains(body, "old") {
+		t.Errorf("stale index: %d %q", code, body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeDebugBackends(context.Background(), w, httptest.NewRequest("GET", "/debug/backends", nil))
+	var reply struct {
+		Backends []map[string]interface{} `json:"backends"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Backends) != 1 {
+		t.Fatalf("got %d backends", len(reply.Backends))
+	}
+	got := reply.Backends[0]
+	if got["addr"] != "localhost:9999" || got["state"] != backendUp || got["trees"] != float64(1) {
+		t.Errorf("unexpected backend %v", got)
+	}
+	if age, ok := got["index_age"].(float64); !ok || age < 3600 {
+		t.Errorf("index_age = %v", got["index_age"])
+	}
+}
@@ -0,0 +1,284 @@
+package httpserve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "livegrep-httpserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "livegrep.sock")
+
+	// Leave a socket behind, as a process that crashed would.
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix:" + file); err == nil {
+		t.Errorf("replaced a file that isn't a socket")
+	}
+}
+
+func TestListenSystemdNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	if _, err := Listen("systemd"); err == nil {
+		t.Errorf("used a socket meant for another process")
+	}
+}
+
+// writeCert writes a self-signed certificate for name and its key.
+func writeCert(t *testing.T, name, certPath, keyPath string, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(mtime.Unix()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		certPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPath:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the change is noticed even on filesystems
+		// with coarse timestamps.
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "old.example.com", certPath, keyPath, time.Now())
+
+	s, err := New(&config.HTTP{CertFile: certPath, KeyFile: keyPath}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l, stop) }()
+
+	served := func() string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if got := served(); got != "old.example.com" {
+		t.Errorf("served %s, want old.example.com", got)
+	}
+	writeCert(t, "new.example.com", certPath, keyPath, time.Now().Add(time.Minute))
+	if got := served(); got != "new.example.com" {
+		t.Errorf("after replacing the certificate, served %s", got)
+	}
+
+	stop <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s, err := New(&config.HTTP{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l, stop) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resc <- result{string(body), err}
+	}()
+	<-started
+
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		t.Fatalf("stopped with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("still accepting connections while shutting down")
+	}
+
+	close(release)
+	if res := <-resc; res.err != nil || res.body != "done" {
+		t.Errorf("request in flight got %q, %v", res.body, res.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestTLSHTTP2(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "example.com", certPath, keyPath, time.Now())
+
+	s, err := New(&config.HTTP{CertFile: certPath, KeyFile: keyPath}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l, stop) }()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+		t.Errorf("negotiated %q, want h2", got)
+	}
+	conn.Close()
+
+	stop <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	const delay = 1500 * time.Millisecond
+	s, err := New(&config.HTTP{WriteTimeoutSeconds: 1}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			NoWriteTimeout(r)
+		}
+		time.Sleep(delay)
+		w.Write([]byte("done"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l, stop) }()
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if body, err := get("/slow"); err == nil {
+		t.Errorf("a response slower than the write timeout got through: %q", body)
+	}
+	if body, err := get("/stream"); err != nil || body != "done" {
+		t.Errorf("a response exempt from the write timeout got %q, %v", body, err)
+	}
+
+	stop <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
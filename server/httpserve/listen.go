@@ -0,0 +1,62 @@
+// Package httpserve runs the frontend's HTTP server: listening on TCP,
+// unix or systemd-activated sockets, serving HTTPS with certificates
+// that are reloaded when they change, and draining requests on
+// shutdown.
+package httpserve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listen listens on addr, which is HOST:PORT, "unix:PATH" for a unix
+// socket, or "systemd" for the socket passed by systemd socket
+// activation.
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return listenSystemd()
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// Remove a socket left behind by an earlier run, but nothing
+	// else that happens to be at path.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// The first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+func listenSystemd() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("listen: not started by systemd socket activation")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n != 1 {
+		return nil, fmt.Errorf("listen: expected one socket from systemd, got LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+	}
+	// Don't pass the socket on to child processes, such as git.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	syscall.CloseOnExec(listenFdsStart)
+
+	f := os.NewFile(listenFdsStart, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
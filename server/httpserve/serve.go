@@ -0,0 +1,116 @@
+package httpserve
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/filereload"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+func seconds(n, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// TLSConfig returns a server TLS configuration using the PEM
+// certificate and key in the given files. They are loaded
+// immediately, so that mistakes are reported at startup, and then
+// re-read whenever the files change.
+func TLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert := filereload.New(func() (interface{}, error) {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		return &c, err
+	}, certFile, keyFile)
+	if _, err := cert.Get(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		// tls.NewListener doesn't offer HTTP/2 by itself.
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, err := cert.Get()
+			if err != nil {
+				return nil, err
+			}
+			return c.(*tls.Certificate), nil
+		},
+	}, nil
+}
+
+type connKey struct{}
+
+// NoWriteTimeout lifts the write timeout for the response to r, for
+// handlers that stream for longer than it. It only works over
+// HTTP/1.x: HTTP/2 applies the timeout to each stream itself.
+func NoWriteTimeout(r *http.Request) {
+	if r.ProtoMajor != 1 {
+		return
+	}
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// A Server serves HTTP, or HTTPS if configured to.
+type Server struct {
+	srv             *http.Server
+	shutdownTimeout time.Duration
+}
+
+// New returns a server for h configured by cfg.
+func New(cfg *config.HTTP, h http.Handler) (*Server, error) {
+	s := &Server{
+		srv: &http.Server{
+			Handler:      h,
+			ReadTimeout:  seconds(cfg.ReadTimeoutSeconds, 10),
+			WriteTimeout: seconds(cfg.WriteTimeoutSeconds, 90),
+			IdleTimeout:  seconds(cfg.IdleTimeoutSeconds, 120),
+			// Kept so that NoWriteTimeout can find the
+			// connection.
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, connKey{}, c)
+			},
+		},
+		shutdownTimeout: seconds(cfg.ShutdownTimeoutSeconds, 30),
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		tc, err := TLSConfig(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.srv.TLSConfig = tc
+	}
+	return s, nil
+}
+
+// Serve serves requests on l until a signal arrives on stop. It then
+// stops accepting connections and waits for the requests in flight
+// to finish, for up to the configured shutdown timeout.
+func (s *Server) Serve(l net.Listener, stop <-chan os.Signal) error {
+	if s.srv.TLSConfig != nil {
+		l = tls.NewListener(l, s.srv.TLSConfig)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf(context.Background(), "%s: finishing requests in flight", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		return s.srv.Shutdown(ctx)
+	}
+}
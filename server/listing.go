@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func (s *server) ServeAPIBackends(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	backends := s.backendList()
+	reply := &api.ReplyBackends{
+		Backends: make([]*api.Backend, 0, len(backends)),
+	}
+	for _, bk := range backends {
+		bk.I.Lock()
+		out := &api.Backend{
+			Id:    bk.Id,
+			Name:  bk.I.Name,
+			Trees: make([]*api.Tree, 0, len(bk.I.Trees)),
+		}
+		if !bk.I.IndexTime.IsZero() {
+			out.IndexTime = bk.I.IndexTime.Unix()
+		}
+		for _, t := range bk.I.Trees {
+			if !s.repoAllowed(ctx, t.Name) {
+				continue
+			}
+			out.Trees = append(out.Trees, &api.Tree{
+				Name:       t.Name,
+				Version:    t.Version,
+				URLPattern: t.Url,
+				Metadata:   t.Metadata,
+			})
+		}
+		bk.I.Unlock()
+		reply.Backends = append(reply.Backends, out)
+	}
+	replyJSON(ctx, w, 200, reply)
+}
+
+func (s *server) ServeAPIRepos(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repos := s.visibleRepos(ctx)
+	reply := &api.ReplyRepos{
+		Repos: make([]*api.Repo, 0, len(repos)),
+	}
+	for _, repo := range repos {
+		revisions := repo.Revisions
+		if revisions == nil {
+			revisions = []string{}
+		}
+		reply.Repos = append(reply.Repos, &api.Repo{
+			Name:      repo.Name,
+			Revisions: revisions,
+			Blame:     getHistory(repo.Name) != nil,
+		})
+	}
+	sort.Slice(reply.Repos, func(i, j int) bool {
+		return reply.Repos[i].Name < reply.Repos[j].Name
+	})
+	replyJSON(ctx, w, 200, reply)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// serveJSON calls a handler as user, or anonymously if user is empty,
+// and returns its JSON reply decoded generically so that its exact
+// shape can be compared.
+func serveJSON(t *testing.T, user string, f func(context.Context, http.ResponseWriter, *http.Request), url string) (int, interface{}) {
+	ctx := context.Background()
+	if user != "" {
+		ctx = auth.NewContext(ctx, auth.Identity{User: user})
+	}
+	w := httptest.NewRecorder()
+	f(ctx, w, httptest.NewRequest("GET", url, nil))
+	var reply interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%s: bad reply %q: %v", url, w.Body.String(), err)
+	}
+	return w.Code, reply
+}
+
+func mustJSON(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("bad JSON %q: %v", s, err)
+	}
+	return v
+}
+
+func TestServeAPIBackends(t *testing.T) {
+	s := &server{
+		config: &config.Config{},
+		acl:    testACL(t),
+		bk: map[string]*Backend{
+			"a": {Id: "a", I: &I{
+				Name:      "main",
+				IndexTime: time.Unix(1000, 0),
+				Trees: []Tree{
+					{Name: "public/repo", Version: "v1", Url: "https://example.com/{path}#L{lno}",
+						Metadata: map[string]string{"github": "example/repo"}},
+					{Name: "secret/keys", Version: "v2"},
+				},
+			}},
+			"b": {Id: "b", I: &I{Name: "b"}},
+		},
+		bkOrder: []string{"a", "b"},
+	}
+
+	cases := []struct {
+		user string
+		want string
+	}{
+		{"", `{"backends": [
+			{"id": "a", "name": "main", "index_time": 1000, "trees": [
+				{"name": "public/repo", "version": "v1",
+				 "url_pattern": "https://example.com/{path}#L{lno}",
+				 "metadata": {"github": "example/repo"}}
+			]},
+			{"id": "b", "name": "b", "index_time": 0, "trees": []}
+		]}`},
+		{"alice", `{"backends": [
+			{"id": "a", "name": "main", "index_time": 1000, "trees": [
+				{"name": "public/repo", "version": "v1",
+				 "url_pattern": "https://example.com/{path}#L{lno}",
+				 "metadata": {"github": "example/repo"}},
+				{"name": "secret/keys", "version": "v2"}
+			]},
+			{"id": "b", "name": "b", "index_time": 0, "trees": []}
+		]}`},
+	}
+	for _, tc := range cases {
+		code, got := serveJSON(t, tc.user, s.ServeAPIBackends, "/api/v1/backends")
+		if want := mustJSON(t, tc.want); code != 200 || !reflect.DeepEqual(got, want) {
+			t.Errorf("user %q: got %d %v, want %v", tc.user, code, got, want)
+		}
+	}
+}
+
+func TestServeAPIRepos(t *testing.T) {
+	s := &server{
+		config: &config.Config{},
+		acl:    testACL(t),
+		repos: map[string]config.RepoConfig{
+			"public/repo":   {Name: "public/repo", Revisions: []string{"HEAD", "v1"}},
+			"secret/keys":   {Name: "secret/keys"},
+			"secret/shared": {Name: "secret/shared", Revisions: []string{"HEAD"}},
+		},
+	}
+
+	cases := []struct {
+		user string
+		want string
+	}{
+		{"", `{"repos": [
+			{"name": "public/repo", "revisions": ["HEAD", "v1"], "blame": false}
+		]}`},
+		{"bob", `{"repos": [
+			{"name": "public/repo", "revisions": ["HEAD", "v1"], "blame": false},
+			{"name": "secret/shared", "revisions": ["HEAD"], "blame": false}
+		]}`},
+		{"alice", `{"repos": [
+			{"name": "public/repo", "revisions": ["HEAD", "v1"], "blame": false},
+			{"name": "secret/keys", "revisions": [], "blame": false},
+			{"name": "secret/shared", "revisions": ["HEAD"], "blame": false}
+		]}`},
+	}
+	for _, tc := range cases {
+		code, got := serveJSON(t, tc.user, s.ServeAPIRepos, "/api/v1/repos")
+		if want := mustJSON(t, tc.want); code != 200 || !reflect.DeepEqual(got, want) {
+			t.Errorf("user %q: got %d %v, want %v", tc.user, code, got, want)
+		}
+	}
+}
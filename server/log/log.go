@@ -1,21 +1,229 @@
+// Package log writes leveled log lines, as either text or JSON, that
+// carry the request ID, user, and any other fields attached to the
+// context they are logged with.
+//
+// The level and format default to the LIVEGREP_LOG_LEVEL and
+// LIVEGREP_LOG_FORMAT environment variables, if they are set.
 package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/livegrep/livegrep/server/auth"
 	"github.com/livegrep/livegrep/server/reqid"
 	"golang.org/x/net/context"
 )
 
-func Printf(c context.Context, msg string, args ...interface{}) {
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Fields are key-value pairs attached to a log line.
+type Fields map[string]interface{}
+
+var (
+	mu     sync.Mutex
+	out    io.Writer = os.Stdout
+	level  Level     = Info
+	asJSON bool
+)
+
+func init() {
+	if err := Configure(os.Getenv("LIVEGREP_LOG_LEVEL"), os.Getenv("LIVEGREP_LOG_FORMAT")); err != nil {
+		fmt.Fprintf(os.Stderr, "log: %s\n", err)
+	}
+}
+
+// Configure sets the minimum level to log, and the format, "text" or
+// "json". Empty strings leave the current setting unchanged.
+func Configure(levelName, format string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if levelName != "" {
+		l, err := ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+		level = l
+	}
+	switch format {
+	case "":
+	case "text":
+		asJSON = false
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// SetOutput sets where log lines are written. The default is stdout.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+// Enabled reports whether lines at level l are being logged.
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l >= level
+}
+
+type fieldsKey struct{}
+
+// NewContext returns a context carrying fields, in addition to any
+// the parent carries, to be included in everything logged with it.
+func NewContext(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	if parent, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+		for k, v := range parent {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// Log writes msg at level l, with the fields from ctx and fields.
+func Log(ctx context.Context, l Level, msg string, fields Fields) {
+	if !Enabled(l) {
+		return
+	}
+	all := Fields{}
+	if ctxFields, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+		for k, v := range ctxFields {
+			all[k] = v
+		}
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+	var id reqid.RequestID
+	if reqID, ok := reqid.FromContext(ctx); ok {
+		id = reqID
+	}
+	var user string
+	if u, ok := auth.FromContext(ctx); ok {
+		user = u.User
+	}
+
+	now := time.Now().UTC()
 	var line bytes.Buffer
-	line.WriteString(time.Now().UTC().Format("[2006-01-02T15:04:05.999] "))
+	mu.Lock()
+	defer mu.Unlock()
+	if asJSON {
+		all["time"] = now.Format(time.RFC3339Nano)
+		all["level"] = l.String()
+		all["msg"] = msg
+		if id != "" {
+			all["request_id"] = string(id)
+		}
+		if user != "" {
+			all["user"] = user
+		}
+		if err := json.NewEncoder(&line).Encode(all); err != nil {
+			fmt.Fprintf(&line, `{"level":"error","msg":%q}`+"\n",
+				"log: encoding fields: "+err.Error())
+		}
+	} else {
+		line.WriteString(now.Format("[2006-01-02T15:04:05.999] "))
+		if l != Info {
+			fmt.Fprintf(&line, "%s: ", strings.ToUpper(l.String()))
+		}
+		if id != "" {
+			fmt.Fprintf(&line, "[%s] ", id)
+		}
+		if user != "" {
+			fmt.Fprintf(&line, "[user=%s] ", user)
+		}
+		line.WriteString(msg)
+		keys := make([]string, 0, len(all))
+		for k := range all {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&line, " %s=%s", k, textValue(all[k]))
+		}
+		line.WriteByte('\n')
+	}
+	out.Write(line.Bytes())
+}
 
-	if reqID, ok := reqid.FromContext(c); ok {
-		fmt.Fprintf(&line, "[%s] ", reqID)
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			return fmt.Sprintf("%q", v)
+		}
+		return v
+	case error:
+		return fmt.Sprintf("%q", v.Error())
+	case time.Duration:
+		return v.String()
 	}
-	fmt.Fprintf(&line, msg, args...)
-	fmt.Println(line.String())
+	return fmt.Sprint(v)
+}
+
+func Debugf(ctx context.Context, msg string, args ...interface{}) {
+	Log(ctx, Debug, fmt.Sprintf(msg, args...), nil)
+}
+
+func Infof(ctx context.Context, msg string, args ...interface{}) {
+	Log(ctx, Info, fmt.Sprintf(msg, args...), nil)
+}
+
+func Warnf(ctx context.Context, msg string, args ...interface{}) {
+	Log(ctx, Warn, fmt.Sprintf(msg, args...), nil)
+}
+
+func Errorf(ctx context.Context, msg string, args ...interface{}) {
+	Log(ctx, Error, fmt.Sprintf(msg, args...), nil)
+}
+
+// Printf logs at the info level.
+func Printf(ctx context.Context, msg string, args ...interface{}) {
+	Infof(ctx, msg, args...)
+}
+
+// Fatalf logs at the error level, and exits.
+func Fatalf(ctx context.Context, msg string, args ...interface{}) {
+	Errorf(ctx, msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,92 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+func capture(t *testing.T, levelName, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	if err := Configure(levelName, format); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func reset() {
+	SetOutput(os.Stdout)
+	Configure("info", "text")
+}
+
+func testContext() context.Context {
+	ctx := reqid.NewContext(context.Background(), "req-1")
+	ctx = auth.NewContext(ctx, auth.Identity{User: "alice"})
+	return NewContext(ctx, Fields{"handler": "ServeAPISearch"})
+}
+
+func TestText(t *testing.T) {
+	buf := capture(t, "info", "text")
+	defer reset()
+
+	ctx := testContext()
+	Debugf(ctx, "hidden")
+	Printf(ctx, "hello %d", 1)
+	Log(NewContext(ctx, Fields{"backend": "main"}), Warn, "slow", Fields{"duration_ms": 12})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if !strings.HasSuffix(lines[0], "] [req-1] [user=alice] hello 1 handler=ServeAPISearch") {
+		t.Errorf("bad info line: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "WARN: [req-1] [user=alice] slow backend=main duration_ms=12 handler=ServeAPISearch") {
+		t.Errorf("bad warn line: %q", lines[1])
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := capture(t, "debug", "json")
+	defer reset()
+
+	Log(testContext(), Error, "failed", Fields{"status": 500})
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON %q: %v", buf, err)
+	}
+	want := map[string]interface{}{
+		"level":      "error",
+		"msg":        "failed",
+		"request_id": "req-1",
+		"user":       "alice",
+		"handler":    "ServeAPISearch",
+		"status":     float64(500),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Errorf("no time in %v", got)
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	defer reset()
+	if err := Configure("loud", ""); err == nil {
+		t.Error("accepted an unknown level")
+	}
+	if err := Configure("", "xml"); err == nil {
+		t.Error("accepted an unknown format")
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("livegrep_http_requests_total",
+		"HTTP requests served, by handler and status code.",
+		"handler", "code")
+	httpDuration = metrics.NewHistogramVec("livegrep_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by handler.",
+		metrics.DefBuckets, "handler")
+	searchDuration = metrics.NewHistogramVec("livegrep_search_duration_seconds",
+		"Time spent in each phase of searches sent to a backend.",
+		metrics.DefBuckets, "backend", "phase")
+	searchExits = metrics.NewCounterVec("livegrep_search_exit_reason_total",
+		"Searches sent to a backend, by the reason the search stopped.",
+		"backend", "reason")
+	backendPolls = metrics.NewCounterVec("livegrep_backend_poll_total",
+		"Attempts to fetch index information from a backend, by result.",
+		"backend", "result")
+	searchRetries = metrics.NewCounterVec("livegrep_search_retries_total",
+		"Searches sent to a second replica of a backend, because the first failed or, if hedging, was slow.",
+		"backend", "kind")
+)
+
+func init() {
+	metrics.NewGaugeFunc("livegrep_blame_history_commits",
+		"Commits loaded into each repository's blame history.",
+		[]string{"repo"}, func(emit func(float64, ...string)) {
+			historiesLock.RLock()
+			defer historiesLock.RUnlock()
+			for name, h := range histories {
+				emit(float64(len(h.Hashes)), name)
+			}
+		})
+	metrics.NewGaugeFunc("livegrep_blame_history_files",
+		"Files tracked by each repository's blame history.",
+		[]string{"repo"}, func(emit func(float64, ...string)) {
+			historiesLock.RLock()
+			defer historiesLock.RUnlock()
+			for name, h := range histories {
+				emit(float64(len(h.Files)), name)
+			}
+		})
+}
+
+// registerBackendMetrics exports the age of each backend's index and
+// whether polling it is failing.
+func (s *server) registerBackendMetrics() {
+	metrics.NewGaugeFunc("livegrep_backend_index_age_seconds",
+		"Seconds since each backend's index was built.",
+		[]string{"backend"}, func(emit func(float64, ...string)) {
+			for _, bk := range s.backendList() {
+				bk.I.Lock()
+				indexTime := bk.I.IndexTime
+				bk.I.Unlock()
+				if indexTime.IsZero() || indexTime.Unix() == 0 {
+					continue
+				}
+				emit(time.Since(indexTime).Seconds(), bk.Id)
+			}
+		})
+	metrics.NewGaugeFunc("livegrep_backend_consecutive_poll_failures",
+		"How many times in a row polling each backend has failed.",
+		[]string{"backend"}, func(emit func(float64, ...string)) {
+			for _, bk := range s.backendList() {
+				bk.I.Lock()
+				failures := bk.I.ConsecutiveFailures
+				bk.I.Unlock()
+				emit(float64(failures), bk.Id)
+			}
+		})
+}
+
+// observeSearch records the timing statistics of a backend search.
+// The times in info are in milliseconds.
+func observeSearch(backend string, info *api.Stats) {
+	phases := []struct {
+		name string
+		ms   int64
+	}{
+		{"re2", info.RE2Time},
+		{"git", info.GitTime},
+		{"index", info.IndexTime},
+		{"sort", info.SortTime},
+		{"analyze", info.AnalyzeTime},
+		{"total", info.TotalTime},
+	}
+	for _, p := range phases {
+		searchDuration.Observe(float64(p.ms)/1000, backend, p.name)
+	}
+	searchExits.Inc(backend, info.ExitReason)
+}
+
+// handlerName returns a short name for a handler function, for use as
+// a metric label.
+func handlerName(f interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	name := strings.TrimSuffix(fn.Name(), "-fm")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,273 @@
+// Package metrics implements the handful of Prometheus metric types
+// livegrep exports, and serves them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds a set of metrics to export. Metrics are written in
+// the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	order   []string
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Default is the registry served by Handler.
+var Default = NewRegistry()
+
+// register adds m to r, replacing any metric of the same name.
+func (r *Registry) register(name, help, typ string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; !ok {
+		r.order = append(r.order, name)
+	}
+	r.metrics[name] = &described{help, typ, m}
+}
+
+type described struct {
+	help, typ string
+	metric
+}
+
+func (d *described) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, d.typ)
+	d.metric.write(w, name)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	for _, name := range r.order {
+		r.metrics[name].write(bw, name)
+	}
+	r.mu.Unlock()
+	bw.Flush()
+}
+
+// Handler serves the metrics in Default.
+func Handler() http.Handler {
+	return Default
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatLabels renders a label set, with an optional extra label
+// (such as a histogram's "le") appended.
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, n, escapeValue(values[i]))
+	}
+	if len(extra) == 2 {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[0], escapeValue(extra[1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// series holds one value per combination of label values.
+type series struct {
+	labels []string
+	mu     sync.Mutex
+	values map[string][]string // key -> label values
+}
+
+func newSeries(labels []string) series {
+	return series{labels: labels, values: make(map[string][]string)}
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values, want %d", len(values), len(s.labels)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := s.values[k]; !ok {
+		s.values[k] = append([]string(nil), values...)
+	}
+	return k
+}
+
+// sortedKeys must be called with s.mu held.
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	series
+	counts map[string]float64
+}
+
+// NewCounterVec registers a new counter with Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{series: newSeries(labels), counts: make(map[string]float64)}
+	Default.register(name, help, "counter", c)
+	return c
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.counts[c.key(labelValues)] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", name,
+			formatLabels(c.labels, c.values[k]), formatFloat(c.counts[k]))
+	}
+}
+
+// A HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	series
+	buckets []float64
+	hists   map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a new histogram with Default. buckets are
+// the upper bounds of the buckets, in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		series:  newSeries(labels),
+		buckets: buckets,
+		hists:   make(map[string]*histogram),
+	}
+	Default.register(name, help, "histogram", h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(labelValues)
+	hist := h.hists[k]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.hists[k] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range h.sortedKeys() {
+		values := h.values[k]
+		hist := h.hists[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+				formatLabels(h.labels, values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+			formatLabels(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name,
+			formatLabels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name,
+			formatLabels(h.labels, values), hist.count)
+	}
+}
+
+// gaugeFunc is a gauge whose values are computed when scraped.
+type gaugeFunc struct {
+	labels  []string
+	collect func(emit func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge with Default whose values are
+// reported by collect, which calls emit once per label set, whenever
+// the metrics are scraped. Registering a gauge with the same name as
+// an existing metric replaces it.
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	Default.register(name, help, "gauge", &gaugeFunc{labels, collect})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer, name string) {
+	type sample struct {
+		labels string
+		v      float64
+	}
+	var samples []sample
+	g.collect(func(v float64, labelValues ...string) {
+		if len(labelValues) != len(g.labels) {
+			panic(fmt.Sprintf("metrics: got %d label values, want %d", len(labelValues), len(g.labels)))
+		}
+		samples = append(samples, sample{formatLabels(g.labels, labelValues), v})
+	})
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, s.labels, formatFloat(s.v))
+	}
+}
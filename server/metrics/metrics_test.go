@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Default.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests.", "handler", "code")
+	c.Inc("search", "200")
+	c.Inc("search", "200")
+	c.Add(3, "file", `5"00`)
+
+	h := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "handler")
+	h.Observe(0.05, "search")
+	h.Observe(0.5, "search")
+	h.Observe(2, "search")
+
+	NewGaugeFunc("test_age_seconds", "Ages.", []string{"backend"},
+		func(emit func(float64, ...string)) {
+			emit(20, "b")
+			emit(10, "a")
+		})
+
+	want := []string{
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{handler="file",code="5\"00"} 3`,
+		`test_requests_total{handler="search",code="200"} 2`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{handler="search",le="0.1"} 1`,
+		`test_duration_seconds_bucket{handler="search",le="1"} 2`,
+		`test_duration_seconds_bucket{handler="search",le="+Inf"} 3`,
+		`test_duration_seconds_sum{handler="search"} 2.55`,
+		`test_duration_seconds_count{handler="search"} 3`,
+		"# TYPE test_age_seconds gauge",
+		`test_age_seconds{backend="a"} 10`,
+		`test_age_seconds{backend="b"} 20`,
+	}
+	out := scrape(t)
+	pos := 0
+	for _, line := range want {
+		i := strings.Index(out[pos:], line+"\n")
+		if i < 0 {
+			t.Fatalf("missing or out of order: %q\n%s", line, out)
+		}
+		pos += i + len(line)
+	}
+}
+
+func TestReregister(t *testing.T) {
+	NewGaugeFunc("test_replaced", "Old.", nil, func(emit func(float64, ...string)) { emit(1) })
+	NewGaugeFunc("test_replaced", "New.", nil, func(emit func(float64, ...string)) { emit(2) })
+	out := scrape(t)
+	if strings.Count(out, "# TYPE test_replaced") != 1 {
+		t.Errorf("metric written more than once:\n%s", out)
+	}
+	if !strings.Contains(out, "test_replaced 2\n") || strings.Contains(out, "test_replaced 1\n") {
+		t.Errorf("re-registered gauge not replaced:\n%s", out)
+	}
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// StatusWriter wraps a ResponseWriter, recording the status code and
+// the number of bytes written. It passes flushes through, so that
+// streaming responses still work.
+type StatusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w}
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the status code written, defaulting to 200 if
+// nothing has been written.
+func (w *StatusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Bytes returns the number of bytes of body written.
+func (w *StatusWriter) Bytes() int64 {
+	return w.bytes
+}
+
+type accessKey struct{}
+
+// accessEntry collects fields that handlers further in add to a
+// request's access log line.
+type accessEntry struct {
+	mu     sync.Mutex
+	fields log.Fields
+}
+
+// AddAccessFields adds fields to the access log line for r, if r is
+// being logged by AccessLog.
+func AddAccessFields(r *http.Request, fields log.Fields) {
+	e, ok := r.Context().Value(accessKey{}).(*accessEntry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, v := range fields {
+		e.fields[k] = v
+	}
+}
+
+type accessLogHandler struct {
+	inner http.Handler
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	entry := &accessEntry{fields: log.Fields{}}
+	sw := NewStatusWriter(w)
+	h.inner.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessKey{}, entry)))
+
+	entry.mu.Lock()
+	fields := log.Fields{
+		"method":      r.Method,
+		"path":        r.URL.RequestURI(),
+		"remote":      r.RemoteAddr,
+		"status":      sw.Status(),
+		"bytes":       sw.Bytes(),
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		"user_agent":  r.UserAgent(),
+	}
+	for k, v := range entry.fields {
+		fields[k] = v
+	}
+	entry.mu.Unlock()
+	log.Log(context.Background(), log.Info, "access", fields)
+}
+
+// AccessLog wraps h to log one line for every request it serves,
+// recording the status and size of the response and how long it
+// took.
+func AccessLog(h http.Handler) http.Handler {
+	return &accessLogHandler{h}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.Configure("", "json")
+	defer func() {
+		log.SetOutput(os.Stdout)
+		log.Configure("", "text")
+	}()
+
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddAccessFields(r, log.Fields{"handler": "app"})
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("access log hides http.Flusher")
+		}
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})
+	authed, err := RequireAuth(app, &config.Auth{BearerTokens: map[string]string{"t0k": "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := AccessLog(authed)
+
+	r := httptest.NewRequest("GET", "/api/v1/search/?q=x", nil)
+	r.Header.Set("Authorization", "Bearer t0k")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("bad access log %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":     "access",
+		"method":  "GET",
+		"path":    "/api/v1/search/?q=x",
+		"status":  float64(http.StatusTeapot),
+		"bytes":   float64(5),
+		"user":    "alice",
+		"handler": "app",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+
+	// Requests rejected before reaching a handler are logged too.
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/repos", nil))
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("bad access log %q: %v", buf.String(), err)
+	}
+	if got["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("status = %v, want 401", got["status"])
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// An Authenticator identifies the user making a request.
+type Authenticator interface {
+	// Authenticate returns the identity of the user making r, or
+	// false if r doesn't identify anyone.
+	Authenticate(r *http.Request) (auth.Identity, bool)
+}
+
+type bearerTokens map[string]string
+
+func (t bearerTokens) Authenticate(r *http.Request) (auth.Identity, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return auth.Identity{}, false
+	}
+	token := []byte(strings.TrimSpace(header[len(prefix):]))
+	// Check every token, so the time taken doesn't reveal how much
+	// of one matched.
+	user := ""
+	for known, u := range t {
+		if subtle.ConstantTimeCompare(token, []byte(known)) == 1 {
+			user = u
+		}
+	}
+	if user == "" {
+		return auth.Identity{}, false
+	}
+	return auth.Identity{User: user, Provider: "token"}, true
+}
+
+// BearerTokens authenticates requests carrying one of the given
+// tokens in an "Authorization: Bearer" header. tokens maps each token
+// to the user it authenticates as.
+func BearerTokens(tokens map[string]string) Authenticator {
+	return bearerTokens(tokens)
+}
+
+type authHandler struct {
+	inner          http.Handler
+	authenticators []Authenticator
+	oidc           *oidcProvider
+	bearer         bool
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/debug/healthcheck" || strings.HasPrefix(r.URL.Path, "/debug/healthcheck/") {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	if h.oidc != nil && strings.HasPrefix(r.URL.Path, "/auth/") {
+		h.oidc.ServeHTTP(w, r)
+		return
+	}
+	for _, a := range h.authenticators {
+		if id, ok := a.Authenticate(r); ok {
+			AddAccessFields(r, log.Fields{"user": id.User})
+			h.inner.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
+			return
+		}
+	}
+	h.unauthenticated(w, r)
+}
+
+func (h *authHandler) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	isAPI := strings.HasPrefix(r.URL.Path, "/api/")
+	if h.oidc != nil && !isAPI && r.Method == "GET" {
+		login := "/auth/login?return=" + url.QueryEscape(r.URL.RequestURI())
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	if h.bearer {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="livegrep"`)
+	}
+	if !isAPI {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(&api.ReplyError{Err: api.InnerError{
+		Code:    "unauthenticated",
+		Message: "Authentication required",
+	}})
+}
+
+// RequireAuth wraps h so that it only serves requests from users
+// authenticated by one of the methods in cfg, adding their identity
+// to the request's context. If cfg configures OIDC, the returned
+// handler also serves the login flow under /auth/. h is returned
+// unchanged if cfg configures no methods.
+func RequireAuth(h http.Handler, cfg *config.Auth) (http.Handler, error) {
+	out := &authHandler{inner: h}
+	if len(cfg.BearerTokens) > 0 {
+		out.authenticators = append(out.authenticators, BearerTokens(cfg.BearerTokens))
+		out.bearer = true
+	}
+	if cfg.TrustedHeader != "" {
+		out.authenticators = append(out.authenticators, TrustedHeader(cfg.TrustedHeader))
+	}
+	if cfg.OIDC != nil {
+		p, err := newOIDCProvider(cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		out.oidc = p
+		out.authenticators = append(out.authenticators, p)
+	}
+	if len(out.authenticators) == 0 {
+		return h, nil
+	}
+	return out, nil
+}
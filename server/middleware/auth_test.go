@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// whoami replies with the name of the authenticated user.
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	id, ok := auth.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "no identity", 500)
+		return
+	}
+	w.Write([]byte(id.Provider + ":" + id.User))
+})
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRequireAuth(t *testing.T) {
+	h, err := RequireAuth(whoami, &config.Auth{
+		TrustedHeader: "X-Forwarded-User",
+		BearerTokens:  map[string]string{"s3cret": "ci-bot"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		status int
+		body   string
+	}{
+		{"token", "/api/v1/repos", "Authorization", "Bearer s3cret", 200, "token:ci-bot"},
+		{"bad token", "/api/v1/repos", "Authorization", "Bearer wrong", 401, `"unauthenticated"`},
+		{"header", "/search/", "X-Forwarded-User", "alice", 200, "header:alice"},
+		{"anonymous", "/search/", "", "", 401, "Authentication required"},
+		{"healthcheck", "/debug/healthcheck", "", "", 500, "no identity"},
+		{"readiness", "/debug/healthcheck/ready", "", "", 500, "no identity"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		w := serve(h, r)
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("%s: got %d %q, want %d %q",
+				tc.name, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+}
+
+func TestRequireAuthDisabled(t *testing.T) {
+	h, err := RequireAuth(whoami, &config.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.(*authHandler); ok {
+		t.Errorf("expected no auth to be required")
+	}
+}
+
+// fakeIdP is a minimal OpenID Connect provider that logs in a single
+// user with a fixed code.
+func fakeIdP() *httptest.Server {
+	var idp *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		redirect := r.URL.Query().Get("redirect_uri") +
+			"?code=the-code&state=" + url.QueryEscape(r.URL.Query().Get("state"))
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "the-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"the-token","token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer the-token" {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		w.Write([]byte(`{"email":"bob@example.com"}`))
+	})
+	idp = httptest.NewServer(mux)
+	return idp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := fakeIdP()
+	defer idp.Close()
+
+	app := httptest.NewUnstartedServer(nil)
+	oidc := &config.OIDC{
+		Issuer:       idp.URL,
+		ClientID:     "livegrep",
+		RedirectURL:  "http://" + app.Listener.Addr().String() + "/auth/callback",
+		CookieSecret: strings.Repeat("k", 32),
+	}
+	h, err := RequireAuth(whoami, &config.Auth{OIDC: oidc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Config.Handler = h
+	app.Start()
+	defer app.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get(app.URL + "/view/repo/file?commit=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 100)
+	n, _ := resp.Body.Read(body)
+	resp.Body.Close()
+	if got := string(body[:n]); resp.StatusCode != 200 || got != "oidc:bob@example.com" {
+		t.Fatalf("after login: got %d %q", resp.StatusCode, got)
+	}
+	if got := resp.Request.URL.RequestURI(); got != "/view/repo/file?commit=abc" {
+		t.Errorf("expected to return to the original page, got %s", got)
+	}
+
+	// API requests aren't redirected to the login page.
+	resp, err = http.Get(app.URL + "/api/v1/repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("anonymous API request: got %d, want 401", resp.StatusCode)
+	}
+
+	// A session cookie with a different user but the same signature
+	// is rejected.
+	p := h.(*authHandler).oidc
+	bob := p.sign(sessionCookie, &session{User: "bob@example.com", Expires: 1 << 40})
+	mallory := p.sign(sessionCookie, &session{User: "mallory@example.com", Expires: 1 << 40})
+	forged := mallory[:strings.LastIndex(mallory, ".")] + bob[strings.LastIndex(bob, "."):]
+	r := httptest.NewRequest("GET", "/api/v1/repos", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: forged})
+	if w := serve(h, r); w.Code != 401 {
+		t.Errorf("forged session: got %d, want 401", w.Code)
+	}
+
+	// Neither a login state cookie, which anyone can get by
+	// starting a login, nor a session without a user is accepted
+	// as a session.
+	for name, value := range map[string]string{
+		"login state":   p.sign(stateCookie, &loginState{State: "x", Return: "/", Expires: 1 << 40}),
+		"empty session": p.sign(sessionCookie, &session{Expires: 1 << 40}),
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/repos", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		if w := serve(h, r); w.Code != 401 {
+			t.Errorf("%s as a session: got %d, want 401", name, w.Code)
+		}
+	}
+	// Logging out takes a POST, so that other sites can't log
+	// users out with a link.
+	resp, err = client.Get(app.URL + "/auth/logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 405 {
+		t.Errorf("GET /auth/logout: got %d, want 405", resp.StatusCode)
+	}
+	if resp, err = client.Get(app.URL + "/api/v1/repos"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("GET /auth/logout logged out: got %d", resp.StatusCode)
+	}
+	if resp, err = client.Post(app.URL+"/auth/logout", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp, err = client.Get(app.URL + "/api/v1/repos"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("after POST /auth/logout: got %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestSafeReturn(t *testing.T) {
+	for ret, want := range map[string]bool{
+		"/search?q=x":         true,
+		"//evil.example.com":  false,
+		"/\\evil.example.com": false,
+		"https://example.com": false,
+		"":                    false,
+	} {
+		if got := safeReturn(ret); got != want {
+			t.Errorf("safeReturn(%q) = %v, want %v", ret, got, want)
+		}
+	}
+}
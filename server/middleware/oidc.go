@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+const (
+	sessionCookie = "livegrep_session"
+	stateCookie   = "livegrep_oidc_state"
+
+	defaultSessionTTL  = 24 * time.Hour
+	loginTimeout       = 10 * time.Minute
+	oidcRequestTimeout = 10 * time.Second
+)
+
+// oidcProvider implements the OpenID Connect authorization code flow.
+// Once a user has logged in, their identity is kept in a session
+// cookie signed with an HMAC, so no server-side state is needed.
+type oidcProvider struct {
+	oauth       oauth2.Config
+	userinfoURL string
+	userClaim   string
+	key         []byte
+	ttl         time.Duration
+	secure      bool
+}
+
+// The fields we use from the provider's discovery document.
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type session struct {
+	User    string `json:"u"`
+	Expires int64  `json:"e"`
+}
+
+type loginState struct {
+	State   string `json:"s"`
+	Return  string `json:"r"`
+	Expires int64  `json:"e"`
+}
+
+func discoverOIDC(issuer string) (*oidcDiscovery, error) {
+	client := &http.Client{Timeout: oidcRequestTimeout}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching discovery document: %s", resp.Status)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, fmt.Errorf("parsing discovery document: %s", err)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, errors.New("discovery document is missing an endpoint")
+	}
+	return &d, nil
+}
+
+func newOIDCProvider(cfg *config.OIDC) (*oidcProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer, client_id, and redirect_url are required")
+	}
+	if len(cfg.CookieSecret) < 32 {
+		return nil, errors.New("oidc: cookie_secret must be at least 32 bytes")
+	}
+	d, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %s: %s", cfg.Issuer, err)
+	}
+
+	p := &oidcProvider{
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  d.AuthorizationEndpoint,
+				TokenURL: d.TokenEndpoint,
+			},
+		},
+		userinfoURL: d.UserinfoEndpoint,
+		userClaim:   cfg.UserClaim,
+		key:         []byte(cfg.CookieSecret),
+		ttl:         time.Duration(cfg.SessionTTLSeconds) * time.Second,
+		secure:      strings.HasPrefix(cfg.RedirectURL, "https://"),
+	}
+	if len(p.oauth.Scopes) == 0 {
+		p.oauth.Scopes = []string{"openid", "email", "profile"}
+	}
+	if p.userClaim == "" {
+		p.userClaim = "email"
+	}
+	if p.ttl <= 0 {
+		p.ttl = defaultSessionTTL
+	}
+	return p, nil
+}
+
+// mac returns the HMAC of a signed value's payload. The cookie the
+// value is meant for is included, so that a value signed for one
+// cookie, such as the login state, can't be passed off as another,
+// such as the session.
+func (p *oidcProvider) mac(cookie, payload string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(cookie))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sign serializes v for the named cookie and appends an HMAC of the
+// result.
+func (p *oidcProvider) sign(cookie string, v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.mac(cookie, payload))
+}
+
+// verify checks the HMAC on a value produced by sign for the named
+// cookie, and if it is valid deserializes the value into v.
+func (p *oidcProvider) verify(cookie, s string, v interface{}) error {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return errors.New("malformed signed value")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, p.mac(cookie, s[:i])) {
+		return errors.New("bad signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (p *oidcProvider) setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl > 0 {
+		c.MaxAge = int(ttl / time.Second)
+	} else {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+func (p *oidcProvider) Authenticate(r *http.Request) (auth.Identity, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return auth.Identity{}, false
+	}
+	var s session
+	if err := p.verify(sessionCookie, c.Value, &s); err != nil ||
+		s.User == "" || time.Now().Unix() > s.Expires {
+		return auth.Identity{}, false
+	}
+	return auth.Identity{User: s.User, Provider: "oidc"}, true
+}
+
+func (p *oidcProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/auth/login":
+		p.serveLogin(w, r)
+	case "/auth/callback":
+		p.serveCallback(w, r)
+	case "/auth/logout":
+		// Only a POST logs out, so that a link or image on
+		// another site can't.
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.setCookie(w, sessionCookie, "", 0)
+		http.Error(w, "Logged out.", http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// safeReturn reports whether it is safe to redirect to ret after a
+// login, which is only the case for paths on this site.
+func safeReturn(ret string) bool {
+	return strings.HasPrefix(ret, "/") &&
+		!strings.HasPrefix(ret, "//") &&
+		!strings.HasPrefix(ret, "/\\")
+}
+
+func (p *oidcProvider) serveLogin(w http.ResponseWriter, r *http.Request) {
+	ret := r.URL.Query().Get("return")
+	if !safeReturn(ret) {
+		ret = "/"
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+	state := hex.EncodeToString(buf)
+	p.setCookie(w, stateCookie, p.sign(stateCookie, &loginState{
+		State:   state,
+		Return:  ret,
+		Expires: time.Now().Add(loginTimeout).Unix(),
+	}), loginTimeout)
+	http.Redirect(w, r, p.oauth.AuthCodeURL(state), http.StatusFound)
+}
+
+func (p *oidcProvider) serveCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), oidcRequestTimeout)
+	defer cancel()
+
+	params := r.URL.Query()
+	if e := params.Get("error"); e != "" {
+		log.Warnf(ctx, "oidc login failed error=%q description=%q",
+			e, params.Get("error_description"))
+		http.Error(w, "Login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	var ls loginState
+	c, err := r.Cookie(stateCookie)
+	if err == nil {
+		err = p.verify(stateCookie, c.Value, &ls)
+	}
+	if err != nil || time.Now().Unix() > ls.Expires ||
+		subtle.ConstantTimeCompare([]byte(ls.State), []byte(params.Get("state"))) != 1 {
+		http.Error(w, "Login expired or invalid; please try again.", http.StatusBadRequest)
+		return
+	}
+	p.setCookie(w, stateCookie, "", 0)
+
+	token, err := p.oauth.Exchange(ctx, params.Get("code"))
+	if err != nil {
+		log.Warnf(ctx, "oidc code exchange failed err=%q", err.Error())
+		http.Error(w, "Login failed.", http.StatusBadGateway)
+		return
+	}
+	user, err := p.userinfo(ctx, token)
+	if err != nil {
+		log.Warnf(ctx, "oidc userinfo failed err=%q", err.Error())
+		http.Error(w, "Login failed.", http.StatusBadGateway)
+		return
+	}
+
+	log.Printf(ctx, "oidc login user=%q", user)
+	p.setCookie(w, sessionCookie, p.sign(sessionCookie, &session{
+		User:    user,
+		Expires: time.Now().Add(p.ttl).Unix(),
+	}), p.ttl)
+	http.Redirect(w, r, ls.Return, http.StatusFound)
+}
+
+// userinfo fetches the name of the user who logged in from the
+// provider's userinfo endpoint.
+func (p *oidcProvider) userinfo(ctx context.Context, token *oauth2.Token) (string, error) {
+	resp, err := p.oauth.Client(ctx, token).Get(p.userinfoURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", err
+	}
+	user, _ := claims[p.userClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("no %q claim in userinfo", p.userClaim)
+	}
+	return user, nil
+}
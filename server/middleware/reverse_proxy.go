@@ -3,6 +3,8 @@ package middleware
 import (
 	"net/http"
 	"strings"
+
+	"github.com/livegrep/livegrep/server/auth"
 )
 
 type reverseProxyHandler struct {
@@ -27,3 +29,19 @@ func (h *reverseProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 func UnwrapProxyHeaders(h http.Handler) http.Handler {
 	return &reverseProxyHandler{h}
 }
+
+type trustedHeader string
+
+func (h trustedHeader) Authenticate(r *http.Request) (auth.Identity, bool) {
+	user := r.Header.Get(string(h))
+	if user == "" {
+		return auth.Identity{}, false
+	}
+	return auth.Identity{User: user, Provider: "header"}, true
+}
+
+// TrustedHeader authenticates requests using a header set by a
+// reverse proxy to the name of the user it authenticated.
+func TrustedHeader(name string) Authenticator {
+	return trustedHeader(http.CanonicalHeaderKey(name))
+}
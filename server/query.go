@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
@@ -38,8 +39,65 @@ func onlyOneSynonym(ops map[string]string, op1 string, op2 string) (string, erro
 	return ops[op2], nil
 }
 
+// queryTerm is one operator and its value, or the main search term
+// (with an empty key), as written in a query. Offsets are byte
+// offsets into the query.
+type queryTerm struct {
+	key   string
+	value string
+	// start is the offset of the operator, or of the value for the
+	// main search term.
+	start, valueStart, end int
+}
+
+// QueryError is an error parsing a query, carrying the byte offsets
+// of the part of the query it refers to.
+type QueryError struct {
+	Start, End int
+	Message    string
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+func newQueryTerm(query, key string, start, valueStart, end int) queryTerm {
+	value := query[valueStart:end]
+	valueStart += len(value) - len(strings.TrimLeftFunc(value, unicode.IsSpace))
+	end -= len(value) - len(strings.TrimRightFunc(value, unicode.IsSpace))
+	if key == "" {
+		start = valueStart
+	}
+	return queryTerm{key, query[valueStart:end], start, valueStart, end}
+}
+
+// errorAt attributes err to the last non-empty term with one of the
+// given keys.
+func errorAt(terms []queryTerm, err error, keys ...string) error {
+	for i := len(terms) - 1; i >= 0; i-- {
+		t := terms[i]
+		if t.value == "" {
+			continue
+		}
+		for _, k := range keys {
+			if t.key == k {
+				return &QueryError{t.start, t.end, err.Error()}
+			}
+		}
+	}
+	return err
+}
+
 func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
+	out, _, err := parseQuery(query, globalRegex)
+	return out, err
+}
+
+// parseQuery parses a query as ParseQuery does, additionally returning
+// the terms it was made up of, in order.
+func parseQuery(query string, globalRegex bool) (pb.Query, []queryTerm, error) {
 	var out pb.Query
+	var terms []queryTerm
 
 	ops := make(map[string]string)
 	key := ""
@@ -48,20 +106,37 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	inRegex := globalRegex
 	justGotSpace := true
 
+	// pos is the offset of q within query, and keyStart and
+	// termStart are the offsets of the current operator and term.
+	pos := len(query) - len(strings.TrimLeftFunc(query, unicode.IsSpace))
+	keyStart, termStart := pos, pos
+	setTerm := func(end int) error {
+		t := newQueryTerm(query, key, keyStart, termStart, end)
+		if _, alreadySet := ops[key]; alreadySet {
+			return &QueryError{t.start, t.end, fmt.Sprintf("got term twice: %s", key)}
+		}
+		ops[key] = term
+		if key != "" || t.value != "" {
+			terms = append(terms, t)
+		}
+		return nil
+	}
+
 	for {
 		m := pieceRE.FindStringSubmatchIndex(q)
 		if m == nil {
 			term += q
-			if _, alreadySet := ops[key]; alreadySet {
-				return out, fmt.Errorf("got term twice: %s", key)
+			if err := setTerm(pos + len(q)); err != nil {
+				return out, terms, err
 			}
-			ops[key] = term
 			break
 		}
 
+		base := pos
 		term += q[:m[0]]
 		match := q[m[0]:m[1]]
 		q = q[m[1]:]
+		pos += m[1]
 
 		justGotSpace = justGotSpace && m[0] == 0
 
@@ -71,13 +146,13 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 				term += " "
 
 			} else {
-				if _, alreadySet := ops[key]; alreadySet {
-					return out, fmt.Errorf("got term twice: %s", key)
+				if err := setTerm(base + m[0]); err != nil {
+					return out, terms, err
 				}
-				ops[key] = term
 				key = ""
 				term = ""
 				inRegex = globalRegex
+				keyStart, termStart = pos, pos
 			}
 		} else if match == "(" {
 			if !(inRegex || justGotSpace) {
@@ -113,6 +188,7 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 				}
 				term += match + w.String()
 				q = q[i:]
+				pos += i
 			}
 		} else if match[0] == '\\' {
 			term += match
@@ -121,13 +197,16 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 			newKey := match[m[2]-m[0] : m[3]-m[0]]
 			if key == "" && knownTags[newKey] {
 				if strings.TrimSpace(term) != "" {
+					t := newQueryTerm(query, key, termStart, termStart, base+m[0])
 					if _, alreadySet := ops[key]; alreadySet {
-						return out, fmt.Errorf("main search term must be contiguous")
+						return out, terms, &QueryError{t.start, t.end, "main search term must be contiguous"}
 					}
 					ops[key] = term
+					terms = append(terms, t)
 				}
 				term = ""
 				key = newKey
+				keyStart, termStart = base+m[0], pos
 			} else {
 				term += match
 			}
@@ -140,12 +219,12 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 
 	var err error
 	if out.File, err = onlyOneSynonym(ops, "file", "path"); err != nil {
-		return out, err
+		return out, terms, errorAt(terms, err, "file", "path")
 	}
 	out.Repo = ops["repo"]
 	out.Tags = ops["tags"]
 	if out.NotFile, err = onlyOneSynonym(ops, "-file", "-path"); err != nil {
-		return out, err
+		return out, terms, errorAt(terms, err, "-file", "-path")
 	}
 	out.NotRepo = ops["-repo"]
 	out.NotTags = ops["-tags"]
@@ -161,7 +240,9 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	}
 
 	if len(bits) > 1 {
-		return out, errors.New("You cannot provide multiple of case:, lit:, and a bare regex")
+		return out, terms, errorAt(terms,
+			errors.New("You cannot provide multiple of case:, lit:, and a bare regex"),
+			"", "case", "lit")
 	}
 
 	if len(bits) > 0 {
@@ -193,11 +274,13 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		if err == nil {
 			out.MaxMatches = int32(i)
 		} else {
-			return out, errors.New("Value given to max_matches: must be a valid integer")
+			return out, terms, errorAt(terms,
+				errors.New("Value given to max_matches: must be a valid integer"),
+				"max_matches")
 		}
 	} else {
 		out.MaxMatches = 0
 	}
 
-	return out, nil
+	return out, terms, nil
 }
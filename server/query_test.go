@@ -228,3 +228,77 @@ func TestParseQueryError(t *testing.T) {
 		}
 	}
 }
+
+func TestParseQueryTerms(t *testing.T) {
+	type term struct {
+		key               string
+		value             string
+		start, valueStart int
+		end               int
+	}
+	cases := []struct {
+		in    string
+		terms []term
+	}{
+		{
+			"hello",
+			[]term{{"", "hello", 0, 0, 5}},
+		},
+		{
+			"  foo  bar file:\\.go$ -repo:(a b) ",
+			[]term{
+				{"", "foo  bar", 2, 2, 10},
+				{"file", `\.go$`, 11, 16, 21},
+				{"-repo", "(a b)", 22, 28, 33},
+			},
+		},
+		{
+			"lit:a(b max_matches:10",
+			[]term{
+				{"lit", "a(b", 0, 4, 7},
+				{"max_matches", "10", 8, 20, 22},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		_, terms, err := parseQuery(tc.in, true)
+		if err != nil {
+			t.Errorf("parse(%v) error=%v", tc.in, err)
+			continue
+		}
+		got := make([]term, len(terms))
+		for i, qt := range terms {
+			got[i] = term{qt.key, qt.value, qt.start, qt.valueStart, qt.end}
+		}
+		if !reflect.DeepEqual(tc.terms, got) {
+			t.Errorf("terms of %q: expected %+v got %+v", tc.in, tc.terms, got)
+		}
+	}
+}
+
+func TestParseQueryErrorSpan(t *testing.T) {
+	cases := []struct {
+		in         string
+		start, end int
+	}{
+		{"a file:b file:c", 9, 15},
+		{"a file:b c", 9, 10},
+		{"case:a lit:b", 7, 12},
+		{"a file:b path:c", 9, 15},
+		{"a max_matches:x", 2, 15},
+	}
+
+	for _, tc := range cases {
+		_, err := ParseQuery(tc.in, true)
+		qe, ok := err.(*QueryError)
+		if !ok {
+			t.Errorf("parse(%v): expected a *QueryError, got %v", tc.in, err)
+			continue
+		}
+		if qe.Start != tc.start || qe.End != tc.end {
+			t.Errorf("parse(%v): expected error at [%d,%d), got [%d,%d): %s",
+				tc.in, tc.start, tc.end, qe.Start, qe.End, qe.Message)
+		}
+	}
+}
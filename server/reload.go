@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// A Reloader is a handler whose configuration can be replaced while
+// it is serving.
+type Reloader interface {
+	http.Handler
+	// Reload switches to cfg if it is valid. Otherwise it returns
+	// an error and the current configuration stays in use.
+	Reload(cfg *config.Config) error
+	// SetLoader sets how /debug/reload-config reads the new
+	// configuration.
+	SetLoader(load func() (*config.Config, error))
+}
+
+// cfg returns the current configuration, which must not be modified.
+func (s *server) cfg() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// repoMap returns the browsable repositories by name. The map must
+// not be modified.
+func (s *server) repoMap() map[string]config.RepoConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.repos
+}
+
+func (s *server) tmpl() *Templates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.T
+}
+
+func (s *server) assetHashes() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.AssetHashes
+}
+
+func (s *server) setTemplates(t *Templates, hashes map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.T, s.AssetHashes = t, hashes
+}
+
+func repoMap(cfg *config.Config) map[string]config.RepoConfig {
+	repos := make(map[string]config.RepoConfig, len(cfg.IndexConfig.Repositories))
+	for _, r := range cfg.IndexConfig.Repositories {
+		repos[r.Name] = r
+	}
+	return repos
+}
+
+// restartOnly lists the settings that are only read at startup, so
+// that reloading can warn when they change.
+func restartOnly(cfg *config.Config) map[string]interface{} {
+	// The admins are looked up on every request.
+	auth := cfg.Auth
+	auth.Admins = nil
+	return map[string]interface{}{
+		"listen":         cfg.Listen,
+		"http":           cfg.HTTP,
+		"reverse_proxy":  cfg.ReverseProxy,
+		"auth":           auth,
+		"acl":            cfg.ACL,
+		"log":            cfg.Log,
+		"honeycomb":      cfg.Honeycomb,
+		"events":         cfg.Events,
+		"tracing":        cfg.Tracing,
+		"search_cache":   cfg.SearchCache,
+		"saved_searches": cfg.SavedSearches,
+		"discovery":      cfg.Discovery,
+	}
+}
+
+func (s *server) SetLoader(load func() (*config.Config, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loader = load
+}
+
+// Reload switches the server to cfg: its repositories, backends,
+// templates, and the settings read while serving. Blame history is
+// loaded for repositories that are new or have changed. Nothing
+// changes unless the templates load and every backend can be set up.
+func (s *server) Reload(cfg *config.Config) error {
+	_, err := s.reload(cfg)
+	return err
+}
+
+// reload is Reload, also returning the restart-only sections of cfg
+// that differ from the running config and so were not applied.
+func (s *server) reload(cfg *config.Config) ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	ctx := context.Background()
+
+	t, hashes, err := loadTemplates(cfg.DocRoot)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := discoverBackends(cfg.Backends, s.discoverers)
+	if err != nil {
+		return nil, err
+	}
+
+	old := s.cfg()
+	oldRepos := s.repoMap()
+	repos := repoMap(cfg)
+	var changed []config.RepoConfig
+	for name, r := range repos {
+		if prev, ok := oldRepos[name]; !ok || !reflect.DeepEqual(prev, r) || getHistory(name) == nil {
+			changed = append(changed, r)
+		}
+	}
+
+	set, err := s.newBackendSet(backends)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 {
+		loadBlame(ctx, changed)
+	}
+
+	// Swap everything at once, so that no request sees the new
+	// config with the old backends or the other way around.
+	s.mu.Lock()
+	s.bkMu.Lock()
+	s.config = cfg
+	s.repos = repos
+	dropHistories(repos)
+	s.T, s.AssetHashes = t, hashes
+	if set != nil {
+		s.swapBackends(set)
+	}
+	s.bkMu.Unlock()
+	s.mu.Unlock()
+
+	was, now := restartOnly(old), restartOnly(cfg)
+	var ignored []string
+	for name := range now {
+		if !reflect.DeepEqual(was[name], now[name]) {
+			ignored = append(ignored, name)
+		}
+	}
+	sort.Strings(ignored)
+	for _, name := range ignored {
+		log.Warnf(ctx, "config: changes to %q take effect after a restart", name)
+	}
+	log.Printf(ctx, "config reloaded: %d backends, %d repositories", len(backends), len(repos))
+	return ignored, nil
+}
+
+// isAdmin reports whether the user making a request may use the
+// administrative endpoints.
+func (s *server) isAdmin(ctx context.Context) bool {
+	id, ok := auth.FromContext(ctx)
+	if !ok || id.User == "" {
+		return false
+	}
+	for _, u := range s.cfg().Auth.Admins {
+		if u == id.User {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) ServeReloadConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(ctx) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	s.mu.RLock()
+	load := s.loader
+	s.mu.RUnlock()
+	if load == nil {
+		http.Error(w, "Config reloading is not enabled", 404)
+		return
+	}
+	cfg, err := load()
+	var ignored []string
+	if err == nil {
+		ignored, err = s.reload(cfg)
+	}
+	if err != nil {
+		message := fmt.Sprint("Error reloading config, keeping the current one: ", err)
+		log.Errorf(ctx, "%s", message)
+		http.Error(w, message, 400)
+		return
+	}
+	if len(ignored) > 0 {
+		http.Error(w, fmt.Sprintf("OK, but changes to %s take effect after a restart",
+			strings.Join(ignored, ", ")), 200)
+		return
+	}
+	http.Error(w, "OK", 200)
+}
+
+// reloadTemplates re-reads the templates before every request while
+// the config's "reload" setting is on, for working on them.
+func (s *server) reloadTemplates(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg().Reload {
+			t, hashes, err := loadTemplates(s.cfg().DocRoot)
+			if err != nil {
+				log.Errorf(r.Context(), "%s", err)
+			} else {
+				s.setTemplates(t, hashes)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveAssets serves the static assets from the current docroot.
+func (s *server) serveAssets(w http.ResponseWriter, r *http.Request) {
+	http.FileServer(http.Dir(path.Join(s.cfg().DocRoot, "htdocs"))).ServeHTTP(w, r)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// testDocRoot creates a docroot with empty templates.
+func testDocRoot(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "livegrep-docroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"layout.html", "index.html", "fileview.html", "blamediff.html",
+		"blamefile.html", "logfile.html", "about.html", "opensearch.xml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "templates", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hashes.txt"), []byte("abcd  htdocs/app.js\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newReloadServer(t *testing.T, cfg *config.Config) *server {
+	h, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*server)
+}
+
+func stopBackends(s *server) {
+	for _, bk := range s.backendList() {
+		bk.Stop()
+	}
+}
+
+func TestReload(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+
+	s := newReloadServer(t, &config.Config{
+		DocRoot:           docRoot,
+		DefaultMaxMatches: 50,
+		Backends:          []config.Backend{{Id: "a", Addr: "localhost:9001"}},
+		IndexConfig: config.IndexConfig{
+			Repositories: []config.RepoConfig{{Name: "old"}},
+		},
+	})
+	defer stopBackends(s)
+	a := s.backend("a")
+	setHistory("old", &blameworthy.GitHistory{})
+	defer setHistory("old", nil)
+
+	err := s.Reload(&config.Config{
+		DocRoot:           docRoot,
+		DefaultMaxMatches: 100,
+		Backends: []config.Backend{
+			{Id: "a", Addr: "localhost:9001"},
+			{Id: "b", Addr: "localhost:9002"},
+		},
+		IndexConfig: config.IndexConfig{
+			Repositories: []config.RepoConfig{{Name: "new"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.cfg().DefaultMaxMatches; got != 100 {
+		t.Errorf("DefaultMaxMatches = %d, want 100", got)
+	}
+	if _, ok := s.repoMap()["new"]; !ok {
+		t.Errorf("new repo not browsable")
+	}
+	if _, ok := s.repoMap()["old"]; ok {
+		t.Errorf("removed repo still browsable")
+	}
+	if getHistory("old") != nil {
+		t.Errorf("removed repo's blame history kept")
+	}
+	if got, want := backendIds(s), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+	if s.backend("a") != a {
+		t.Errorf("an unchanged backend was replaced")
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+
+	cfg := &config.Config{
+		DocRoot:  docRoot,
+		Backends: []config.Backend{{Id: "a", Addr: "localhost:9001"}},
+	}
+	s := newReloadServer(t, cfg)
+	defer stopBackends(s)
+	tmpl := s.tmpl()
+
+	bad := []*config.Config{
+		// No templates
+		{DocRoot: filepath.Join(docRoot, "missing")},
+		// A backend that can't be set up
+		{
+			DocRoot: docRoot,
+			Backends: []config.Backend{{Id: "b", Addr: "localhost:9002",
+				TLS: &config.ClientTLS{Enabled: true, CAFile: filepath.Join(docRoot, "missing.pem")}}},
+		},
+	}
+	for i, c := range bad {
+		if err := s.Reload(c); err == nil {
+			t.Errorf("%d: accepted an invalid config", i)
+		}
+		if s.cfg() != cfg || s.tmpl() != tmpl {
+			t.Errorf("%d: an invalid config was swapped in", i)
+		}
+		if got, want := backendIds(s), []string{"a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: backends = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestServeReloadConfig(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+
+	cfg := &config.Config{
+		DocRoot: docRoot,
+		Auth:    config.Auth{Admins: []string{"root"}},
+	}
+	s := newReloadServer(t, cfg)
+	defer stopBackends(s)
+	next := &config.Config{
+		DocRoot:           docRoot,
+		Auth:              cfg.Auth,
+		DefaultMaxMatches: 100,
+	}
+	s.SetLoader(func() (*config.Config, error) { return next, nil })
+
+	cases := []struct {
+		user   string
+		status int
+	}{
+		{"", 403},
+		{"bob", 403},
+		{"root", 200},
+	}
+	for _, tc := range cases {
+		ctx := context.Background()
+		if tc.user != "" {
+			ctx = auth.NewContext(ctx, auth.Identity{User: tc.user})
+		}
+		w := httptest.NewRecorder()
+		s.ServeReloadConfig(ctx, w, httptest.NewRequest("POST", "/debug/reload-config", nil))
+		if w.Code != tc.status {
+			t.Errorf("user %q: got %d, want %d", tc.user, w.Code, tc.status)
+		}
+		if reloaded := s.cfg() == next; reloaded != (tc.status == 200) {
+			t.Errorf("user %q: reloaded = %v", tc.user, reloaded)
+		}
+	}
+}
+
+func TestServeReloadConfigReportsRestartOnly(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+
+	cfg := &config.Config{
+		DocRoot: docRoot,
+		Auth:    config.Auth{Admins: []string{"root"}},
+	}
+	s := newReloadServer(t, cfg)
+	defer stopBackends(s)
+	s.SetLoader(func() (*config.Config, error) {
+		return &config.Config{
+			DocRoot:           docRoot,
+			Auth:              config.Auth{Admins: []string{"root"}, TrustedHeader: "X-User"},
+			ACL:               config.ACL{Groups: map[string][]string{"staff": {"root"}}},
+			DefaultMaxMatches: 100,
+		}, nil
+	})
+
+	w := httptest.NewRecorder()
+	ctx := auth.NewContext(context.Background(), auth.Identity{User: "root"})
+	s.ServeReloadConfig(ctx, w, httptest.NewRequest("POST", "/debug/reload-config", nil))
+	if w.Code != 200 || s.cfg().DefaultMaxMatches != 100 {
+		t.Fatalf("got %d %q, want the config reloaded", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.Contains(body, "acl, auth") || !strings.Contains(body, "restart") {
+		t.Errorf("response %q doesn't report the ignored acl and auth changes", body)
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// A Replica is one of the codesearch processes serving a backend's
+// index.
+type Replica struct {
+	// The number of searches currently waiting on the replica.
+	// Accessed atomically, so it comes first for alignment.
+	inFlight int64
+
+	Addr       string
+	Codesearch pb.CodeSearchClient
+	conn       *grpc.ClientConn
+
+	mu                  sync.Mutex
+	lastPoll            time.Time
+	lastSuccess         time.Time
+	consecutiveFailures int
+	lastError           string
+}
+
+// poll asks the replica for its info, recording whether it answered.
+func (r *Replica) poll() (*pb.ServerInfo, error) {
+	// Without a deadline, a replica that is down would block the
+	// poll forever instead of being reported as failing.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	info, err := r.Codesearch.Info(ctx, &pb.InfoRequest{}, grpc.FailFast(false))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastPoll = time.Now()
+	if err == nil {
+		r.lastSuccess = r.lastPoll
+		r.consecutiveFailures = 0
+		r.lastError = ""
+	} else {
+		r.consecutiveFailures++
+		r.lastError = err.Error()
+	}
+	return info, err
+}
+
+// searchFailed records that a search couldn't reach the replica,
+// taking it out of rotation until it next answers a poll.
+func (r *Replica) searchFailed(err error, unhealthyAfter int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.consecutiveFailures < unhealthyAfter {
+		r.consecutiveFailures = unhealthyAfter
+	}
+	r.lastError = err.Error()
+}
+
+func (r *Replica) healthy(unhealthyAfter int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.consecutiveFailures < unhealthyAfter
+}
+
+// latencyWindow remembers how long recent searches took.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [256]time.Duration
+	n       int
+	pos     int
+}
+
+// minHedgeSamples is how many searches must have completed before
+// their times are used to decide when to hedge.
+const minHedgeSamples = 20
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.pos] = d
+	w.pos = (w.pos + 1) % len(w.samples)
+	if w.n < len(w.samples) {
+		w.n++
+	}
+}
+
+// percentile returns the pth percentile of the recent search times,
+// or false if there have been too few searches to say.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if w.n < minHedgeSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, w.n)
+	copy(sorted, w.samples[:w.n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p / 100 * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// replicaSet is a CodeSearchClient that spreads calls across the
+// replicas of a backend, preferring healthy and idle ones, and retries
+// failed calls on other replicas.
+type replicaSet struct {
+	backend        string
+	replicas       []*Replica
+	unhealthyAfter int
+	hedge          *config.Hedge
+	latencies      latencyWindow
+	next           uint32
+}
+
+func newReplicaSet(cfg *config.Backend, replicas []*Replica) *replicaSet {
+	rs := &replicaSet{
+		backend:        cfg.Id,
+		replicas:       replicas,
+		unhealthyAfter: cfg.UnhealthyAfter,
+		hedge:          cfg.Hedge,
+	}
+	if rs.unhealthyAfter <= 0 {
+		rs.unhealthyAfter = 1
+	}
+	return rs
+}
+
+// pick returns the replicas in the order to try them: healthy ones
+// with the fewest searches in flight first, then the rest as a last
+// resort. Ties are broken round-robin.
+func (rs *replicaSet) pick() []*Replica {
+	n := len(rs.replicas)
+	start := int(atomic.AddUint32(&rs.next, 1) % uint32(n))
+	healthy := make([]*Replica, 0, n)
+	var unhealthy []*Replica
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		if r.healthy(rs.unhealthyAfter) {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return atomic.LoadInt64(&healthy[i].inFlight) < atomic.LoadInt64(&healthy[j].inFlight)
+	})
+	return append(healthy, unhealthy...)
+}
+
+// hedgeDelay returns how long to wait for a replica before sending a
+// search to another one, or false if searches shouldn't be hedged.
+func (rs *replicaSet) hedgeDelay() (time.Duration, bool) {
+	if rs.hedge == nil || rs.hedge.Percentile <= 0 {
+		return 0, false
+	}
+	d, ok := rs.latencies.percentile(rs.hedge.Percentile)
+	if !ok {
+		return 0, false
+	}
+	min := 10 * time.Millisecond
+	if rs.hedge.MinDelayMs > 0 {
+		min = time.Duration(rs.hedge.MinDelayMs) * time.Millisecond
+	}
+	if d < min {
+		d = min
+	}
+	return d, true
+}
+
+// retryable returns whether a call that failed with err might succeed
+// on another replica.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return grpc.Code(err) != codes.InvalidArgument
+}
+
+type searchResult struct {
+	replica *Replica
+	reply   *pb.CodeSearchResult
+	err     error
+	elapsed time.Duration
+}
+
+func (rs *replicaSet) Search(ctx context.Context, q *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	candidates := rs.pick()
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan searchResult, len(candidates))
+	next, outstanding := 0, 0
+	launch := func() {
+		r := candidates[next]
+		callOpts := opts
+		if next < len(candidates)-1 {
+			// Give up straight away if the replica is unreachable,
+			// so that the search can be retried on another.
+			callOpts = append(opts[:len(opts):len(opts)], grpc.FailFast(true))
+		}
+		next++
+		outstanding++
+		go func() {
+			start := time.Now()
+			atomic.AddInt64(&r.inFlight, 1)
+			reply, err := r.Codesearch.Search(ctx, q, callOpts...)
+			atomic.AddInt64(&r.inFlight, -1)
+			results <- searchResult{r, reply, err, time.Since(start)}
+		}()
+	}
+	launch()
+
+	var hedge <-chan time.Time
+	if delay, ok := rs.hedgeDelay(); ok && len(candidates) > 1 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		hedge = t.C
+	}
+
+	for {
+		select {
+		case res := <-results:
+			outstanding--
+			if res.err == nil {
+				rs.latencies.add(res.elapsed)
+				return res.reply, nil
+			}
+			if !retryable(parent, res.err) {
+				return nil, res.err
+			}
+			if grpc.Code(res.err) == codes.Unavailable {
+				res.replica.searchFailed(res.err, rs.unhealthyAfter)
+			}
+			if next < len(candidates) {
+				log.Log(parent, log.Warn, "search failed, trying another replica",
+					log.Fields{"replica": res.replica.Addr, "error": res.err.Error()})
+				searchRetries.Inc(rs.backend, "failover")
+				launch()
+			} else if outstanding == 0 {
+				return nil, res.err
+			}
+		case <-hedge:
+			hedge = nil
+			if next < len(candidates) {
+				searchRetries.Inc(rs.backend, "hedge")
+				launch()
+			}
+		}
+	}
+}
+
+func (rs *replicaSet) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	var err error
+	for _, r := range rs.pick() {
+		var info *pb.ServerInfo
+		if info, err = r.Codesearch.Info(ctx, in, opts...); err == nil || !retryable(ctx, err) {
+			return info, err
+		}
+	}
+	return nil, err
+}
+
+// Reload asks every replica to reload its index, returning the first
+// error.
+func (rs *replicaSet) Reload(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.Empty, error) {
+	var first error
+	for _, r := range rs.replicas {
+		if _, err := r.Codesearch.Reload(ctx, in, opts...); err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	return &pb.Empty{}, nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// replicaClient is one replica of a fake backend, which answers
+// searches with a single result naming itself.
+type replicaClient struct {
+	fakeCodeSearch
+	name string
+	// If set, calls fail with this error.
+	err error
+	// The index time reported by Info, 1000 if unset.
+	indexTime int64
+	// If set, searches wait until they are cancelled.
+	block    bool
+	searches int32
+}
+
+func (c *replicaClient) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	indexTime := c.indexTime
+	if indexTime == 0 {
+		indexTime = 1000
+	}
+	return &pb.ServerInfo{Name: c.name, IndexTime: indexTime}, nil
+}
+
+func (c *replicaClient) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	atomic.AddInt32(&c.searches, 1)
+	if c.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &pb.CodeSearchResult{
+		Stats:   &pb.SearchStats{},
+		Results: []*pb.SearchResult{{Tree: c.name, Bounds: &pb.Bounds{}}},
+	}, nil
+}
+
+func newTestReplicas(cfg *config.Backend, clients ...*replicaClient) *replicaSet {
+	var replicas []*Replica
+	for _, c := range clients {
+		replicas = append(replicas, &Replica{Addr: c.name, Codesearch: c})
+	}
+	return newReplicaSet(cfg, replicas)
+}
+
+func searchedBy(t *testing.T, rs *replicaSet) string {
+	reply, err := rs.Search(context.Background(), &pb.Query{Line: "x"})
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	return reply.Results[0].Tree
+}
+
+func TestReplicaFailover(t *testing.T) {
+	a := &replicaClient{name: "a", err: grpc.Errorf(codes.Unavailable, "restarting")}
+	b := &replicaClient{name: "b"}
+	rs := newTestReplicas(&config.Backend{Id: "bk"}, a, b)
+
+	for i := 0; i < 4; i++ {
+		if got := searchedBy(t, rs); got != "b" {
+			t.Errorf("search %d answered by %s, want b", i, got)
+		}
+	}
+	// Once a has failed, searches stop being sent to it.
+	if n := atomic.LoadInt32(&a.searches); n != 1 {
+		t.Errorf("a was sent %d searches, want 1", n)
+	}
+
+	// It comes back into rotation once it answers a poll.
+	a.err = nil
+	rs.replicas[0].poll()
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[searchedBy(t, rs)] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("searches not spread across replicas: %v", seen)
+	}
+}
+
+func TestReplicaNoRetry(t *testing.T) {
+	a := &replicaClient{name: "a", err: grpc.Errorf(codes.InvalidArgument, "bad regex")}
+	b := &replicaClient{name: "b", err: grpc.Errorf(codes.InvalidArgument, "bad regex")}
+	rs := newTestReplicas(&config.Backend{Id: "bk"}, a, b)
+
+	if _, err := rs.Search(context.Background(), &pb.Query{Line: "("}); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	if n := atomic.LoadInt32(&a.searches) + atomic.LoadInt32(&b.searches); n != 1 {
+		t.Errorf("a bad query was sent %d times", n)
+	}
+	if !rs.replicas[0].healthy(rs.unhealthyAfter) || !rs.replicas[1].healthy(rs.unhealthyAfter) {
+		t.Errorf("a bad query marked a replica unhealthy")
+	}
+}
+
+func TestReplicaHedge(t *testing.T) {
+	a := &replicaClient{name: "a", block: true}
+	b := &replicaClient{name: "b"}
+	rs := newTestReplicas(&config.Backend{Id: "bk", Hedge: &config.Hedge{Percentile: 90, MinDelayMs: 1}}, a, b)
+	for i := 0; i < minHedgeSamples; i++ {
+		rs.latencies.add(time.Millisecond)
+	}
+
+	// a hangs, so searches that try it first only succeed if they
+	// are hedged to b. Replicas are tried round-robin, so one of
+	// these does.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		reply, err := rs.Search(ctx, &pb.Query{Line: "x"})
+		if err != nil {
+			t.Fatalf("search %d: %v", i, err)
+		}
+		if reply.Results[0].Tree != "b" {
+			t.Errorf("search %d answered by %s, want b", i, reply.Results[0].Tree)
+		}
+	}
+	if n := atomic.LoadInt32(&a.searches); n != 1 {
+		t.Errorf("a was sent %d searches, want 1", n)
+	}
+}
+
+func TestBackendPollReplicas(t *testing.T) {
+	a := &replicaClient{name: "a", err: grpc.Errorf(codes.Unavailable, "down")}
+	b := &replicaClient{name: "b"}
+	rs := newTestReplicas(&config.Backend{Id: "bk"}, a, b)
+	bk := &Backend{Id: "bk", Addr: "a,b", I: &I{}, Codesearch: rs, Replicas: rs.replicas}
+	s := &server{config: &config.Config{}, started: time.Now()}
+
+	bk.pollOnce()
+	h := s.backendHealth(bk, time.Now())
+	if h.State != backendUp || h.IndexAge == nil {
+		t.Errorf("one replica up: %+v", h)
+	}
+	if len(h.Replicas) != 2 || h.Replicas[0].Healthy || !h.Replicas[1].Healthy {
+		t.Fatalf("unexpected replicas: %+v", h.Replicas)
+	}
+	if h.Replicas[0].LastError == "" {
+		t.Errorf("no error recorded for the failing replica")
+	}
+
+	b.err = a.err
+	bk.pollOnce()
+	h = s.backendHealth(bk, time.Now())
+	if h.State != backendFailing || h.ConsecutiveFailures != 1 {
+		t.Errorf("all replicas down: %+v", h)
+	}
+}
+
+func TestBackendPollReplicasReindex(t *testing.T) {
+	a := &replicaClient{name: "a", indexTime: 2000}
+	b := &replicaClient{name: "b", indexTime: 1000}
+	rs := newTestReplicas(&config.Backend{Id: "bk"}, a, b)
+	reindexes := 0
+	bk := &Backend{Id: "bk", Addr: "a,b", I: &I{}, Codesearch: rs, Replicas: rs.replicas,
+		OnReindex: func(*Backend) { reindexes++ }}
+
+	bk.pollOnce()
+	if reindexes != 1 || bk.I.IndexTime.Unix() != 2000 {
+		t.Fatalf("first poll: %d reindexes, index time %v", reindexes, bk.I.IndexTime)
+	}
+
+	// The replica with the newest index going away, and coming
+	// back, isn't a reindex.
+	a.err = grpc.Errorf(codes.Unavailable, "down")
+	bk.pollOnce()
+	a.err = nil
+	bk.pollOnce()
+	if reindexes != 1 || bk.I.IndexTime.Unix() != 2000 {
+		t.Errorf("replica outage: %d reindexes, index time %v", reindexes, bk.I.IndexTime)
+	}
+
+	b.indexTime = 3000
+	bk.pollOnce()
+	if reindexes != 2 || bk.I.IndexTime.Unix() != 3000 {
+		t.Errorf("new index: %d reindexes, index time %v", reindexes, bk.I.IndexTime)
+	}
+}
@@ -30,3 +30,21 @@ func FromContext(ctx context.Context) (RequestID, bool) {
 	reqID, ok := ctx.Value(reqIDKey).(RequestID)
 	return reqID, ok
 }
+
+// Parse checks a request ID supplied by a client, such as in an
+// X-Request-Id header. IDs are limited to a modest length and to
+// characters that are safe to log and echo back.
+func Parse(s string) (RequestID, bool) {
+	if len(s) == 0 || len(s) > 128 {
+		return "", false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return "", false
+		}
+	}
+	return RequestID(s), true
+}
@@ -0,0 +1,653 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/reqid"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+const (
+	savedSearchTimeout = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+var errSavedSearchChanged = errors.New("saved search was changed or deleted while it ran")
+
+// savedSearches holds the saved searches, along with the matches each
+// found on its last run, and persists them to a JSON file.
+type savedSearches struct {
+	path    string
+	webhook string
+	// The hosts, in lower case, that searches may set their own
+	// webhook to.
+	webhookHosts map[string]bool
+	client       *http.Client
+
+	// runMu serializes runs, so that a search run by hand and by
+	// the scheduler at once doesn't send the same alert twice.
+	runMu sync.Mutex
+
+	mu       sync.Mutex
+	searches map[string]*savedSearch
+	// pending holds the backends that have reindexed since the
+	// scheduler last woke up.
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+type savedSearch struct {
+	api.SavedSearch
+	// Primed is set once the search has run, so that its first
+	// run doesn't report every match as new.
+	Primed  bool              `json:"primed"`
+	Matches []*api.SavedMatch `json:"matches"`
+
+	// rev is incremented whenever the search is edited.
+	rev int
+}
+
+type savedSearchFile struct {
+	Searches []*savedSearch `json:"searches"`
+}
+
+func newSavedSearches(cfg *config.SavedSearches) (*savedSearches, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	ss := &savedSearches{
+		path:         cfg.Path,
+		webhook:      cfg.WebhookURL,
+		webhookHosts: make(map[string]bool, len(cfg.WebhookHosts)),
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// A redirect could lead anywhere, including
+			// hosts that aren't allowed.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		searches: make(map[string]*savedSearch),
+		pending:  make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	for _, h := range cfg.WebhookHosts {
+		ss.webhookHosts[strings.ToLower(h)] = true
+	}
+	data, err := ioutil.ReadFile(cfg.Path)
+	if os.IsNotExist(err) {
+		return ss, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f savedSearchFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", cfg.Path, err)
+	}
+	for _, search := range f.Searches {
+		ss.searches[search.Id] = search
+	}
+	return ss, nil
+}
+
+// save writes the saved searches to disk. It must be called with
+// ss.mu held.
+func (ss *savedSearches) save() error {
+	f := savedSearchFile{Searches: make([]*savedSearch, 0, len(ss.searches))}
+	for _, search := range ss.searches {
+		f.Searches = append(f.Searches, search)
+	}
+	sort.Slice(f.Searches, func(i, j int) bool {
+		return f.Searches[i].Id < f.Searches[j].Id
+	})
+	data, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it into place, so a
+	// crash can't leave a truncated file behind.
+	tmp := ss.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ss.path)
+}
+
+// trigger schedules a run of the saved searches that search bk. It is
+// used as bk.OnReindex.
+func (ss *savedSearches) trigger(bk *Backend) {
+	ss.mu.Lock()
+	ss.pending[bk.Id] = true
+	ss.mu.Unlock()
+	select {
+	case ss.wake <- struct{}{}:
+	default:
+	}
+}
+
+// searchesAny reports whether a search of backends searches any of
+// the backends in set.
+func searchesAny(backends []string, set map[string]bool) bool {
+	if len(backends) == 0 {
+		return len(set) > 0
+	}
+	for _, id := range backends {
+		if set[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// runSavedSearches re-runs saved searches as the backends they search
+// reindex. It never returns.
+func (s *server) runSavedSearches() {
+	ss := s.saved
+	for range ss.wake {
+		ss.mu.Lock()
+		reindexed := ss.pending
+		ss.pending = make(map[string]bool)
+		var ids []string
+		for id, search := range ss.searches {
+			if searchesAny(search.Query.Backends, reindexed) {
+				ids = append(ids, id)
+			}
+		}
+		ss.mu.Unlock()
+
+		sort.Strings(ids)
+		for _, id := range ids {
+			// runSavedSearch logs and records its own errors.
+			s.runSavedSearch(context.Background(), id)
+		}
+	}
+}
+
+func matchKey(m *api.SavedMatch) string {
+	return m.Tree + "\x00" + m.Path + "\x00" + m.Line
+}
+
+// diffMatches compares the matches found by a run of a saved search
+// against those found by the previous run, returning the new baseline
+// to compare the next run against. If the run was incomplete, because
+// it hit the match limit or a backend failed, matches missing from it
+// aren't reported as removed.
+func diffMatches(old, cur []*api.SavedMatch, complete bool) (added, removed, baseline []*api.SavedMatch) {
+	oldKeys := make(map[string]bool, len(old))
+	for _, m := range old {
+		oldKeys[matchKey(m)] = true
+	}
+	curKeys := make(map[string]bool, len(cur))
+	for _, m := range cur {
+		curKeys[matchKey(m)] = true
+		if !oldKeys[matchKey(m)] {
+			added = append(added, m)
+		}
+	}
+	if !complete {
+		return added, nil, append(append([]*api.SavedMatch{}, old...), added...)
+	}
+	for _, m := range old {
+		if !curKeys[matchKey(m)] {
+			removed = append(removed, m)
+		}
+	}
+	return added, removed, cur
+}
+
+// savedSearchMatches runs req, returning the distinct matches it found
+// and whether the results are complete.
+func (s *server) savedSearchMatches(ctx context.Context, req *api.SearchRequest) ([]*api.SavedMatch, bool, error) {
+	q, backends, e := s.queryFromRequest(req)
+	if e != nil {
+		return nil, false, e
+	}
+	var reply *api.ReplySearch
+	var err error
+	if len(backends) == 1 {
+		reply, err = s.doSearch(ctx, backends[0], &q)
+	} else {
+		reply, err = s.doSearchAll(ctx, backends, &q)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	seen := make(map[string]bool)
+	var matches []*api.SavedMatch
+	add := func(m *api.SavedMatch) {
+		if k := matchKey(m); !seen[k] {
+			seen[k] = true
+			matches = append(matches, m)
+		}
+	}
+	for _, r := range reply.Results {
+		add(&api.SavedMatch{Tree: r.Tree, Path: r.Path, Line: r.Line})
+	}
+	for _, r := range reply.FileResults {
+		add(&api.SavedMatch{Tree: r.Tree, Path: r.Path})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matchKey(matches[i]) < matchKey(matches[j])
+	})
+
+	complete := reply.Info.ExitReason == pb.SearchStats_NONE.String() && len(reply.Warnings) == 0
+	return matches, complete, nil
+}
+
+// webhookAllowed reports whether alerts may be posted to webhook:
+// the configured webhook, or an http or https URL on one of the
+// configured hosts. Anything else could make the server post search
+// results to internal services.
+func (ss *savedSearches) webhookAllowed(webhook string) bool {
+	if webhook == ss.webhook {
+		return true
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return ss.webhookHosts[strings.ToLower(u.Hostname())]
+}
+
+// postAlert sends alert to a webhook.
+func (ss *savedSearches) postAlert(ctx context.Context, webhook string, alert *api.SavedSearchAlert) error {
+	if !ss.webhookAllowed(webhook) {
+		return fmt.Errorf("webhook %s is not on an allowed host", webhook)
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ss.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("posting to webhook: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("posting to webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// runSavedSearch runs the saved search with the given id, posting an
+// alert to its webhook if its results have changed since the last
+// run. The run is recorded on the saved search, even if it fails. It
+// gives up once ctx is done.
+func (s *server) runSavedSearch(ctx context.Context, id string) (*api.SavedSearchAlert, error) {
+	ss := s.saved
+	ss.runMu.Lock()
+	defer ss.runMu.Unlock()
+
+	ss.mu.Lock()
+	search, ok := ss.searches[id]
+	if !ok {
+		ss.mu.Unlock()
+		return nil, errSavedSearchChanged
+	}
+	query := search.Query
+	owner := search.Owner
+	webhook := search.WebhookURL
+	rev := search.rev
+	primed := search.Primed
+	old := search.Matches
+	ss.mu.Unlock()
+
+	if webhook == "" {
+		webhook = ss.webhook
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, savedSearchTimeout)
+	defer cancel()
+	if _, ok := reqid.FromContext(ctx); !ok {
+		ctx = reqid.NewContext(ctx, reqid.New())
+	}
+	if owner != "" {
+		ctx = auth.NewContext(ctx, auth.Identity{User: owner, Provider: "saved"})
+	}
+
+	alert := &api.SavedSearchAlert{}
+	var baseline []*api.SavedMatch
+	matches, complete, err := s.savedSearchMatches(ctx, &query)
+	if err == nil {
+		alert.Added, alert.Removed, baseline = diffMatches(old, matches, complete)
+		if !primed {
+			// The first run only records a baseline.
+			alert.Added, alert.Removed = nil, nil
+		}
+	}
+
+	ss.mu.Lock()
+	search, ok = ss.searches[id]
+	if !ok || search.rev != rev {
+		ss.mu.Unlock()
+		return nil, errSavedSearchChanged
+	}
+	snapshot := search.SavedSearch
+	snapshot.LastRun = time.Now().Unix()
+	ss.mu.Unlock()
+
+	alert.Search = &snapshot
+	changed := len(alert.Added) > 0 || len(alert.Removed) > 0
+	if err == nil && changed && webhook != "" {
+		err = ss.postAlert(ctx, webhook, alert)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	search, ok = ss.searches[id]
+	if !ok || search.rev != rev {
+		return nil, errSavedSearchChanged
+	}
+	search.LastRun = snapshot.LastRun
+	if err != nil {
+		// Keep the old baseline, so that changes are reported
+		// again by the next successful run.
+		search.LastError = err.Error()
+		log.Warnf(ctx, "saved search failed id=%s err=%q", id, err.Error())
+	} else {
+		search.LastError = ""
+		search.Primed = true
+		search.Matches = baseline
+		search.MatchCount = len(baseline)
+		log.Printf(ctx, "saved search ran id=%s matches=%d added=%d removed=%d",
+			id, len(baseline), len(alert.Added), len(alert.Removed))
+	}
+	if e := ss.save(); e != nil {
+		log.Errorf(ctx, "saving saved searches err=%q", e.Error())
+	}
+	snapshot = search.SavedSearch
+	alert.Search = &snapshot
+	return alert, err
+}
+
+func newSavedSearchId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// checkSavedSearch validates the client-settable fields of a saved
+// search.
+func (s *server) checkSavedSearch(in *api.SavedSearch) *apiError {
+	if _, _, e := s.queryFromRequest(&in.Query); e != nil {
+		if e.inner.Field != "" {
+			e.inner.Field = "query." + e.inner.Field
+		}
+		return e
+	}
+	if in.Query.Cursor != "" {
+		return fieldError("query.cursor", "saved searches cannot have a cursor")
+	}
+	if in.WebhookURL != "" {
+		u, err := url.Parse(in.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fieldError("webhook_url", "must be an http or https URL")
+		}
+		if !s.saved.webhookAllowed(in.WebhookURL) {
+			return fieldError("webhook_url", "must be on one of the hosts in saved_searches.webhook_hosts")
+		}
+	}
+	return nil
+}
+
+func (s *server) decodeSavedSearch(w http.ResponseWriter, r *http.Request) (*api.SavedSearch, *apiError) {
+	var in api.SavedSearch
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSearchRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, decodeError(err)
+	}
+	if e := s.checkSavedSearch(&in); e != nil {
+		return nil, e
+	}
+	if in.Name == "" {
+		in.Name = in.Query.Line
+	}
+	return &in, nil
+}
+
+// savedEnabled writes an error and returns false if saved searches are
+// not configured.
+func (s *server) savedEnabled(ctx context.Context, w http.ResponseWriter) bool {
+	if s.saved == nil {
+		writeError(ctx, w, 404, "not_found", "Saved searches not enabled")
+		return false
+	}
+	return true
+}
+
+// mayAccess reports whether the user making a request may see, change
+// and run search. Only its owner and admins may, since a run searches
+// as the owner.
+func (s *server) mayAccess(ctx context.Context, search *savedSearch) bool {
+	id, _ := auth.FromContext(ctx)
+	return search.Owner == id.User || s.isAdmin(ctx)
+}
+
+// lookupSaved returns the saved search with the given id if the user
+// making a request may access it. It must be called with s.saved.mu
+// held.
+func (s *server) lookupSaved(ctx context.Context, id string) (*savedSearch, bool) {
+	search, ok := s.saved.searches[id]
+	if !ok || !s.mayAccess(ctx, search) {
+		return nil, false
+	}
+	return search, true
+}
+
+func (s *server) ServeAPISavedList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	ss := s.saved
+	ss.mu.Lock()
+	reply := &api.ReplySavedSearches{
+		Searches: make([]*api.SavedSearch, 0, len(ss.searches)),
+	}
+	for _, search := range ss.searches {
+		if !s.mayAccess(ctx, search) {
+			continue
+		}
+		out := search.SavedSearch
+		reply.Searches = append(reply.Searches, &out)
+	}
+	ss.mu.Unlock()
+	sort.Slice(reply.Searches, func(i, j int) bool {
+		a, b := reply.Searches[i], reply.Searches[j]
+		if a.Created != b.Created {
+			return a.Created < b.Created
+		}
+		return a.Id < b.Id
+	})
+	replyJSON(ctx, w, 200, reply)
+}
+
+func (s *server) ServeAPISavedCreate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	in, e := s.decodeSavedSearch(w, r)
+	if e != nil {
+		writeAPIError(ctx, w, e)
+		return
+	}
+
+	now := time.Now().Unix()
+	search := &savedSearch{SavedSearch: api.SavedSearch{
+		Id:         newSavedSearchId(),
+		Name:       in.Name,
+		Query:      in.Query,
+		WebhookURL: in.WebhookURL,
+		Created:    now,
+		Updated:    now,
+	}}
+	if id, ok := auth.FromContext(ctx); ok {
+		search.Owner = id.User
+	}
+
+	ss := s.saved
+	ss.mu.Lock()
+	ss.searches[search.Id] = search
+	err := ss.save()
+	out := search.SavedSearch
+	ss.mu.Unlock()
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", fmt.Sprint("Saving search: ", err))
+		return
+	}
+
+	log.Printf(ctx, "saved search created id=%s query=%s", out.Id, asJSON{out.Query})
+	replyJSON(ctx, w, 201, &out)
+}
+
+func (s *server) ServeAPISavedGet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	ss := s.saved
+	ss.mu.Lock()
+	search, ok := s.lookupSaved(ctx, r.URL.Query().Get(":id"))
+	var out api.SavedSearch
+	if ok {
+		out = search.SavedSearch
+	}
+	ss.mu.Unlock()
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	replyJSON(ctx, w, 200, &out)
+}
+
+func (s *server) ServeAPISavedUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	ss := s.saved
+	// Check for the search first, so that users who can't see it
+	// get the same reply whatever they send.
+	ss.mu.Lock()
+	_, ok := s.lookupSaved(ctx, id)
+	ss.mu.Unlock()
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	in, e := s.decodeSavedSearch(w, r)
+	if e != nil {
+		writeAPIError(ctx, w, e)
+		return
+	}
+
+	ss.mu.Lock()
+	search, ok := s.lookupSaved(ctx, id)
+	if !ok {
+		ss.mu.Unlock()
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	if !reflect.DeepEqual(search.Query, in.Query) {
+		// The old matches mean nothing for the new query.
+		search.Primed = false
+		search.Matches = nil
+		search.MatchCount = 0
+	}
+	search.Name = in.Name
+	search.Query = in.Query
+	search.WebhookURL = in.WebhookURL
+	search.Updated = time.Now().Unix()
+	search.rev++
+	err := ss.save()
+	out := search.SavedSearch
+	ss.mu.Unlock()
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", fmt.Sprint("Saving search: ", err))
+		return
+	}
+
+	log.Printf(ctx, "saved search updated id=%s query=%s", out.Id, asJSON{out.Query})
+	replyJSON(ctx, w, 200, &out)
+}
+
+func (s *server) ServeAPISavedDelete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	ss := s.saved
+	ss.mu.Lock()
+	_, ok := s.lookupSaved(ctx, id)
+	var err error
+	if ok {
+		delete(ss.searches, id)
+		err = ss.save()
+	}
+	ss.mu.Unlock()
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", fmt.Sprint("Saving searches: ", err))
+		return
+	}
+
+	log.Printf(ctx, "saved search deleted id=%s", id)
+	w.WriteHeader(204)
+}
+
+func (s *server) ServeAPISavedRun(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.savedEnabled(ctx, w) {
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	s.saved.mu.Lock()
+	_, ok := s.lookupSaved(ctx, id)
+	s.saved.mu.Unlock()
+	if !ok {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+
+	alert, err := s.runSavedSearch(ctx, id)
+	if err != nil {
+		if e, ok := err.(*apiError); ok {
+			writeAPIError(ctx, w, e)
+		} else {
+			writeError(ctx, w, 500, "saved_search_failed", err.Error())
+		}
+		return
+	}
+	replyJSON(ctx, w, 200, alert)
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/auth"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// fakeCodeSearch is a backend that finds a fixed set of lines, each in
+// its own file.
+type fakeCodeSearch struct {
+	lines []string
+	// The outgoing metadata of the last search.
+	md metadata.MD
+}
+
+func (f *fakeCodeSearch) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	return &pb.ServerInfo{}, nil
+}
+
+func (f *fakeCodeSearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	f.md, _ = metadata.FromOutgoingContext(ctx)
+	out := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+	for _, line := range f.lines {
+		out.Results = append(out.Results, &pb.SearchResult{
+			Tree:   "repo",
+			Path:   line + ".go",
+			Line:   line,
+			Bounds: &pb.Bounds{},
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeCodeSearch) Reload(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+func TestDiffMatches(t *testing.T) {
+	m := func(line string) *api.SavedMatch {
+		return &api.SavedMatch{Tree: "repo", Path: "a.go", Line: line}
+	}
+	old := []*api.SavedMatch{m("a"), m("b")}
+	cur := []*api.SavedMatch{m("b"), m("c")}
+
+	added, removed, baseline := diffMatches(old, cur, true)
+	if len(added) != 1 || added[0].Line != "c" || len(removed) != 1 || removed[0].Line != "a" {
+		t.Errorf("complete: added=%v removed=%v", added, removed)
+	}
+	if len(baseline) != 2 {
+		t.Errorf("complete: expected the new matches as the baseline, got %v", baseline)
+	}
+
+	added, removed, baseline = diffMatches(old, cur, false)
+	if len(added) != 1 || len(removed) != 0 || len(baseline) != 3 {
+		t.Errorf("incomplete: added=%v removed=%v baseline=%v", added, removed, baseline)
+	}
+}
+
+func TestSavedSearchAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alerts := make(chan *api.SavedSearchAlert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert api.SavedSearchAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("decoding alert: %v", err)
+		}
+		alerts <- &alert
+	}))
+	defer hook.Close()
+
+	cfg := &config.SavedSearches{
+		Path:       filepath.Join(dir, "saved.json"),
+		WebhookURL: hook.URL,
+	}
+	saved, err := newSavedSearches(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &fakeCodeSearch{lines: []string{"key1", "key2"}}
+	s := &server{
+		config:  &config.Config{DefaultMaxMatches: 50},
+		bk:      map[string]*Backend{"a": {Id: "a", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"a"},
+		saved:   saved,
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeAPISavedCreate(context.Background(), w,
+		httptest.NewRequest("POST", "/api/v1/saved", strings.NewReader(`{"query":{"line":"key\\d"}}`)))
+	if w.Code != 201 {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	var created api.SavedSearch
+	json.NewDecoder(w.Body).Decode(&created)
+
+	// The first run only records a baseline.
+	if _, err := s.runSavedSearch(context.Background(), created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Errorf("expected no alert from the first run")
+	}
+
+	cs.lines = []string{"key2", "key3"}
+	if _, err := s.runSavedSearch(context.Background(), created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("expected an alert, got %d", len(alerts))
+	}
+	alert := <-alerts
+	if len(alert.Added) != 1 || alert.Added[0].Line != "key3" ||
+		len(alert.Removed) != 1 || alert.Removed[0].Line != "key1" {
+		t.Errorf("unexpected alert: added=%v removed=%v", alert.Added, alert.Removed)
+	}
+	if alert.Search.Id != created.Id || alert.Search.MatchCount != 2 {
+		t.Errorf("unexpected search in alert: %+v", alert.Search)
+	}
+
+	// Nothing changed, so nothing is sent.
+	if _, err := s.runSavedSearch(context.Background(), created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Errorf("expected no alert when nothing changed")
+	}
+
+	// The matches survive a restart.
+	reloaded, err := newSavedSearches(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := reloaded.searches[created.Id]
+	if search == nil || !search.Primed || len(search.Matches) != 2 {
+		t.Errorf("unexpected saved search after reload: %+v", search)
+	}
+}
+
+func TestSavedSearchOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved, err := newSavedSearches(&config.SavedSearches{Path: filepath.Join(dir, "saved.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		config: &config.Config{
+			DefaultMaxMatches: 50,
+			Auth:              config.Auth{Admins: []string{"root"}},
+		},
+		bk: map[string]*Backend{"a": {Id: "a", I: &I{},
+			Codesearch: &fakeCodeSearch{lines: []string{"key1"}}}},
+		bkOrder: []string{"a"},
+		saved:   saved,
+	}
+	as := func(user string) context.Context {
+		return auth.NewContext(context.Background(), auth.Identity{User: user})
+	}
+	call := func(user string, f func(context.Context, http.ResponseWriter, *http.Request), method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f(as(user), w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+	list := func(user string) int {
+		w := call(user, s.ServeAPISavedList, "GET", "/api/v1/saved", "")
+		var reply api.ReplySavedSearches
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("list as %s: %v", user, err)
+		}
+		return len(reply.Searches)
+	}
+
+	w := call("alice", s.ServeAPISavedCreate, "POST", "/api/v1/saved", `{"query":{"line":"key"}}`)
+	if w.Code != 201 {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	var created api.SavedSearch
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Owner != "alice" {
+		t.Errorf("owner = %q, want alice", created.Owner)
+	}
+	idURL := "/api/v1/saved/" + created.Id + "?:id=" + created.Id
+	runURL := "/api/v1/saved/" + created.Id + "/run?:id=" + created.Id
+	evil := `{"query":{"line":"password"},"webhook_url":"https://evil.example.com/"}`
+
+	// Another user can't see, change, run or delete it.
+	if n := list("bob"); n != 0 {
+		t.Errorf("bob lists %d searches, want 0", n)
+	}
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"get":    call("bob", s.ServeAPISavedGet, "GET", idURL, ""),
+		"update": call("bob", s.ServeAPISavedUpdate, "PUT", idURL, evil),
+		"run":    call("bob", s.ServeAPISavedRun, "POST", runURL, ""),
+		"delete": call("bob", s.ServeAPISavedDelete, "DELETE", idURL, ""),
+	} {
+		if w.Code != 404 {
+			t.Errorf("%s as bob: got %d, want 404", name, w.Code)
+		}
+	}
+	search := saved.searches[created.Id]
+	if search == nil || search.Query.Line != "key" || search.WebhookURL != "" || search.LastRun != 0 {
+		t.Fatalf("bob changed the search: %+v", search)
+	}
+
+	// Its owner and admins can.
+	if n := list("alice"); n != 1 {
+		t.Errorf("alice lists %d searches, want 1", n)
+	}
+	if n := list("root"); n != 1 {
+		t.Errorf("root lists %d searches, want 1", n)
+	}
+	if w := call("root", s.ServeAPISavedGet, "GET", idURL, ""); w.Code != 200 {
+		t.Errorf("get as root: got %d", w.Code)
+	}
+	if w := call("alice", s.ServeAPISavedRun, "POST", runURL, ""); w.Code != 200 {
+		t.Errorf("run as alice: got %d %s", w.Code, w.Body.String())
+	}
+	w = call("root", s.ServeAPISavedUpdate, "PUT", idURL, `{"query":{"line":"key2"}}`)
+	if w.Code != 200 || saved.searches[created.Id].Owner != "alice" {
+		t.Errorf("update as root: got %d, owner %q", w.Code, saved.searches[created.Id].Owner)
+	}
+	if w := call("alice", s.ServeAPISavedDelete, "DELETE", idURL, ""); w.Code != 204 {
+		t.Errorf("delete as alice: got %d", w.Code)
+	}
+}
+
+func TestSavedSearchWebhookHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved, err := newSavedSearches(&config.SavedSearches{
+		Path:         filepath.Join(dir, "saved.json"),
+		WebhookURL:   "https://alerts.example.com/default",
+		WebhookHosts: []string{"Hooks.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		config:  &config.Config{DefaultMaxMatches: 50},
+		bk:      map[string]*Backend{"a": {Id: "a", I: &I{}, Codesearch: &fakeCodeSearch{}}},
+		bkOrder: []string{"a"},
+		saved:   saved,
+	}
+
+	cases := []struct {
+		body  string
+		code  int
+		field string
+	}{
+		{`{"query":{"line":"x"},"webhook_url":"https://hooks.example.com/alert"}`, 201, ""},
+		{`{"query":{"line":"x"},"webhook_url":"https://alerts.example.com/default"}`, 201, ""},
+		{`{"query":{"line":"x"},"webhook_url":"http://169.254.169.254/latest/meta-data/"}`, 400, "webhook_url"},
+		{`{"query":{"line":"x"},"webhook_url":"http://localhost:8080/"}`, 400, "webhook_url"},
+		{`{"query":{"line":"x"},"webhook_url":"https://hooks.example.com.evil.com/"}`, 400, "webhook_url"},
+		{`{"query":{"line":"x"},"webhook_ur1":"https://hooks.example.com/"}`, 400, "webhook_ur1"},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		s.ServeAPISavedCreate(context.Background(), w,
+			httptest.NewRequest("POST", "/api/v1/saved", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d %s, want %d", tc.body, w.Code, w.Body.String(), tc.code)
+			continue
+		}
+		if tc.code != 400 {
+			continue
+		}
+		var reply api.ReplyError
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Err.Field != tc.field {
+			t.Errorf("%s: got error %s, want one on %q", tc.body, w.Body.String(), tc.field)
+		}
+	}
+
+	// A webhook saved before its host was disallowed isn't posted to.
+	if err := saved.postAlert(context.Background(), "http://127.0.0.1:1/", &api.SavedSearchAlert{}); err == nil ||
+		!strings.Contains(err.Error(), "not on an allowed host") {
+		t.Errorf("posted to a disallowed webhook: %v", err)
+	}
+}
+
+func TestSavedSearchRunHonorsContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livegrep-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved, err := newSavedSearches(&config.SavedSearches{Path: filepath.Join(dir, "saved.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gated := &gatedCodeSearch{release: make(chan struct{})}
+	defer close(gated.release)
+	s := &server{
+		config:  &config.Config{DefaultMaxMatches: 50},
+		bk:      map[string]*Backend{"a": {Id: "a", I: &I{}, Codesearch: gated}},
+		bkOrder: []string{"a"},
+		saved:   saved,
+	}
+	w := httptest.NewRecorder()
+	s.ServeAPISavedCreate(context.Background(), w,
+		httptest.NewRequest("POST", "/api/v1/saved", strings.NewReader(`{"query":{"line":"x"}}`)))
+	var created api.SavedSearch
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+
+	// A run by hand stops with its request, not after the saved
+	// search timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.runSavedSearch(ctx, created.Id)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("a cancelled run succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a cancelled run kept going")
+	}
+}
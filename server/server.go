@@ -1,26 +1,30 @@
 package server
 
 import (
+	"expvar"
 	"fmt"
 	"html/template"
-	"io"
-	stdlog "log"
 	"net/http"
+	"net/http/pprof"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	texttemplate "text/template"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/bmizerany/pat"
-	libhoney "github.com/honeycombio/libhoney-go"
 
+	"github.com/livegrep/livegrep/server/auth"
 	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
+	"github.com/livegrep/livegrep/server/middleware"
 	"github.com/livegrep/livegrep/server/reqid"
 	"github.com/livegrep/livegrep/server/templates"
+	"github.com/livegrep/livegrep/server/trace"
 )
 
 type Templates struct {
@@ -35,28 +39,51 @@ type Templates struct {
 }
 
 type server struct {
-	config      *config.Config
+	// mu guards config, repos, T, and AssetHashes, which are
+	// replaced when the config is reloaded. Use cfg, repoMap, tmpl
+	// and assetHashes to read them.
+	mu     sync.RWMutex
+	config *config.Config
+	// bk and bkOrder are replaced, never modified, when backends
+	// are added or removed. Use backend and backendList to read
+	// them. bkCfgs holds the configurations they were set from.
+	bkMu        sync.RWMutex
 	bk          map[string]*Backend
 	bkOrder     []string
+	bkCfgs      []config.Backend
 	repos       map[string]config.RepoConfig
 	inner       http.Handler
-	T           Templates
+	T           *Templates
 	AssetHashes map[string]string
 	Layout      *template.Template
 
-	honey *libhoney.Builder
+	events EventSink
+	cache  *searchCache
+	acl    *repoACL
+	saved  *savedSearches
+
+	// reloadMu serializes config reloads and backend discovery.
+	reloadMu    sync.Mutex
+	loader      func() (*config.Config, error)
+	discoverers []discoverer
+
+	// When the server started, for reporting on backends that have
+	// never answered.
+	started time.Time
 }
 
-func (s *server) loadTemplates() {
-	s.AssetHashes = make(map[string]string)
+func loadTemplates(docRoot string) (*Templates, map[string]string, error) {
+	t := &Templates{}
+	hashes := make(map[string]string)
 	err := templates.Load(
-		path.Join(s.config.DocRoot, "templates"),
-		&s.T,
-		path.Join(s.config.DocRoot, "hashes.txt"),
-		s.AssetHashes)
+		path.Join(docRoot, "templates"),
+		t,
+		path.Join(docRoot, "hashes.txt"),
+		hashes)
 	if err != nil {
-		panic(fmt.Sprintf("loading templates: %v", err))
+		return nil, nil, fmt.Errorf("loading templates: %v", err)
 	}
+	return t, hashes, nil
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -64,16 +91,17 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	urls := make(map[string]map[string]string, len(s.bk))
-	backends := make([]*Backend, 0, len(s.bk))
+	backends := s.backendList()
+	urls := make(map[string]map[string]string, len(backends))
 	sampleRepo := ""
-	for _, bkId := range s.bkOrder {
-		bk := s.bk[bkId]
-		backends = append(backends, bk)
+	for _, bk := range backends {
 		bk.I.Lock()
 		m := make(map[string]string, len(bk.I.Trees))
 		urls[bk.Id] = m
 		for _, r := range bk.I.Trees {
+			if !s.repoAllowed(ctx, r.Name) {
+				continue
+			}
 			if sampleRepo == "" {
 				sampleRepo = r.Name
 			}
@@ -89,14 +117,14 @@ func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http
 		RepoUrls           map[string]map[string]string `json:"repo_urls"`
 		InternalViewRepos  map[string]config.RepoConfig `json:"internal_view_repos"`
 		DefaultSearchRepos []string                     `json:"default_search_repos"`
-	}{urls, s.repos, s.config.DefaultSearchRepos}
+	}{urls, s.visibleRepos(ctx), s.cfg().DefaultSearchRepos}
 
-	body, err := executeTemplate(s.T.Index, page_data)
+	body, err := executeTemplate(ctx, "index", s.tmpl().Index, page_data)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	s.renderPage(w, &page{
+	s.renderPage(ctx, w, &page{
 		Title:         "code search",
 		ScriptName:    "codesearch",
 		ScriptData:    script_data,
@@ -113,18 +141,18 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 		commit = "HEAD"
 	}
 
-	if len(s.repos) == 0 {
+	if len(s.repoMap()) == 0 {
 		http.Error(w, "File browsing not enabled", 404)
 		return
 	}
 
-	repo, ok := s.repos[repoName]
+	repo, ok := s.lookupRepo(ctx, repoName)
 	if !ok {
 		http.Error(w, "No such repo", 404)
 		return
 	}
 
-	data, err := buildFileData(path, repo, commit)
+	data, err := buildFileData(ctx, path, repo, commit)
 	if err != nil {
 		http.Error(w, fmt.Sprint("500 Error reading file: ", err), 500)
 		return
@@ -135,12 +163,13 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 		Commit   string            `json:"commit"`
 	}{repo, commit}
 
-	body, err := executeTemplate(s.T.FileView, data)
+	body, err := executeTemplate(ctx, "fileview", s.tmpl().FileView, data)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	s.renderPage(w, &page{
+	s.sendBrowseEvent(ctx, "file", repo.Name, path, commit, false)
+	s.renderPage(ctx, w, &page{
 		Title:         data.PathSegments[len(data.PathSegments)-1].Name,
 		ScriptName:    "fileview",
 		ScriptData:    script_data,
@@ -164,27 +193,28 @@ func (s *server) ServeLog(ctx context.Context, w http.ResponseWriter, r *http.Re
 		}
 	}
 
-	repo, ok := s.repos[repoName]
+	repo, ok := s.lookupRepo(ctx, repoName)
 	if !ok {
 		http.Error(w, "No such repo", 404)
 		return
 	}
 
-	gitHistory, ok := histories[repo.Name]
-	if !ok {
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
 		http.Error(w, "Repo not configued for log", 404)
 		return
 	}
 
-	logData, err := buildLogData(repo, gitHistory, path, offset)
+	logData, err := buildLogData(ctx, repo, gitHistory, path, offset)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	err = s.T.LogFile.Execute(w, map[string]interface{}{
+	s.sendBrowseEvent(ctx, "log", repo.Name, path, "", false)
+	err = renderTemplate(ctx, w, "log", s.tmpl().LogFile, map[string]interface{}{
 		"cssTag": templates.LinkTag("stylesheet",
-			"/assets/css/blame.css", s.AssetHashes),
+			"/assets/css/blame.css", s.assetHashes()),
 		"path":    path,
 		"repo":    repo,
 		"logData": logData,
@@ -195,7 +225,7 @@ func (s *server) ServeLog(ctx context.Context, w http.ResponseWriter, r *http.Re
 }
 
 func (s *server) parseBlameURL(r *http.Request) (string, string, error) {
-	if len(s.repos) == 0 {
+	if len(s.repoMap()) == 0 {
 		return "", "", fmt.Errorf("File browsing not enabled")
 	}
 	repoName := r.URL.Query().Get(":repo")
@@ -210,14 +240,14 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
-	repo, ok := s.repos[repoName]
+	repo, ok := s.lookupRepo(ctx, repoName)
 	if !ok {
 		http.Error(w, "No such repo", 404)
 		return
 	}
 
-	gitHistory, ok := histories[repo.Name]
-	if !ok {
+	gitHistory := getHistory(repo.Name)
+	if gitHistory == nil {
 		http.Error(w, "Repo not configured for blame", 404)
 		return
 	}
@@ -245,25 +275,26 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 
 	isDiff := false // TODO: remove
 	data := BlameData{}
-	resolveCommit(repo, hash, path, &data)
+	resolveCommit(ctx, repo, hash, path, &data)
 	if data.CommitHash != hash {
 		pat1 := "/" + hash + "/"
 		pat2 := "/" + data.CommitHash + "/"
 		destURL := strings.Replace(r.URL.Path, pat1, pat2, 1)
 		http.Redirect(w, r, destURL, 307)
 	}
-	err = buildBlameData(repo, hash, gitHistory, path, isDiff, &data)
+	err = buildBlameData(ctx, repo, hash, gitHistory, path, isDiff, &data)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
 	}
-	t := s.T.BlameFile
+	s.sendBrowseEvent(ctx, "blame", repo.Name, path, hash, false)
+	t := s.tmpl().BlameFile
 	if isDiff {
-		t = s.T.BlameDiff
+		t = s.tmpl().BlameDiff
 	}
-	err = t.Execute(w, map[string]interface{}{
+	err = renderTemplate(ctx, w, "blame", t, map[string]interface{}{
 		"cssTag": templates.LinkTag("stylesheet",
-			"/assets/css/blame.css", s.AssetHashes),
+			"/assets/css/blame.css", s.assetHashes()),
 		"repo":       repo,
 		"path":       path,
 		"commitHash": hash,
@@ -271,30 +302,30 @@ func (s *server) ServeBlame(ctx context.Context, w http.ResponseWriter, r *http.
 		"content":    data.Content,
 	})
 	if err != nil {
-		stdlog.Print("Cannot render template: ", err)
+		log.Errorf(ctx, "Cannot render template: %s", err)
 	}
 }
 
 func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	if len(s.repos) == 0 {
+	if len(s.repoMap()) == 0 {
 		http.Error(w, "404 Repository browsing not enabled", 404)
 		return
 	}
 	repoName := r.URL.Query().Get(":repo")
 	hash := r.URL.Query().Get(":hash")
-	repo, ok := s.repos[repoName]
+	repo, ok := s.lookupRepo(ctx, repoName)
 	if !ok {
 		http.Error(w, "404 No such repository", 404)
 		return
 	}
 	rest := pat.Tail("/diff/:repo/:hash/", r.URL.Path)
 	if len(rest) > 0 {
-		diffRedirect(w, r, repoName, hash, rest)
+		diffRedirect(ctx, w, r, repoName, hash, rest)
 		return
 	}
 	data := DiffData{}
 	data2 := BlameData{}
-	resolveCommit(repo, hash, "", &data2)
+	resolveCommit(ctx, repo, hash, "", &data2)
 	data.CommitHash = data2.CommitHash
 	data.Author = data2.Author
 	data.Date = data2.Date
@@ -304,32 +335,33 @@ func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.R
 	// 	http.Redirect(w, r, data.CommitHash, 307)
 	// }
 
-	err := buildDiffData(repo, hash, &data)
+	err := buildDiffData(ctx, repo, hash, &data)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
 	}
 
-	err = s.T.BlameDiff.Execute(w, map[string]interface{}{
+	s.sendBrowseEvent(ctx, "diff", repo.Name, "", hash, false)
+	err = renderTemplate(ctx, w, "diff", s.tmpl().BlameDiff, map[string]interface{}{
 		"cssTag": templates.LinkTag("stylesheet",
-			"/assets/css/blame.css", s.AssetHashes),
+			"/assets/css/blame.css", s.assetHashes()),
 		"repo":       repo,
 		"path":       "NONE",
 		"commitHash": hash,
 		"blame":      data,
 	})
 	if err != nil {
-		stdlog.Print("Cannot render template: ", err)
+		log.Errorf(ctx, "Cannot render template: %s", err)
 	}
 }
 
 func (s *server) ServeAbout(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	body, err := executeTemplate(s.T.About, nil)
+	body, err := executeTemplate(ctx, "about", s.tmpl().About, nil)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	s.renderPage(w, &page{
+	s.renderPage(ctx, w, &page{
 		Title:         "about",
 		IncludeHeader: true,
 		Body:          template.HTML(body),
@@ -341,28 +373,14 @@ func (s *server) ServeHelp(ctx context.Context, w http.ResponseWriter, r *http.R
 	http.Redirect(w, r, "/search", 303)
 }
 
-func (s *server) ServeHealthcheck(w http.ResponseWriter, r *http.Request) {
-	// All backends must have (at some point) reported an index age for us to
-	// report as healthy.
-	// TODO: report as unhealthy if a backend goes down after we've spoken to
-	// it.
-	for _, bk := range s.bk {
-		if bk.I.IndexTime.IsZero() {
-			http.Error(w, fmt.Sprintf("unhealthy backend '%s' '%s'\n", bk.Id, bk.Addr), 500)
-			return
-		}
-	}
-	io.WriteString(w, "ok\n")
-}
-
 type stats struct {
 	IndexAge int64 `json:"index_age"`
 }
 
 func (s *server) ReloadIndexes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	if err := initBlame(s.config); err != nil {
+	if err := initBlame(ctx, s.cfg()); err != nil {
 		message := fmt.Sprint("Error reloading blame data: ", err)
-		log.Printf(ctx, message)
+		log.Errorf(ctx, "%s", message)
 		http.Error(w, message, 500)
 		return
 	}
@@ -373,7 +391,7 @@ func (s *server) ServeStats(ctx context.Context, w http.ResponseWriter, r *http.
 	// For index age, report the age of the stalest backend's index.
 	now := time.Now()
 	maxBkAge := time.Duration(-1) * time.Second
-	for _, bk := range s.bk {
+	for _, bk := range s.backendList() {
 		if bk.I.IndexTime.IsZero() {
 			// backend didn't report index time
 			continue
@@ -389,7 +407,7 @@ func (s *server) ServeStats(ctx context.Context, w http.ResponseWriter, r *http.
 }
 
 func (s *server) requestProtocol(r *http.Request) string {
-	if s.config.ReverseProxy {
+	if s.cfg().ReverseProxy {
 		if proto := r.Header.Get("X-Real-Proto"); len(proto) > 0 {
 			return proto
 		}
@@ -407,14 +425,14 @@ func (s *server) ServeOpensearch(ctx context.Context, w http.ResponseWriter, r *
 		BaseURL: s.requestProtocol(r) + "://" + r.Host + "/",
 	}
 
-	for _, bk := range s.bk {
+	for _, bk := range s.backendList() {
 		if bk.I.Name != "" {
 			data.BackendName = bk.I.Name
 			break
 		}
 	}
 
-	body, err := executeTemplate(s.T.OpenSearch, data)
+	body, err := executeTemplate(ctx, "opensearch", s.tmpl().OpenSearch, data)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -424,66 +442,165 @@ func (s *server) ServeOpensearch(ctx context.Context, w http.ResponseWriter, r *
 	w.Write(body)
 }
 
-type handler func(c context.Context, w http.ResponseWriter, r *http.Request)
+type handler struct {
+	name string
+	f    func(c context.Context, w http.ResponseWriter, r *http.Request)
+	// If set, f sets its own deadline instead of RequestTimeout.
+	untimed bool
+}
 
 const RequestTimeout = 8 * time.Second
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
-	defer cancel()
-	ctx = reqid.NewContext(ctx, reqid.New())
-	log.Printf(ctx, "http request: remote=%q method=%q url=%q",
+	start := time.Now()
+	// Derived from the request so that work stops when the client
+	// goes away. It also carries the user that authenticated.
+	ctx := r.Context()
+	if !h.untimed {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RequestTimeout)
+		defer cancel()
+	}
+	id, ok := reqid.Parse(r.Header.Get("X-Request-Id"))
+	if !ok {
+		id = reqid.New()
+	}
+	ctx = reqid.NewContext(ctx, id)
+	w.Header().Set("X-Request-Id", string(id))
+	if sc, ok := trace.ParseTraceparent(r.Header.Get("Traceparent")); ok {
+		ctx = trace.NewContext(ctx, sc)
+	}
+	ctx, span := trace.Start(ctx, h.name)
+	span.Kind = trace.Server
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.RequestURI())
+	span.SetAttr("request_id", string(id))
+	if user, ok := auth.FromContext(ctx); ok {
+		span.SetAttr("user", user.User)
+	}
+	ctx = log.NewContext(ctx, log.Fields{"handler": h.name})
+	middleware.AddAccessFields(r, log.Fields{
+		"request_id": string(id),
+		"handler":    h.name,
+		"trace_id":   span.TraceID.String(),
+	})
+	log.Debugf(ctx, "http request: remote=%q method=%q url=%q",
 		r.RemoteAddr, r.Method, r.URL)
-	h(ctx, w, r)
+	sw := middleware.NewStatusWriter(w)
+	h.f(ctx, sw, r)
+	httpRequests.Inc(h.name, strconv.Itoa(sw.Status()))
+	httpDuration.Observe(time.Since(start).Seconds(), h.name)
+	span.SetAttr("http.status_code", sw.Status())
+	if sw.Status() >= 500 {
+		span.SetError(fmt.Errorf("HTTP %d", sw.Status()))
+	}
+	span.Finish()
 }
 
 func (s *server) Handler(f func(c context.Context, w http.ResponseWriter, r *http.Request)) http.Handler {
-	return handler(f)
+	return handler{name: handlerName(f), f: f}
+}
+
+// untimedHandler is like Handler, but for handlers that may run for
+// longer than RequestTimeout and set their own deadline.
+func (s *server) untimedHandler(f func(c context.Context, w http.ResponseWriter, r *http.Request)) http.Handler {
+	return handler{name: handlerName(f), f: f, untimed: true}
+}
+
+func initTracing(cfg *config.Tracing) error {
+	service := cfg.ServiceName
+	if service == "" {
+		service = "livegrep"
+	}
+	var exporters []trace.Exporter
+	if cfg.OTLPEndpoint != "" {
+		exporters = append(exporters,
+			trace.NewOTLPExporter(cfg.OTLPEndpoint, cfg.OTLPHeaders, service))
+	}
+	if cfg.File != "" {
+		e, err := trace.NewFileExporter(cfg.File, service)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+	}
+	if len(exporters) > 0 {
+		log.Printf(context.Background(),
+			"Enabling tracing otlp=%q file=%q", cfg.OTLPEndpoint, cfg.File)
+		trace.SetExporter(trace.Multi(exporters...))
+	}
+	return nil
 }
 
 func New(cfg *config.Config) (http.Handler, error) {
 	srv := &server{
-		config: cfg,
-		bk:     make(map[string]*Backend),
-		repos:  make(map[string]config.RepoConfig),
+		config:  cfg,
+		bk:      make(map[string]*Backend),
+		repos:   repoMap(cfg),
+		started: time.Now(),
+	}
+	if err := log.Configure(cfg.Log.Level, cfg.Log.Format); err != nil {
+		return nil, err
+	}
+	t, hashes, err := loadTemplates(cfg.DocRoot)
+	if err != nil {
+		return nil, err
 	}
-	srv.loadTemplates()
+	srv.T, srv.AssetHashes = t, hashes
 
-	if err := initBlame(cfg); err != nil {
-		ctx := context.Background()
-		log.Printf(ctx, "Error: %s", err)
+	srv.cache = newSearchCache(cfg.SearchCache.Size,
+		time.Duration(cfg.SearchCache.TTLSeconds)*time.Second)
+
+	acl, err := newRepoACL(&cfg.ACL)
+	if err != nil {
 		return nil, err
 	}
+	srv.acl = acl
 
-	if cfg.Honeycomb.WriteKey != "" {
-		log.Printf(context.Background(),
-			"Enabling honeycomb dataset=%s", cfg.Honeycomb.Dataset)
-		srv.honey = libhoney.NewBuilder()
-		srv.honey.WriteKey = cfg.Honeycomb.WriteKey
-		srv.honey.Dataset = cfg.Honeycomb.Dataset
+	if err := initBlame(context.Background(), cfg); err != nil {
+		log.Errorf(context.Background(), "Error: %s", err)
+		return nil, err
 	}
 
-	for _, bk := range srv.config.Backends {
-		be, e := NewBackend(bk.Id, bk.Addr)
-		if e != nil {
-			return nil, e
-		}
-		be.Start()
-		srv.bk[be.Id] = be
-		srv.bkOrder = append(srv.bkOrder, be.Id)
+	srv.events, err = newEventSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := initTracing(&cfg.Tracing); err != nil {
+		return nil, err
+	}
+
+	srv.saved, err = newSavedSearches(&cfg.SavedSearches)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, r := range srv.config.IndexConfig.Repositories {
-		srv.repos[r.Name] = r
+	srv.discoverers = newDiscoverers(&cfg.Discovery)
+	if err := srv.refreshBackends(srv.discoverers); err != nil {
+		return nil, err
+	}
+	if len(srv.discoverers) > 0 {
+		go srv.runDiscovery(context.Background(), srv.discoverers)
+	}
+
+	srv.registerBackendMetrics()
+
+	if srv.saved != nil {
+		go srv.runSavedSearches()
 	}
 
 	m := pat.New()
 	m.Add("GET", "/log/:repo/", srv.Handler(srv.ServeLog))
 	m.Add("GET", "/blame/:repo/:hash/", srv.Handler(srv.ServeBlame))
 	m.Add("GET", "/diff/:repo/:hash/", srv.Handler(srv.ServeDiff))
-	m.Add("GET", "/debug/healthcheck", http.HandlerFunc(srv.ServeHealthcheck))
+	m.Add("GET", "/debug/healthcheck", http.HandlerFunc(srv.ServeReadiness))
+	m.Add("GET", "/debug/healthcheck/ready", http.HandlerFunc(srv.ServeReadiness))
+	m.Add("GET", "/debug/healthcheck/live", http.HandlerFunc(srv.ServeLiveness))
+	m.Add("GET", "/debug/backends", srv.Handler(srv.ServeDebugBackends))
+	m.Add("GET", "/metrics", metrics.Handler())
 	m.Add("GET", "/debug/reload-indexes", srv.Handler(srv.ReloadIndexes))
+	m.Add("POST", "/debug/reload-config", srv.Handler(srv.ServeReloadConfig))
 	m.Add("GET", "/debug/stats", srv.Handler(srv.ServeStats))
 	m.Add("GET", "/search/:backend", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/search/", srv.Handler(srv.ServeSearch))
@@ -493,25 +610,49 @@ func New(cfg *config.Config) (http.Handler, error) {
 	m.Add("GET", "/opensearch.xml", srv.Handler(srv.ServeOpensearch))
 	m.Add("GET", "/", srv.Handler(srv.ServeSearch))
 
+	m.Add("GET", "/api/v1/search/stream/:backend", srv.untimedHandler(srv.ServeAPISearchStream))
+	m.Add("GET", "/api/v1/search/stream/", srv.untimedHandler(srv.ServeAPISearchStream))
 	m.Add("GET", "/api/v1/search/:backend", srv.Handler(srv.ServeAPISearch))
 	m.Add("GET", "/api/v1/search/", srv.Handler(srv.ServeAPISearch))
-
-	var h http.Handler = m
-
-	if cfg.Reload {
-		h = templates.ReloadHandler(
-			path.Join(srv.config.DocRoot, "templates"),
-			&srv.T,
-			path.Join(srv.config.DocRoot, "hashes.txt"),
-			srv.AssetHashes,
-			h)
-	}
+	m.Add("GET", "/api/v1/backends", srv.Handler(srv.ServeAPIBackends))
+	m.Add("GET", "/api/v1/repos", srv.Handler(srv.ServeAPIRepos))
+	m.Add("GET", "/api/v1/file/:repo/", srv.Handler(srv.ServeAPIFile))
+	m.Add("GET", "/api/v1/blame/:repo/:hash/", srv.Handler(srv.ServeAPIBlame))
+	m.Add("GET", "/api/v1/diff/:repo/:hash", srv.Handler(srv.ServeAPIDiff))
+	m.Add("GET", "/api/v1/log/:repo/", srv.Handler(srv.ServeAPILog))
+	m.Add("GET", "/api/v1/parse", srv.Handler(srv.ServeAPIParse))
+	m.Add("GET", "/api/v1/saved", srv.Handler(srv.ServeAPISavedList))
+	m.Add("GET", "/api/v1/saved/:id", srv.Handler(srv.ServeAPISavedGet))
+	m.Add("POST", "/api/v1/saved", srv.Handler(srv.ServeAPISavedCreate))
+	m.Add("POST", "/api/v1/saved/:id/run", srv.Handler(srv.ServeAPISavedRun))
+	m.Add("PUT", "/api/v1/saved/:id", srv.Handler(srv.ServeAPISavedUpdate))
+	m.Add("DELETE", "/api/v1/saved/:id", srv.Handler(srv.ServeAPISavedDelete))
+	m.Add("POST", "/api/v1/search/batch", srv.untimedHandler(srv.ServeAPISearchBatch))
+	m.Add("POST", "/api/v1/search", srv.Handler(srv.ServeAPISearchPost))
+	m.Add("POST", "/api/v1/search/", srv.Handler(srv.ServeAPISearchPost))
 
 	mux := http.NewServeMux()
-	mux.Handle("/assets/", http.FileServer(http.Dir(path.Join(cfg.DocRoot, "htdocs"))))
-	mux.Handle("/", h)
-
-	srv.inner = mux
+	mux.HandleFunc("/assets/", srv.serveAssets)
+	mux.Handle("/", srv.reloadTemplates(m))
+	// The profiler and exported variables are served here rather
+	// than from http.DefaultServeMux so that they sit behind the
+	// same authentication as everything else.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	if cfg.Auth.TrustedHeader != "" && !cfg.ReverseProxy {
+		return nil, fmt.Errorf("auth.trusted_header requires reverse_proxy, since clients could otherwise set %s themselves",
+			cfg.Auth.TrustedHeader)
+	}
+	inner, err := middleware.RequireAuth(mux, &cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	srv.inner = middleware.AccessLog(inner)
 
 	return srv, nil
 }
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestHandlerPropagation(t *testing.T) {
+	cs := &fakeCodeSearch{lines: []string{"needle"}}
+	s := &server{
+		config:  &config.Config{DefaultMaxMatches: 50},
+		bk:      map[string]*Backend{"a": {Id: "a", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"a"},
+	}
+	h := s.Handler(s.ServeAPISearch)
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("GET", "/api/v1/search/?q=needle", nil)
+	r.Header.Set("X-Request-Id", "client-id-1")
+	r.Header.Set("Traceparent", parent)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("search failed: %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "client-id-1" {
+		t.Errorf("X-Request-Id = %q, want the client's", got)
+	}
+	if got := cs.md["request-id"]; len(got) != 1 || got[0] != "client-id-1" {
+		t.Errorf("backend got request-id %v", got)
+	}
+	tp := cs.md["traceparent"]
+	if len(tp) != 1 || !strings.HasPrefix(tp[0], "00-4bf92f3577b34da6a3ce929d0e0e4736-") || tp[0] == parent {
+		t.Errorf("backend got traceparent %v, want a child of %s", tp, parent)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/search/?q=needle", nil)
+	r.Header.Set("X-Request-Id", "bad id\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	got := w.Header().Get("X-Request-Id")
+	if got == "" || strings.Contains(got, " ") {
+		t.Errorf("X-Request-Id = %q, want a generated ID", got)
+	}
+	if id := cs.md["request-id"]; len(id) != 1 || id[0] != got {
+		t.Errorf("backend got request-id %v, want %q", id, got)
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	s := &server{config: &config.Config{}}
+	var hasDeadline bool
+	f := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = ctx.Deadline()
+	}
+
+	s.Handler(f).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !hasDeadline {
+		t.Errorf("Handler set no deadline")
+	}
+	s.untimedHandler(f).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if hasDeadline {
+		t.Errorf("untimedHandler set a deadline")
+	}
+}
+
+func TestDebugEndpointsRequireAuth(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+	s := newReloadServer(t, &config.Config{
+		DocRoot: docRoot,
+		Auth:    config.Auth{BearerTokens: map[string]string{"secret": "bob"}},
+	})
+	defer stopBackends(s)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 401 {
+			t.Errorf("%s without a token: got %d, want 401", path, w.Code)
+		}
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("%s with a token: got %d, want 200", path, w.Code)
+		}
+	}
+}
+
+func TestTrustedHeaderRequiresReverseProxy(t *testing.T) {
+	docRoot := testDocRoot(t)
+	defer os.RemoveAll(docRoot)
+	cfg := &config.Config{
+		DocRoot: docRoot,
+		Auth:    config.Auth{TrustedHeader: "X-Forwarded-User"},
+	}
+	if _, err := New(cfg); err == nil {
+		t.Errorf("trusted a header without a reverse proxy")
+	}
+	cfg.ReverseProxy = true
+	s := newReloadServer(t, cfg)
+	stopBackends(s)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/httpserve"
+	"github.com/livegrep/livegrep/server/log"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// streamWriter writes api.StreamFrames to the client as they are
+// produced, either as newline-delimited JSON or as Server-Sent Events.
+type streamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+}
+
+func wantsSSE(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "sse"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func newStreamWriter(w http.ResponseWriter, r *http.Request) (*streamWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	sw := &streamWriter{w: w, flusher: flusher, sse: wantsSSE(r)}
+	if sw.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	// Ask nginx and friends not to buffer the response.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	return sw, true
+}
+
+func (sw *streamWriter) Write(f *api.StreamFrame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if sw.sse {
+		_, err = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", f.Type, b)
+	} else {
+		_, err = fmt.Fprintf(sw.w, "%s\n", b)
+	}
+	if err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
+
+const defaultStreamTimeout = 60 * time.Second
+
+// streamTimeout is how long a streamed search may run. It is not
+// limited by RequestTimeout, since results are sent as they arrive.
+func (s *server) streamTimeout() time.Duration {
+	if n := s.cfg().StreamTimeoutSeconds; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultStreamTimeout
+}
+
+func (s *server) ServeAPISearchStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	backends, err := s.searchBackends(r.URL.Query().Get(":backend"))
+	if err != nil {
+		writeError(ctx, w, 400, "bad_backend", err.Error())
+		return
+	}
+
+	q, err := extractQuery(ctx, r)
+	if err != nil {
+		writeAPIError(ctx, w, queryParseError(r.URL.Query().Get("q"), err))
+		return
+	}
+
+	if err := s.checkQuery(&q); err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.streamTimeout())
+	defer cancel()
+	// The stream timeout bounds this response instead.
+	httpserve.NoWriteTimeout(r)
+
+	sw, ok := newStreamWriter(w, r)
+	if !ok {
+		writeError(ctx, w, 500, "internal_error", "Streaming is not supported")
+		return
+	}
+
+	if err := s.streamSearch(ctx, sw, backends, &q); err != nil {
+		log.Warnf(ctx, "error writing stream err=%s", err)
+	}
+}
+
+// streamSearch fans q out to backends and writes each backend's
+// results as soon as that backend replies, followed by a final "done"
+// frame with the merged stats.
+func (s *server) streamSearch(ctx context.Context, sw *streamWriter, backends []*Backend, q *pb.Query) error {
+	start := time.Now()
+
+	info := &api.Stats{ExitReason: pb.SearchStats_NONE.String()}
+	searchType := "normal"
+	if q.FilenameOnly {
+		searchType = "filename_only"
+	}
+
+	max := int(q.MaxMatches)
+	results, fileResults := 0, 0
+	truncated := false
+	succeeded, cached := 0, 0
+	var firstErr error
+
+	for br := range s.fanOut(ctx, backends, q) {
+		bk := backends[br.index]
+		if br.err != nil {
+			if firstErr == nil {
+				firstErr = br.err
+			}
+			log.Log(ctx, log.Warn, fmt.Sprintf("partial search results err=%s", br.err),
+				log.Fields{"backend": bk.Id})
+			if err := sw.Write(&api.StreamFrame{
+				Type:    "warning",
+				Backend: bk.Id,
+				Message: grpc.ErrorDesc(br.err),
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		succeeded++
+
+		for _, res := range br.reply.Results {
+			if max > 0 && results >= max {
+				truncated = true
+				break
+			}
+			results++
+			if err := sw.Write(&api.StreamFrame{
+				Type:    "result",
+				Backend: bk.Id,
+				Result:  res,
+			}); err != nil {
+				return err
+			}
+		}
+		for _, res := range br.reply.FileResults {
+			if max > 0 && fileResults >= max {
+				truncated = true
+				break
+			}
+			fileResults++
+			if err := sw.Write(&api.StreamFrame{
+				Type:       "file_result",
+				Backend:    bk.Id,
+				FileResult: res,
+			}); err != nil {
+				return err
+			}
+		}
+
+		mergeStats(info, br.reply.Info)
+		if br.reply.Info.Cached {
+			cached++
+		}
+		if err := sw.Write(&api.StreamFrame{
+			Type:    "backend",
+			Backend: bk.Id,
+			Info:    br.reply.Info,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if succeeded == 0 && firstErr != nil {
+		e := queryError(firstErr)
+		return sw.Write(&api.StreamFrame{Type: "error", Error: &e.inner})
+	}
+
+	if truncated && info.ExitReason == pb.SearchStats_NONE.String() {
+		info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+	}
+	info.TotalTime = int64(time.Since(start) / time.Millisecond)
+	info.Cached = cached == succeeded
+
+	s.sendSearchEvent(ctx, backends, q, results, info)
+
+	log.Printf(ctx,
+		"responding success streamed results=%d why=%s stats=%s",
+		results,
+		info.ExitReason,
+		asJSON{info})
+
+	return sw.Write(&api.StreamFrame{
+		Type:       "done",
+		Info:       info,
+		SearchType: searchType,
+	})
+}
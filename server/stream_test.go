@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// gatedCodeSearch is a fake backend whose searches wait for release
+// to be closed.
+type gatedCodeSearch struct {
+	fakeCodeSearch
+	release chan struct{}
+}
+
+func (g *gatedCodeSearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return g.fakeCodeSearch.Search(ctx, in, opts...)
+}
+
+func newTestServer(clients map[string]pb.CodeSearchClient, order ...string) *server {
+	s := &server{
+		config: &config.Config{DefaultMaxMatches: 50},
+		bk:     make(map[string]*Backend),
+	}
+	for _, id := range order {
+		s.bk[id] = &Backend{Id: id, I: &I{}, Codesearch: clients[id]}
+		s.bkOrder = append(s.bkOrder, id)
+	}
+	return s
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{
+		"a": &fakeCodeSearch{lines: []string{"x1", "x2"}},
+		"b": &fakeCodeSearch{lines: []string{"y1"}},
+	}, "a", "b")
+	w := httptest.NewRecorder()
+	s.untimedHandler(s.ServeAPISearchStream).ServeHTTP(w,
+		httptest.NewRequest("GET", "/api/v1/search/stream/?q=x", nil))
+
+	if w.Code != 200 {
+		t.Fatalf("stream failed: %d %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var frames []*api.StreamFrame
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		var f api.StreamFrame
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("bad frame %q: %v", line, err)
+		}
+		frames = append(frames, &f)
+	}
+
+	results := map[string]int{}
+	finished := map[string]bool{}
+	for _, f := range frames[:len(frames)-1] {
+		switch f.Type {
+		case "result":
+			if finished[f.Backend] {
+				t.Errorf("result from %s after its backend frame", f.Backend)
+			}
+			results[f.Backend]++
+		case "backend":
+			if f.Info == nil {
+				t.Errorf("backend frame for %s has no stats", f.Backend)
+			}
+			finished[f.Backend] = true
+		default:
+			t.Errorf("unexpected %q frame", f.Type)
+		}
+	}
+	if results["a"] != 2 || results["b"] != 1 || !finished["a"] || !finished["b"] {
+		t.Errorf("results = %v, finished = %v", results, finished)
+	}
+	done := frames[len(frames)-1]
+	if done.Type != "done" || done.Info == nil || done.SearchType != "normal" {
+		t.Errorf("last frame = %+v, want the final stats", done)
+	} else if done.Info.ExitReason != pb.SearchStats_NONE.String() {
+		t.Errorf("exit reason = %s", done.Info.ExitReason)
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{
+		"a": &fakeCodeSearch{lines: []string{"x1"}},
+	}, "a")
+	r := httptest.NewRequest("GET", "/api/v1/search/stream/?q=x", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	s.untimedHandler(s.ServeAPISearchStream).ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var events []string
+	for _, block := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "event: ") || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("bad event %q", block)
+		}
+		var f api.StreamFrame
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &f); err != nil {
+			t.Fatalf("bad event data %q: %v", lines[1], err)
+		}
+		event := strings.TrimPrefix(lines[0], "event: ")
+		if event != f.Type {
+			t.Errorf("event %q carries a %q frame", event, f.Type)
+		}
+		events = append(events, event)
+	}
+	if got := strings.Join(events, ","); got != "result,backend,done" {
+		t.Errorf("events = %s", got)
+	}
+}
+
+// TestStreamInterleaving checks that a backend's results are sent as
+// soon as it replies, without waiting for slower backends.
+func TestStreamInterleaving(t *testing.T) {
+	slow := &gatedCodeSearch{
+		fakeCodeSearch: fakeCodeSearch{lines: []string{"slow"}},
+		release:        make(chan struct{}),
+	}
+	s := newTestServer(map[string]pb.CodeSearchClient{
+		"slow": slow,
+		"fast": &fakeCodeSearch{lines: []string{"fast"}},
+	}, "slow", "fast")
+	ts := httptest.NewServer(s.untimedHandler(s.ServeAPISearchStream))
+	defer ts.Close()
+	defer func() {
+		select {
+		case <-slow.release:
+		default:
+			close(slow.release)
+		}
+	}()
+
+	resp, err := http.Get(ts.URL + "/api/v1/search/stream/?q=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	var order []string
+	for sc.Scan() {
+		var f api.StreamFrame
+		if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+			t.Fatalf("bad frame %q: %v", sc.Text(), err)
+		}
+		order = append(order, f.Type+":"+f.Backend)
+		// The slow backend can only reply once the fast one's
+		// results have reached the client.
+		if f.Type == "backend" && f.Backend == "fast" {
+			close(slow.release)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := "result:fast,backend:fast,result:slow,backend:slow,done:"
+	if got := strings.Join(order, ","); got != want {
+		t.Errorf("frames = %s, want %s", got, want)
+	}
+}
+
+func TestStreamBadQuery(t *testing.T) {
+	s := newTestServer(map[string]pb.CodeSearchClient{"a": &fakeCodeSearch{}}, "a")
+	w := httptest.NewRecorder()
+	s.untimedHandler(s.ServeAPISearchStream).ServeHTTP(w,
+		httptest.NewRequest("GET", "/api/v1/search/stream/?q=file:a+file:b+x", nil))
+
+	var reply api.ReplyError
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("bad reply %q: %v", w.Body.String(), err)
+	}
+	if w.Code != 400 || reply.Err.Code != "bad_query" || reply.Err.Span == nil {
+		t.Errorf("got %d %s, want a bad_query error with a span", w.Code, w.Body.String())
+	}
+}
@@ -3,11 +3,14 @@ package server
 import (
 	"bytes"
 	"io"
-	"log"
 
 	"html/template"
 
+	"golang.org/x/net/context"
+
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/trace"
 )
 
 type page struct {
@@ -24,19 +27,28 @@ type Template interface {
 	Execute(wr io.Writer, data interface{}) error
 }
 
-func executeTemplate(t Template, context interface{}) ([]byte, error) {
+// renderTemplate executes t, recording a span for it.
+func renderTemplate(ctx context.Context, w io.Writer, name string, t Template, data interface{}) error {
+	_, span := trace.Start(ctx, "template "+name)
+	defer span.Finish()
+	err := t.Execute(w, data)
+	span.SetError(err)
+	return err
+}
+
+func executeTemplate(ctx context.Context, name string, t Template, data interface{}) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := t.Execute(&buf, context); err != nil {
+	if err := renderTemplate(ctx, &buf, name, t, data); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (s *server) renderPage(w io.Writer, p *page) {
-	p.Config = s.config
-	p.AssetHashes = s.AssetHashes
-	if e := s.T.Layout.Execute(w, p); e != nil {
-		log.Printf("Error rendering page=%q error=%q",
+func (s *server) renderPage(ctx context.Context, w io.Writer, p *page) {
+	p.Config = s.cfg()
+	p.AssetHashes = s.assetHashes()
+	if e := renderTemplate(ctx, w, "layout", s.tmpl().Layout, p); e != nil {
+		log.Errorf(ctx, "Error rendering page=%q error=%q",
 			p.Title, e.Error())
 	}
 }
@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
 	"path"
@@ -15,6 +14,7 @@ import (
 	texttemplate "text/template"
 
 	"github.com/livegrep/livegrep/blameworthy"
+	"github.com/livegrep/livegrep/server/log"
 )
 
 func templatePath(f reflect.StructField) string {
@@ -145,7 +145,7 @@ func ReloadHandler(base string, templates interface{}, assetHashFile string, ass
 func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	e := Load(h.baseDir, h.t, h.assetHashFile, h.assetHashMap)
 	if e != nil {
-		log.Printf("loading templates: err=%v", e)
+		log.Errorf(r.Context(), "loading templates: err=%v", e)
 	}
 	h.in.ServeHTTP(w, r)
 }
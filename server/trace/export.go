@@ -0,0 +1,315 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// An Exporter receives finished spans. Export must not block.
+type Exporter interface {
+	Export(s *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sets where finished spans are sent. Spans are discarded
+// if e is nil.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func getExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// Multi returns an Exporter that sends spans to each of es.
+func Multi(es ...Exporter) Exporter {
+	return multi(es)
+}
+
+type multi []Exporter
+
+func (m multi) Export(s *Span) {
+	for _, e := range m {
+		e.Export(s)
+	}
+}
+
+// batcher collects spans, and passes them to send in batches from a
+// background goroutine. Spans are dropped if send can't keep up.
+type batcher struct {
+	spans    chan *Span
+	flush    chan chan struct{}
+	send     func([]*Span) error
+	maxBatch int
+	interval time.Duration
+}
+
+func newBatcher(send func([]*Span) error) *batcher {
+	b := &batcher{
+		spans:    make(chan *Span, 2048),
+		flush:    make(chan chan struct{}),
+		send:     send,
+		maxBatch: 256,
+		interval: 5 * time.Second,
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) Export(s *Span) {
+	select {
+	case b.spans <- s:
+	default:
+	}
+}
+
+// Flush sends any queued spans, and waits for them to be sent.
+func (b *batcher) Flush() {
+	done := make(chan struct{})
+	b.flush <- done
+	<-done
+}
+
+func (b *batcher) run() {
+	var batch []*Span
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.send(batch); err != nil {
+			log.Warnf(context.Background(), "trace: exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-b.spans:
+			batch = append(batch, s)
+			if len(batch) >= b.maxBatch {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-b.flush:
+			for len(b.spans) > 0 {
+				batch = append(batch, <-b.spans)
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding.
+type OTLPExporter struct {
+	*batcher
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter that POSTs spans to endpoint,
+// such as "http://localhost:4318/v1/traces", with the extra headers
+// given, reporting them as coming from service.
+func NewOTLPExporter(endpoint string, headers map[string]string, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	e.batcher = newBatcher(e.post)
+	return e
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int32:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpKeyValue{k, value})
+	}
+	return out
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpRequest builds the body of an OTLP ExportTraceServiceRequest.
+func (e *OTLPExporter) otlpRequest(spans []*Span) interface{} {
+	out := make([]*otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := &otlpSpan{
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Name:       s.Name,
+			Kind:       int(s.Kind) + 1, // SPAN_KIND_INTERNAL is 1
+			Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: otlpAttrs(s.Attrs()),
+		}
+		if s.Parent.IsValid() {
+			o.ParentSpanID = s.Parent.String()
+		}
+		if err := s.Err(); err != nil {
+			o.Status.Code = 2 // STATUS_CODE_ERROR
+			o.Status.Message = err.Error()
+		}
+		out = append(out, o)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttrs(map[string]interface{}{
+						"service.name": e.service,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "livegrep"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) error {
+	body, err := json.Marshal(e.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// FileExporter appends spans to a file as JSON, one per line. It is
+// meant for local testing.
+type FileExporter struct {
+	*batcher
+	f       *os.File
+	service string
+}
+
+// FileSpan is the JSON form of a span written by FileExporter.
+type FileSpan struct {
+	Service    string                 `json:"service"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func NewFileExporter(path, service string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &FileExporter{f: f, service: service}
+	e.batcher = newBatcher(e.write)
+	return e, nil
+}
+
+func (e *FileExporter) write(spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		fs := FileSpan{
+			Service:    e.service,
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind.String(),
+			Start:      s.Start.UTC(),
+			DurationMS: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Attributes: s.Attrs(),
+		}
+		if s.Parent.IsValid() {
+			fs.ParentID = s.Parent.String()
+		}
+		if err := s.Err(); err != nil {
+			fs.Error = err.Error()
+		}
+		if err := enc.Encode(&fs); err != nil {
+			return err
+		}
+	}
+	_, err := e.f.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,215 @@
+// Package trace records spans describing the work done to serve a
+// request, propagating W3C trace context in and out of livegrep, and
+// exports them for distributed tracing.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext identifies a span, and is what is propagated between
+// processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent parses the value of a W3C traceparent header.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may
+	// append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 != 0
+	return sc, true
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Traceparent formats sc as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	Server
+	Client
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	}
+	return "internal"
+}
+
+// A Span records one operation. Spans are created with Start and
+// must be finished with End.
+type Span struct {
+	SpanContext
+	Parent SpanID
+	Name   string
+	Kind   Kind
+	Start  time.Time
+	End    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+// SetAttr sets an attribute on s. Values should be strings, bools,
+// integers, or floats.
+func (s *Span) SetAttr(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// Attrs returns a copy of s's attributes.
+func (s *Span) Attrs() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make(map[string]interface{}, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// SetError marks s as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *Span) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Finish ends s and hands it to the exporter, if it is sampled.
+// Calls after the first are ignored.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if !s.Sampled {
+		return
+	}
+	if e := getExporter(); e != nil {
+		e.Export(s)
+	}
+}
+
+type key int
+
+const (
+	spanKey key = iota
+	remoteKey
+)
+
+// NewContext returns a context whose spans will be children of the
+// remote span sc.
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// FromContext returns the context of the span ctx is in, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if s, ok := ctx.Value(spanKey).(*Span); ok {
+		return s.SpanContext, true
+	}
+	sc, ok := ctx.Value(remoteKey).(SpanContext)
+	return sc, ok
+}
+
+// Start begins a span called name, a child of the span in ctx if
+// there is one, and returns a context containing it.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	s := &Span{Name: name, Start: time.Now()}
+	if parent, ok := FromContext(ctx); ok {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		randomBytes(s.TraceID[:])
+		s.Sampled = true
+	}
+	randomBytes(s.SpanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+}
@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		in      string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, tc := range cases {
+		sc, ok := ParseTraceparent(tc.in)
+		if ok != tc.ok {
+			t.Errorf("ParseTraceparent(%q): ok=%v, want %v", tc.in, ok, tc.ok)
+			continue
+		}
+		if ok && sc.Sampled != tc.sampled {
+			t.Errorf("ParseTraceparent(%q): sampled=%v, want %v", tc.in, sc.Sampled, tc.sampled)
+		}
+	}
+
+	in := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, _ := ParseTraceparent(in)
+	if got := sc.Traceparent(); got != in {
+		t.Errorf("Traceparent() = %q, want %q", got, in)
+	}
+}
+
+type recorder []*Span
+
+func (r *recorder) Export(s *Span) { *r = append(*r, s) }
+
+func TestStartPropagates(t *testing.T) {
+	var rec recorder
+	SetExporter(&rec)
+	defer SetExporter(nil)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := Start(NewContext(context.Background(), remote), "root")
+	_, child := Start(ctx, "child")
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if len(rec) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(rec))
+	}
+	if root.TraceID != remote.TraceID || root.Parent != remote.SpanID {
+		t.Errorf("root not a child of the remote span: %+v", root.SpanContext)
+	}
+	if child.TraceID != remote.TraceID || child.Parent != root.SpanID {
+		t.Errorf("child not a child of root: %+v", child.SpanContext)
+	}
+
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, s := Start(NewContext(context.Background(), unsampled), "unsampled")
+	s.Finish()
+	if len(rec) != 2 {
+		t.Errorf("exported an unsampled span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			t.Errorf("missing configured header")
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	e := NewOTLPExporter(srv.URL, map[string]string{"Authorization": "secret"}, "livegrep-test")
+	_, s := Start(context.Background(), "search")
+	s.Kind = Client
+	s.SetAttr("backend", "main")
+	s.SetError(errors.New("boom"))
+	s.Finish()
+	e.Export(s)
+	e.Flush()
+
+	spans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	got := spans[0].(map[string]interface{})
+	if got["traceId"] != s.TraceID.String() || got["name"] != "search" || got["kind"] != float64(3) {
+		t.Errorf("bad span: %v", got)
+	}
+	if got["status"].(map[string]interface{})["message"] != "boom" {
+		t.Errorf("error not recorded: %v", got["status"])
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	e, err := NewFileExporter(path, "livegrep-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttr("n", 3)
+	for _, s := range []*Span{child, parent} {
+		s.Finish()
+		e.Export(s)
+	}
+	e.Flush()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var spans []FileSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s FileSpan
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].ParentID != parent.SpanID.String() ||
+		spans[0].Attributes["n"] != float64(3) {
+		t.Errorf("bad child span: %+v", spans[0])
+	}
+	if spans[1].ParentID != "" || spans[1].Service != "livegrep-test" {
+		t.Errorf("bad parent span: %+v", spans[1])
+	}
+}